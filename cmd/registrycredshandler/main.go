@@ -1,34 +1,90 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/v3io/registry-creds-handler/pkg/admission"
 	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/credentialhelper"
+	"github.com/v3io/registry-creds-handler/pkg/credentialprovider"
+	"github.com/v3io/registry-creds-handler/pkg/doctor"
+	"github.com/v3io/registry-creds-handler/pkg/notifier"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
 	"github.com/v3io/registry-creds-handler/pkg/registry/factory"
 	"github.com/v3io/registry-creds-handler/pkg/registrycredshandler"
+	"github.com/v3io/registry-creds-handler/pkg/remediation"
+	"github.com/v3io/registry-creds-handler/pkg/verifier"
 
 	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
 	"github.com/v3io/version-go"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	runCommand      = "run"
+	syncCommand     = "sync"
+	cleanupCommand  = "cleanup"
+	getTokenCommand = "get-token"
+	doctorCommand   = "doctor"
+
+	credentialHelperCommand   = "credential-helper"
+	credentialProviderCommand = "credential-provider"
+
+	// configPathEnv is the config path default, as docker runs credential helpers without arguments
+	configPathEnv = "REGISTRY_CREDS_HANDLER_CONFIG"
+
+	cleanupTimeout = 5 * time.Minute
 )
 
 func run() error {
 
+	// commands are given as the first argument, defaulting to run
+	command, args := parseCommand(os.Args[1:])
+
 	// args
 	verbose := flag.Bool("verbose", false, "Allow verbosity logging")
 	registryKind := flag.String("registry-kind", "ecr", "Docker registry kind to authenticate against (Default: ecr)")
 	secretName := flag.String("secret-name", "", "Secret name to create or update with refreshed registry credentials")
 	namespace := flag.String("namespace", "", "Kubernetes namespace to create secret on")
-	registryUri := flag.String("registry-uri", "", "Registry URI to use for authentication")
+	registryUri := flag.String("registry-uri", "", "Registry URI to use for authentication (optional for ecr, discovered from the authorization token)")
 	refreshRate := flag.Int64("refresh-rate", 60, "Refresh credentials rate in min (Default: 60 minutes)")
+	configPath := flag.String("config", os.Getenv(configPathEnv), "Config file path (YAML or JSON) describing registries and target secrets, overrides registry and secret flags (Default: $"+configPathEnv+")")
 	kubeConfigPath := flag.String("kubeconfig-path", "", "Kubernetes config path, If not specified uses in cluster config")
 	creds := flag.String("creds", "", "Credentials to retrieve registry authorization token in JSON format, entries must be in lowerCamelCase")
 	showVersion := flag.Bool("version", false, "Show version in j and exit")
+	secretFormat := flag.String("secret-format", "dockerconfigjson", "Secret format (dockerconfigjson|dockercfg|basic-auth|containers-auth) (Default: dockerconfigjson)")
+	merge := flag.Bool("merge", false, "Merge registry credentials into an existing secret, keeping entries of other registries")
+	once := flag.Bool("once", false, "Run a single refresh of all registries and secrets, then exit (same as the sync command)")
+	dryRun := flag.Bool("dry-run", false, "Print a redacted per-namespace diff of what would change, writing nothing")
+	dryRunPlaceholders := flag.Bool("dry-run-placeholders", false, "Plan with placeholder tokens instead of fetching tokens from the registries")
+	registryName := flag.String("registry-name", "", "Registry (by its config name) to get a token from, defaults to the first registry (get-token)")
+	outputFormat := flag.String("output-format", "login", "Token output format (login|password|dockerconfigjson|credential-helper) (get-token)")
+	cleanupOnShutdown := flag.Bool("cleanup-on-shutdown", false, "Remove what the handler created and was the last to write when shutting down")
 	logsFormat := flag.String("logs-format", "humanreadable", "Logging format (json|humanreadable) (Default: humanreadable)")
+	admissionListenAddress := flag.String("admission-listen-address", "", "Address to serve the mutating admission webhook adding pull secrets to pods on (e.g.: :8443), empty to disable (run)")
+	admissionTLSCertPath := flag.String("admission-tls-cert", "", "Admission webhook TLS certificate path (run)")
+	admissionTLSKeyPath := flag.String("admission-tls-key", "", "Admission webhook TLS key path (run)")
+	tokenCacheDir := flag.String("token-cache-dir", credentialhelper.GetDefaultTokenCacheDir(), "Directory to cache tokens in between invocations, empty to disable caching (credential-helper)")
 
-	flag.Parse()
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [run|sync|cleanup|get-token|doctor|credential-helper|credential-provider] [flags] [get|list|store|erase]\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return errors.Wrap(err, "Failed to parse flags")
+	}
 
 	if *showVersion {
 		encodedVersionInfo, _ := json.Marshal(version.Get())
@@ -36,33 +92,591 @@ func run() error {
 		return nil
 	}
 
-	logger, err := common.CreateLogger("main", *verbose, os.Stdout, *logsFormat)
+	// commands printing to stdout log to stderr
+	logsOutput := os.Stdout
+	if command == getTokenCommand ||
+		command == doctorCommand ||
+		command == credentialHelperCommand ||
+		command == credentialProviderCommand ||
+		*dryRun {
+		logsOutput = os.Stderr
+	}
+
+	logger, err := common.CreateLogger("main", *verbose, logsOutput, *logsFormat)
 	if err != nil {
 		return errors.Wrap(err, "Failed to create logger")
 	}
 
-	// create clients
-	kubeClientSet, err := common.NewKubeClientSet(*kubeConfigPath)
+	// get-token does not need a cluster
+	if command == getTokenCommand {
+		registryConfig, err := loadRegistryConfig(*configPath, *registryName, *registryKind, *creds, *registryUri)
+		if err != nil {
+			return errors.Wrap(err, "Failed to load registry config")
+		}
+		return getToken(logger, registryConfig, common.TokenOutputFormat(*outputFormat))
+	}
+
+	// neither does the credential helper, which replies to docker on stdout
+	if command == credentialHelperCommand {
+		return runCredentialHelper(logger,
+			flag.Arg(0),
+			*configPath,
+			*registryKind,
+			*creds,
+			*registryUri,
+			*tokenCacheDir)
+	}
+
+	// and neither does the kubelet credential provider plugin, which replies to kubelet on stdout
+	if command == credentialProviderCommand {
+		return runCredentialProvider(logger, *configPath, *registryKind, *creds, *registryUri)
+	}
+
+	if command == doctorCommand {
+		return runDoctor(logger,
+			*configPath,
+			*kubeConfigPath,
+			*registryKind,
+			*secretName,
+			*namespace,
+			*creds,
+			*registryUri,
+			common.SecretFormat(*secretFormat),
+			os.Stdout)
+	}
+
+	if *once && command == runCommand {
+		command = syncCommand
+	}
+
+	switch command {
+	case cleanupCommand:
+
+		// the configured targets are cleaned up, along with what the config instance created by its labels. With
+		// neither a config file nor a secret, only the default instance secrets are found by their labels
+		handlerConfig := &config.Config{Instance: config.DefaultInstance}
+		if *configPath != "" {
+			if handlerConfig, err = config.Load(*configPath); err != nil {
+				return errors.Wrap(err, "Failed to load config")
+			}
+		} else if *secretName != "" {
+			if handlerConfig, err = compileConfigFromFlags(*registryKind,
+				*secretName,
+				*namespace,
+				*creds,
+				*registryUri,
+				*refreshRate,
+				*merge,
+				common.SecretFormat(*secretFormat)); err != nil {
+				return errors.Wrap(err, "Failed to compile config from flags")
+			}
+		}
+
+		var kubeClientSet kubernetes.Interface
+		if len(handlerConfig.Targets) == 0 || handlerConfig.RequiresCluster() {
+			if kubeClientSet, err = common.NewKubeClientSet(*kubeConfigPath); err != nil {
+				return errors.Wrap(err, "Failed to create k8s clientset")
+			}
+		}
+
+		handler, err := createHandler(logger, kubeClientSet, handlerConfig)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create handler")
+		}
+		if *dryRun {
+			plans, err := handler.PlanCleanup(context.Background())
+			if err != nil {
+				return errors.Wrap(err, "Failed to plan cleanup")
+			}
+			fmt.Print(common.FormatSecretPlans(plans))
+			return nil
+		}
+		return cleanup(handler)
+
+	case runCommand, syncCommand:
+
+		// load config, falling back to a single registry and secret given by flags
+		var handlerConfig *config.Config
+		if *configPath != "" {
+			if handlerConfig, err = config.Load(*configPath); err != nil {
+				return errors.Wrap(err, "Failed to load config")
+			}
+		} else {
+			if handlerConfig, err = compileConfigFromFlags(*registryKind,
+				*secretName,
+				*namespace,
+				*creds,
+				*registryUri,
+				*refreshRate,
+				*merge,
+				common.SecretFormat(*secretFormat)); err != nil {
+				return errors.Wrap(err, "Failed to compile config from flags")
+			}
+		}
+
+		// files are written without a cluster, e.g.: by a sidecar without Kubernetes API access
+		var kubeClientSet kubernetes.Interface
+		if handlerConfig.RequiresCluster() || *cleanupOnShutdown {
+			if kubeClientSet, err = common.NewKubeClientSet(*kubeConfigPath); err != nil {
+				return errors.Wrap(err, "Failed to create k8s clientset")
+			}
+		}
+
+		handler, err := createHandler(logger, kubeClientSet, handlerConfig)
+		if err != nil {
+			return errors.Wrap(err, "Failed to create handler")
+		}
+
+		if *dryRun {
+			plans, err := handler.Plan(context.Background(), *dryRunPlaceholders)
+			if err != nil {
+				return errors.Wrap(err, "Failed to plan")
+			}
+			fmt.Print(common.FormatSecretPlans(plans))
+			return nil
+		}
+
+		if command == syncCommand {
+			ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+			defer cancel()
+
+			return handler.Sync(ctx)
+		}
+
+		// run until we are signaled to stop
+		ctx, cancel := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+		defer cancel()
+
+		// the admission webhook runs alongside the refreshers, stopping the handler if it fails
+		if *admissionListenAddress != "" {
+			admissionServer, err := admission.NewServer(logger, handler, admission.Options{
+				ListenAddress: *admissionListenAddress,
+				CertPath:      *admissionTLSCertPath,
+				KeyPath:       *admissionTLSKeyPath,
+			})
+			if err != nil {
+				return errors.Wrap(err, "Failed to create admission server")
+			}
+			go func() {
+				if err := admissionServer.Start(ctx); err != nil {
+					logger.WarnWith("Admission server failed, stopping", "err", err.Error())
+					cancel()
+				}
+			}()
+		}
+
+		startErr := handler.Start(ctx)
+		if *cleanupOnShutdown {
+			if err := cleanupWrittenOnShutdown(handler); err != nil {
+				return errors.Wrap(err, "Failed to clean up on shutdown")
+			}
+		}
+		if startErr != nil {
+			return errors.Wrap(startErr, "Failed to start handler")
+		}
+		return nil
+
+	default:
+		return errors.Errorf("Unknown command: %s", command)
+	}
+}
+
+// parseCommand splits the command from its flags, commands are given as the first argument, defaulting to run.
+// When installed as docker-credential-<name>, the binary is a credential helper
+func parseCommand(args []string) (string, []string) {
+	if credentialhelper.IsCredentialHelperBinary(filepath.Base(os.Args[0])) {
+		return credentialHelperCommand, args
+	}
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		return args[0], args[1:]
+	}
+	return runCommand, args
+}
+
+// createHandler creates a handler, along with its registries, from config
+func createHandler(logger logger.Logger,
+	kubeClientSet kubernetes.Interface,
+	handlerConfig *config.Config) (*registrycredshandler.Handler, error) {
+
+	// create registries
+	var sources []*registrycredshandler.Source
+	for index := range handlerConfig.Registries {
+		source, err := createSource(logger, &handlerConfig.Registries[index])
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create source")
+		}
+		sources = append(sources, source)
+	}
+
+	var targets []*config.Target
+	for index := range handlerConfig.Targets {
+		targets = append(targets, &handlerConfig.Targets[index])
+	}
+
+	handler, err := registrycredshandler.NewHandler(logger, kubeClientSet, sources, targets)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create new handler")
+	}
+	if handlerConfig.Instance != "" {
+		handler.SetInstance(handlerConfig.Instance)
+	}
+
+	if handlerConfig.Notifications != nil {
+		var notifiers []notifier.Notifier
+		for _, notificationWebhook := range handlerConfig.Notifications.Webhooks {
+			webhookNotifier, err := notifier.NewWebhookNotifier(logger, notificationWebhook)
+			if err != nil {
+				return nil, errors.Wrap(err, "Failed to create webhook notifier")
+			}
+			notifiers = append(notifiers, webhookNotifier)
+		}
+		handler.SetNotifiers(notifiers,
+			time.Duration(handlerConfig.Notifications.NearExpiryThreshold)*time.Minute)
+	}
+
+	// pods are only remediated in a cluster
+	if handlerConfig.Remediation != nil && kubeClientSet != nil {
+		remediator, err := remediation.NewRemediator(logger,
+			kubeClientSet,
+			handlerConfig.Remediation.MaxPodsPerMinute)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create remediator")
+		}
+		handler.SetRemediator(remediator)
+	}
+
+	return handler, nil
+}
+
+// createSource creates a registry from its config
+func createSource(logger logger.Logger, configRegistry *config.Registry) (*registrycredshandler.Source, error) {
+	registry, err := factory.CreateRegistry(logger,
+		configRegistry.Kind,
+		"",
+		"",
+		configRegistry.GetCreds(),
+		configRegistry.RegistryUri)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to create registry: %s", configRegistry.Name)
+	}
+
+	source := &registrycredshandler.Source{
+		Name:         configRegistry.Name,
+		Kind:         configRegistry.Kind,
+		Registry:     registry,
+		RegistryUri:  configRegistry.RegistryUri,
+		RefreshRate:  time.Duration(configRegistry.RefreshRate) * time.Minute,
+		RegistryUris: configRegistry.RegistryUris,
+	}
+
+	if configRegistry.Verify != nil {
+		if source.Verifier, err = verifier.NewVerifier(logger, *configRegistry.Verify); err != nil {
+			return nil, errors.Wrapf(err, "Failed to create verifier of registry: %s", configRegistry.Name)
+		}
+	}
+
+	return source, nil
+}
+
+// loadRegistryConfig returns a registry by name from the config file, or the registry given by flags when
+// there is no config file
+func loadRegistryConfig(configPath string,
+	registryName string,
+	registryKind string,
+	creds string,
+	registryUri string) (*config.Registry, error) {
+
+	if configPath == "" {
+		return compileRegistryConfigFromFlags(registryKind, creds, registryUri, config.DefaultRefreshRate)
+	}
+
+	handlerConfig, err := config.Load(configPath)
 	if err != nil {
-		return errors.Wrap(err, "Failed to create k8s clientset")
+		return nil, errors.Wrap(err, "Failed to load config")
 	}
 
-	// create registry
-	registry, err := factory.CreateRegistry(logger, *registryKind, *secretName, *namespace, *creds, *registryUri)
+	if registryName == "" {
+		return &handlerConfig.Registries[0], nil
+	}
+	for index := range handlerConfig.Registries {
+		if handlerConfig.Registries[index].Name == registryName {
+			return &handlerConfig.Registries[index], nil
+		}
+	}
+	return nil, errors.Errorf("Registry not found in config: %s", registryName)
+}
+
+// getToken prints a registry token, fetched through the same code path the handler uses
+func getToken(logger logger.Logger, registryConfig *config.Registry, outputFormat common.TokenOutputFormat) error {
+	source, err := createSource(logger, registryConfig)
 	if err != nil {
-		return errors.Wrap(err, "Failed to create k8s clientset")
+		return errors.Wrap(err, "Failed to create source")
 	}
 
-	// start handler
-	handler, err := registrycredshandler.NewHandler(logger, kubeClientSet, registry, *refreshRate, *registryKind)
+	handler, err := registrycredshandler.NewHandler(logger, nil, []*registrycredshandler.Source{source}, nil)
 	if err != nil {
 		return errors.Wrap(err, "Failed to create new handler")
 	}
-	if err = handler.Start(); err != nil {
-		return errors.Wrap(err, "Failed to start handler")
+
+	token, err := handler.GetToken(context.Background(), source.Name)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get token")
+	}
+
+	formattedToken, err := common.FormatToken(token, outputFormat)
+	if err != nil {
+		return errors.Wrap(err, "Failed to format token")
+	}
+
+	_, err = os.Stdout.Write(formattedToken)
+	return err
+}
+
+// runCredentialHelper runs a docker credential helper action against the registries of the config file,
+// or the registry given by flags when there is no config file
+func runCredentialHelper(logger logger.Logger,
+	action string,
+	configPath string,
+	registryKind string,
+	creds string,
+	registryUri string,
+	tokenCacheDir string) error {
+
+	handler, err := createRegistriesHandler(logger, configPath, registryKind, creds, registryUri)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create registries handler")
+	}
+
+	helper, err := credentialhelper.NewHelper(logger, handler, credentialhelper.NewTokenCache(tokenCacheDir))
+	if err != nil {
+		return errors.Wrap(err, "Failed to create credential helper")
+	}
+
+	return helper.Run(context.Background(), action, os.Stdin, os.Stdout)
+}
+
+// runCredentialProvider replies to a kubelet credential provider request with the registries of the config
+// file, or the registry given by flags when there is no config file
+func runCredentialProvider(logger logger.Logger,
+	configPath string,
+	registryKind string,
+	creds string,
+	registryUri string) error {
+
+	handler, err := createRegistriesHandler(logger, configPath, registryKind, creds, registryUri)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create registries handler")
+	}
+
+	provider, err := credentialprovider.NewProvider(logger, handler)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create credential provider")
+	}
+
+	return provider.Run(context.Background(), os.Stdin, os.Stdout)
+}
+
+// runDoctor checks the whole credentials path of the config file, or of the registry and secret given by flags,
+// printing the outcome of each check along with how to fix it to output
+func runDoctor(logger logger.Logger,
+	configPath string,
+	kubeConfigPath string,
+	registryKind string,
+	secretName string,
+	namespace string,
+	creds string,
+	registryUri string,
+	secretFormat common.SecretFormat,
+	output io.Writer) error {
+
+	ctx := context.Background()
+	handlerDoctor, err := doctor.NewDoctor(logger)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create doctor")
+	}
+
+	// report whatever was checked, however far the checks got
+	defer func() {
+		fmt.Fprint(output, handlerDoctor.Format())
+	}()
+
+	var handlerConfig *config.Config
+	switch {
+	case configPath != "":
+		handlerConfig, err = config.Load(configPath)
+	case secretName != "":
+		handlerConfig, err = compileConfigFromFlags(registryKind,
+			secretName,
+			namespace,
+			creds,
+			registryUri,
+			config.DefaultRefreshRate,
+			false,
+			secretFormat)
+	default:
+		var registryConfig *config.Registry
+		if registryConfig, err = compileRegistryConfigFromFlags(registryKind,
+			creds,
+			registryUri,
+			config.DefaultRefreshRate); err == nil {
+			handlerConfig = &config.Config{Registries: []config.Registry{*registryConfig}}
+		}
+	}
+	if err != nil {
+		handlerDoctor.Record("config", &registry.Diagnosis{
+			Check:   "parse",
+			Status:  registry.DiagnosisStatusFail,
+			Message: errors.RootCause(err).Error(),
+			Fix:     "Fix the config file (--config), or the registry and secret flags",
+		})
+		return errors.New("Doctor found failures")
+	}
+	handlerDoctor.Record("config", &registry.Diagnosis{
+		Check:  "parse",
+		Status: registry.DiagnosisStatusPass,
+		Message: fmt.Sprintf("%d registries and %d targets",
+			len(handlerConfig.Registries),
+			len(handlerConfig.Targets)),
+	})
+
+	var kubeClientSet kubernetes.Interface
+	if handlerConfig.RequiresCluster() {
+		if kubeClientSet, err = common.NewKubeClientSet(kubeConfigPath); err != nil {
+			handlerDoctor.Record("kubernetes", &registry.Diagnosis{
+				Check:   "client",
+				Status:  registry.DiagnosisStatusFail,
+				Message: errors.RootCause(err).Error(),
+				Fix:     "Set --kubeconfig-path, or run the handler in the cluster",
+			})
+		}
+	}
+
+	// the registries are checked on their own, targets are checked by access reviews
+	registriesConfig := *handlerConfig
+	registriesConfig.Targets = nil
+	handler, err := createHandler(logger, nil, &registriesConfig)
+	if err != nil {
+		handlerDoctor.Record("config", &registry.Diagnosis{
+			Check:   "registries",
+			Status:  registry.DiagnosisStatusFail,
+			Message: errors.RootCause(err).Error(),
+			Fix:     "Fix the registries creds (e.g.: region, accessKeyID and secretAccessKey of ecr registries)",
+		})
+		return errors.New("Doctor found failures")
+	}
+
+	handlerDoctor.CheckRegistries(ctx, handler)
+
+	if kubeClientSet != nil {
+		var targets []*config.Target
+		for index := range handlerConfig.Targets {
+			targets = append(targets, &handlerConfig.Targets[index])
+		}
+		handlerDoctor.CheckAccess(ctx, kubeClientSet, targets)
+	}
+
+	if handlerDoctor.Failed() {
+		return errors.New("Doctor found failures")
+	}
+	return nil
+}
+
+// createRegistriesHandler creates a handler without a cluster or targets, for getting tokens of the registries
+// of the config file, or of the registry given by flags when there is no config file
+func createRegistriesHandler(logger logger.Logger,
+	configPath string,
+	registryKind string,
+	creds string,
+	registryUri string) (*registrycredshandler.Handler, error) {
+
+	handlerConfig := &config.Config{}
+	if configPath != "" {
+		var err error
+		if handlerConfig, err = config.Load(configPath); err != nil {
+			return nil, errors.Wrap(err, "Failed to load config")
+		}
+	} else {
+		registryConfig, err := compileRegistryConfigFromFlags(registryKind, creds, registryUri, config.DefaultRefreshRate)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to compile registry config from flags")
+		}
+		handlerConfig.Registries = []config.Registry{*registryConfig}
+	}
+
+	return createHandler(logger, nil, handlerConfig)
+}
+
+func cleanup(handler *registrycredshandler.Handler) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	return handler.Cleanup(ctx)
+}
+
+func cleanupWrittenOnShutdown(handler *registrycredshandler.Handler) error {
+	ctx, cancel := context.WithTimeout(context.Background(), cleanupTimeout)
+	defer cancel()
+
+	return handler.CleanupOnShutdown(ctx)
+}
+
+func compileConfigFromFlags(registryKind string,
+	secretName string,
+	namespace string,
+	creds string,
+	registryUri string,
+	refreshRate int64,
+	merge bool,
+	secretFormat common.SecretFormat) (*config.Config, error) {
+
+	if secretName == "" {
+		return nil, errors.New("Secret Name must not be empty")
+	}
+
+	registryConfig, err := compileRegistryConfigFromFlags(registryKind, creds, registryUri, refreshRate)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to compile registry config from flags")
+	}
+
+	handlerConfig := &config.Config{
+		Registries: []config.Registry{*registryConfig},
+		Targets: []config.Target{
+			{
+				SecretName: secretName,
+				Namespace:  namespace,
+				Merge:      merge,
+				Format:     secretFormat,
+			},
+		},
+	}
+
+	if err := handlerConfig.EnrichAndValidate(); err != nil {
+		return nil, errors.Wrap(err, "Failed to enrich and validate config")
+	}
+
+	return handlerConfig, nil
+}
+
+func compileRegistryConfigFromFlags(registryKind string,
+	creds string,
+	registryUri string,
+	refreshRate int64) (*config.Registry, error) {
+
+	registryConfig := &config.Registry{
+		Name:        registryKind,
+		Kind:        registryKind,
+		RegistryUri: registryUri,
+		RefreshRate: refreshRate,
+	}
+	if creds != "" {
+		encodedCreds, err := json.Marshal(creds)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to encode credentials")
+		}
+		registryConfig.Creds = encodedCreds
 	}
 
-	select {}
+	return registryConfig, nil
 }
 
 func main() {
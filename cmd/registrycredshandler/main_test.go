@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+
+	"github.com/nuclio/logger"
+	"github.com/stretchr/testify/suite"
+)
+
+type MainSuite struct {
+	suite.Suite
+	logger logger.Logger
+}
+
+func (suite *MainSuite) SetupTest() {
+	suite.logger, _ = common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	for _, envName := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_ROLE_ARN", "AWS_DEFAULT_REGION"} {
+		suite.Require().NoError(os.Unsetenv(envName))
+	}
+}
+
+func (suite *MainSuite) TestRunDoctorPrintsReport() {
+	for _, testCase := range []struct {
+		name           string
+		configPath     string
+		creds          string
+		expectedOutput string
+	}{
+		{
+			name:       "missingConfig",
+			configPath: "/nonexistent/config.yaml",
+			expectedOutput: "FAIL  config: parse: open /nonexistent/config.yaml: no such file or directory\n" +
+				"      fix: Fix the config file (--config), or the registry and secret flags\n",
+		},
+		{
+			name:  "invalidRegistry",
+			creds: `{"accessKeyID": "id", "secretAccessKey": "key"}`,
+			expectedOutput: "PASS  config: parse: 1 registries and 0 targets\n" +
+				"FAIL  config: registries: AWS Region is required\n" +
+				"      fix: Fix the registries creds (e.g.: region, accessKeyID and secretAccessKey of ecr registries)\n",
+		},
+	} {
+		suite.Run(testCase.name, func() {
+			var output bytes.Buffer
+			err := runDoctor(suite.logger,
+				testCase.configPath,
+				"",
+				"ecr",
+				"",
+				"",
+				testCase.creds,
+				"",
+				common.SecretFormatDockerConfigJSON,
+				&output)
+			suite.Require().EqualError(err, "Doctor found failures")
+			suite.Require().Equal(testCase.expectedOutput, output.String())
+		})
+	}
+}
+
+func TestMainSuite(t *testing.T) {
+	suite.Run(t, new(MainSuite))
+}
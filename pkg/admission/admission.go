@@ -0,0 +1,283 @@
+package admission
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/registrycredshandler"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/core/v1"
+)
+
+const (
+
+	// MutatePodsPath is the path the mutating webhook configuration should call for pods
+	MutatePodsPath = "/mutate-pods"
+
+	// maxRequestSize bounds the admission review body, the API server sends objects up to 3MB
+	maxRequestSize = 3 * 1024 * 1024
+
+	shutdownTimeout = 10 * time.Second
+
+	// the API server calls the webhook on every pod admission, slow or idle clients must not hold connections
+	readHeaderTimeout = 10 * time.Second
+	readTimeout       = 30 * time.Second
+	writeTimeout      = 30 * time.Second
+	idleTimeout       = 2 * time.Minute
+)
+
+// Options configure the admission webhook server
+type Options struct {
+
+	// ListenAddress is the address to serve on (e.g.: :8443)
+	ListenAddress string
+
+	// CertPath and KeyPath are the serving TLS certificate and key, the API server only calls webhooks over TLS
+	CertPath string
+	KeyPath  string
+}
+
+// Server is a mutating admission webhook adding the pull secrets of the handler registries to pods
+// pulling images from them, so that pull secrets do not have to be referred to by hand
+type Server struct {
+	logger  logger.Logger
+	handler *registrycredshandler.Handler
+	options Options
+}
+
+// jsonPatchOperation is a RFC 6902 JSON patch operation
+type jsonPatchOperation struct {
+	Operation string      `json:"op"`
+	Path      string      `json:"path"`
+	Value     interface{} `json:"value,omitempty"`
+}
+
+func NewServer(parentLogger logger.Logger, handler *registrycredshandler.Handler, options Options) (*Server, error) {
+	if options.ListenAddress == "" {
+		return nil, errors.New("Listen address must not be empty")
+	}
+	if options.CertPath == "" || options.KeyPath == "" {
+		return nil, errors.New("TLS certificate and key paths must not be empty")
+	}
+
+	return &Server{
+		logger:  parentLogger.GetChild("admission"),
+		handler: handler,
+		options: options,
+	}, nil
+}
+
+// Start serves admission reviews until ctx is canceled
+func (s *Server) Start(ctx context.Context) error {
+	mux := http.NewServeMux()
+	mux.Handle(MutatePodsPath, s)
+
+	httpServer := &http.Server{
+		Addr:              s.options.ListenAddress,
+		Handler:           mux,
+		ReadHeaderTimeout: readHeaderTimeout,
+		ReadTimeout:       readTimeout,
+		WriteTimeout:      writeTimeout,
+		IdleTimeout:       idleTimeout,
+	}
+
+	go func() {
+		<-ctx.Done()
+
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := httpServer.Shutdown(shutdownCtx); err != nil {
+			s.logger.WarnWith("Failed to shut down admission server", "err", err.Error())
+		}
+	}()
+
+	s.logger.InfoWithCtx(ctx, "Admission server starting", "listenAddress", s.options.ListenAddress)
+	if err := httpServer.ListenAndServeTLS(s.options.CertPath, s.options.KeyPath); err != nil &&
+		err != http.ErrServerClosed {
+		return errors.Wrap(err, "Failed to serve admission webhook")
+	}
+
+	s.logger.InfoWith("Admission server stopped")
+	return nil
+}
+
+// ServeHTTP replies to an admission review of a pod
+func (s *Server) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		http.Error(responseWriter, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(request.Body, maxRequestSize))
+	if err != nil {
+		http.Error(responseWriter, "Failed to read request", http.StatusBadRequest)
+		return
+	}
+
+	review := &admissionv1.AdmissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(responseWriter, "Failed to decode admission review", http.StatusBadRequest)
+		return
+	}
+
+	response := s.Mutate(request.Context(), review.Request)
+	response.UID = review.Request.UID
+
+	encodedReview, err := json.Marshal(&admissionv1.AdmissionReview{
+		TypeMeta: review.TypeMeta,
+		Response: response,
+	})
+	if err != nil {
+		http.Error(responseWriter, "Failed to encode admission review", http.StatusInternalServerError)
+		return
+	}
+
+	responseWriter.Header().Set("Content-Type", "application/json")
+	if _, err := responseWriter.Write(encodedReview); err != nil {
+		s.logger.WarnWithCtx(request.Context(), "Failed to write admission review", "err", err.Error())
+	}
+}
+
+// Mutate returns the admission response of a pod, patching in the pull secrets it needs and does not refer to.
+// Pods are always admitted, failing to resolve their pull secrets is only warned about, as the pod may still
+// pull its images with other credentials
+func (s *Server) Mutate(ctx context.Context, request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{
+		Allowed: true,
+	}
+
+	if request.Kind.Kind != "Pod" || request.Operation != admissionv1.Create {
+		return response
+	}
+
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(request.Object.Raw, pod); err != nil {
+		s.logger.WarnWithCtx(ctx, "Failed to decode pod", "err", err.Error())
+		response.Warnings = []string{fmt.Sprintf("registry-creds-handler failed to decode pod: %s", err.Error())}
+		return response
+	}
+
+	// pods created by controllers have no namespace set yet
+	namespace := request.Namespace
+	if namespace == "" {
+		namespace = pod.Namespace
+	}
+
+	// a dry run admission is only answered, the secrets the patch refers to are not written
+	dryRun := request.DryRun != nil && *request.DryRun
+	secretNames, uncoveredRegistryNames, err := s.handler.EnsureImagePullSecrets(ctx,
+		namespace,
+		GetPodImages(pod),
+		dryRun)
+	if err != nil {
+		s.logger.WarnWithCtx(ctx, "Failed to ensure image pull secrets",
+			"namespace", namespace,
+			"pod", getPodName(pod),
+			"err", err.Error())
+		response.Warnings = []string{
+			fmt.Sprintf("registry-creds-handler failed to add image pull secrets: %s",
+				errors.RootCause(err).Error()),
+		}
+		return response
+	}
+
+	// no secret of these registries is written to namespace, the pod pulls with other credentials if any
+	if len(uncoveredRegistryNames) > 0 {
+		response.Warnings = []string{
+			fmt.Sprintf("registry-creds-handler has no target of registries %s in namespace %s",
+				strings.Join(uncoveredRegistryNames, ", "),
+				namespace),
+		}
+	}
+
+	patch := compileImagePullSecretsPatch(pod, secretNames)
+	if len(patch) == 0 {
+		return response
+	}
+
+	encodedPatch, err := json.Marshal(patch)
+	if err != nil {
+		s.logger.WarnWithCtx(ctx, "Failed to encode patch", "err", err.Error())
+		return response
+	}
+
+	s.logger.InfoWithCtx(ctx, "Adding image pull secrets to pod",
+		"namespace", namespace,
+		"pod", getPodName(pod),
+		"secretNames", secretNames)
+
+	patchType := admissionv1.PatchTypeJSONPatch
+	response.Patch = encodedPatch
+	response.PatchType = &patchType
+	return response
+}
+
+// GetPodImages returns the images of all pod containers
+func GetPodImages(pod *v1.Pod) []string {
+	var images []string
+	for _, container := range pod.Spec.InitContainers {
+		images = append(images, container.Image)
+	}
+	for _, container := range pod.Spec.Containers {
+		images = append(images, container.Image)
+	}
+	for _, container := range pod.Spec.EphemeralContainers {
+		images = append(images, container.Image)
+	}
+	return images
+}
+
+// compileImagePullSecretsPatch returns the JSON patch adding the secrets the pod does not refer to yet
+func compileImagePullSecretsPatch(pod *v1.Pod, secretNames []string) []jsonPatchOperation {
+	referredSecretNames := map[string]bool{}
+	for _, imagePullSecret := range pod.Spec.ImagePullSecrets {
+		referredSecretNames[imagePullSecret.Name] = true
+	}
+
+	var missingImagePullSecrets []v1.LocalObjectReference
+	for _, secretName := range secretNames {
+		if !referredSecretNames[secretName] {
+			missingImagePullSecrets = append(missingImagePullSecrets, v1.LocalObjectReference{Name: secretName})
+			referredSecretNames[secretName] = true
+		}
+	}
+	if len(missingImagePullSecrets) == 0 {
+		return nil
+	}
+
+	// a missing list must be added as a whole, appending to it would fail
+	if len(pod.Spec.ImagePullSecrets) == 0 {
+		return []jsonPatchOperation{
+			{
+				Operation: "add",
+				Path:      "/spec/imagePullSecrets",
+				Value:     missingImagePullSecrets,
+			},
+		}
+	}
+
+	var patch []jsonPatchOperation
+	for _, imagePullSecret := range missingImagePullSecrets {
+		patch = append(patch, jsonPatchOperation{
+			Operation: "add",
+			Path:      "/spec/imagePullSecrets/-",
+			Value:     imagePullSecret,
+		})
+	}
+	return patch
+}
+
+func getPodName(pod *v1.Pod) string {
+	if pod.Name != "" {
+		return pod.Name
+	}
+	return pod.GenerateName
+}
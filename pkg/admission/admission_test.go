@@ -0,0 +1,213 @@
+package admission
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/registry/mock"
+	"github.com/v3io/registry-creds-handler/pkg/registrycredshandler"
+
+	"github.com/nuclio/logger"
+	"github.com/stretchr/testify/suite"
+	admissionv1 "k8s.io/api/admission/v1"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type AdmissionSuite struct {
+	suite.Suite
+	logger        logger.Logger
+	kubeClientSet kubernetes.Interface
+	server        *Server
+}
+
+func (suite *AdmissionSuite) SetupTest() {
+	suite.logger, _ = common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	suite.kubeClientSet = fake.NewSimpleClientset()
+
+	mockedRegistry, _ := mock.NewRegistry(suite.logger, "", "", "", "registry.mock.com")
+	mockedRegistry.On("GetAuthToken").Return(&registry.Token{
+		Auth:        "username:password",
+		RegistryUri: "registry.mock.com",
+	}, nil)
+	source := &registrycredshandler.Source{Name: "mock", Kind: "mock", Registry: mockedRegistry}
+
+	handler, err := registrycredshandler.NewHandler(suite.logger,
+		suite.kubeClientSet,
+		[]*registrycredshandler.Source{source},
+		[]*config.Target{
+			{SecretName: "pull-secret", Namespace: "team", Format: common.SecretFormatDockerConfigJSON},
+			{SecretName: "other-pull-secret", Namespace: "other", Format: common.SecretFormatDockerConfigJSON},
+		})
+	suite.Require().NoError(err)
+
+	// get a token without writing the targets
+	_, err = handler.GetToken(context.Background(), source.Name)
+	suite.Require().NoError(err)
+
+	suite.server, err = NewServer(suite.logger, handler, Options{
+		ListenAddress: ":8443",
+		CertPath:      "tls.crt",
+		KeyPath:       "tls.key",
+	})
+	suite.Require().NoError(err)
+}
+
+func (suite *AdmissionSuite) TestMutateAddsMissingSecret() {
+	pod := &v1.Pod{
+		Spec: v1.PodSpec{
+			InitContainers: []v1.Container{{Image: "busybox"}},
+			Containers:     []v1.Container{{Image: "registry.mock.com/team/app:1.0"}},
+		},
+	}
+
+	response := suite.server.Mutate(context.Background(), suite.compileRequest("team", pod))
+	suite.Require().True(response.Allowed)
+	suite.Require().NotNil(response.PatchType)
+	suite.Require().JSONEq(`[{"op":"add","path":"/spec/imagePullSecrets","value":[{"name":"pull-secret"}]}]`,
+		string(response.Patch))
+
+	// the secret exists before the pod is admitted
+	secret, err := common.GetSecret(context.Background(), suite.kubeClientSet, "team", "pull-secret")
+	suite.Require().NoError(err)
+	suite.Require().Equal(v1.SecretTypeDockerConfigJson, secret.Type)
+}
+
+func (suite *AdmissionSuite) TestMutateDryRunWritesNothing() {
+	pod := &v1.Pod{
+		Spec: v1.PodSpec{Containers: []v1.Container{{Image: "registry.mock.com/team/app:1.0"}}},
+	}
+
+	dryRun := true
+	request := suite.compileRequest("team", pod)
+	request.DryRun = &dryRun
+
+	response := suite.server.Mutate(context.Background(), request)
+	suite.Require().True(response.Allowed)
+	suite.Require().JSONEq(`[{"op":"add","path":"/spec/imagePullSecrets","value":[{"name":"pull-secret"}]}]`,
+		string(response.Patch))
+
+	_, err := common.GetSecret(context.Background(), suite.kubeClientSet, "team", "pull-secret")
+	suite.Require().True(apierrors.IsNotFound(err))
+}
+
+func (suite *AdmissionSuite) TestMutateAppendsToExistingSecrets() {
+	pod := &v1.Pod{
+		Spec: v1.PodSpec{
+			Containers:       []v1.Container{{Image: "registry.mock.com/team/app:1.0"}},
+			ImagePullSecrets: []v1.LocalObjectReference{{Name: "someone-elses"}},
+		},
+	}
+
+	response := suite.server.Mutate(context.Background(), suite.compileRequest("team", pod))
+	suite.Require().True(response.Allowed)
+	suite.Require().JSONEq(`[{"op":"add","path":"/spec/imagePullSecrets/-","value":{"name":"pull-secret"}}]`,
+		string(response.Patch))
+}
+
+func (suite *AdmissionSuite) TestMutateSkipsUnneededSecrets() {
+	for _, testCase := range []struct {
+		name      string
+		namespace string
+		pod       *v1.Pod
+	}{
+		{
+			name:      "unmanagedRegistry",
+			namespace: "team",
+			pod: &v1.Pod{
+				Spec: v1.PodSpec{Containers: []v1.Container{{Image: "quay.io/team/app:1.0"}}},
+			},
+		},
+		{
+			name:      "alreadyReferred",
+			namespace: "team",
+			pod: &v1.Pod{
+				Spec: v1.PodSpec{
+					Containers:       []v1.Container{{Image: "registry.mock.com/team/app:1.0"}},
+					ImagePullSecrets: []v1.LocalObjectReference{{Name: "pull-secret"}},
+				},
+			},
+		},
+	} {
+		suite.Run(testCase.name, func() {
+			response := suite.server.Mutate(context.Background(), suite.compileRequest(testCase.namespace, testCase.pod))
+			suite.Require().True(response.Allowed)
+			suite.Require().Nil(response.Patch)
+			suite.Require().Nil(response.PatchType)
+		})
+	}
+}
+
+func (suite *AdmissionSuite) TestMutateWarnsOfUncoveredNamespace() {
+	pod := &v1.Pod{
+		Spec: v1.PodSpec{Containers: []v1.Container{{Image: "registry.mock.com/team/app:1.0"}}},
+	}
+
+	// no target writes the secret to the namespace, the pod is admitted as is with a warning
+	response := suite.server.Mutate(context.Background(), suite.compileRequest("unmanaged", pod))
+	suite.Require().True(response.Allowed)
+	suite.Require().Nil(response.Patch)
+	suite.Require().Equal([]string{"registry-creds-handler has no target of registries mock in namespace unmanaged"},
+		response.Warnings)
+}
+
+func (suite *AdmissionSuite) TestServeHTTP() {
+	pod := &v1.Pod{
+		Spec: v1.PodSpec{Containers: []v1.Container{{Image: "registry.mock.com/team/app:1.0"}}},
+	}
+	request := suite.compileRequest("team", pod)
+	request.UID = "some-uid"
+
+	encodedReview, err := json.Marshal(&admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request:  request,
+	})
+	suite.Require().NoError(err)
+
+	recorder := httptest.NewRecorder()
+	suite.server.ServeHTTP(recorder,
+		httptest.NewRequest(http.MethodPost, MutatePodsPath, bytes.NewReader(encodedReview)))
+	suite.Require().Equal(http.StatusOK, recorder.Code)
+
+	review := &admissionv1.AdmissionReview{}
+	suite.Require().NoError(json.Unmarshal(recorder.Body.Bytes(), review))
+	suite.Require().Equal("AdmissionReview", review.Kind)
+	suite.Require().NotNil(review.Response)
+	suite.Require().EqualValues("some-uid", review.Response.UID)
+	suite.Require().True(review.Response.Allowed)
+	suite.Require().NotEmpty(review.Response.Patch)
+
+	// anything but an admission review is rejected
+	recorder = httptest.NewRecorder()
+	suite.server.ServeHTTP(recorder,
+		httptest.NewRequest(http.MethodPost, MutatePodsPath, bytes.NewReader([]byte("{}"))))
+	suite.Require().Equal(http.StatusBadRequest, recorder.Code)
+}
+
+func (suite *AdmissionSuite) compileRequest(namespace string, pod *v1.Pod) *admissionv1.AdmissionRequest {
+	encodedPod, err := json.Marshal(pod)
+	suite.Require().NoError(err)
+
+	return &admissionv1.AdmissionRequest{
+		Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+		Namespace: namespace,
+		Operation: admissionv1.Create,
+		Object:    runtime.RawExtension{Raw: encodedPod},
+	}
+}
+
+func TestAdmissionSuite(t *testing.T) {
+	suite.Run(t, new(AdmissionSuite))
+}
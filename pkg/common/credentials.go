@@ -0,0 +1,99 @@
+package common
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+
+	"github.com/nuclio/errors"
+)
+
+type TokenOutputFormat string
+
+const (
+	TokenOutputFormatLogin            TokenOutputFormat = "login"
+	TokenOutputFormatPassword         TokenOutputFormat = "password"
+	TokenOutputFormatDockerConfigJSON TokenOutputFormat = "dockerconfigjson"
+	TokenOutputFormatCredentialHelper TokenOutputFormat = "credential-helper"
+
+	credentialHelperIdentityTokenUsername = "<token>"
+)
+
+// CredentialHelperCredentials are the credentials a docker credential helper replies with to get
+type CredentialHelperCredentials struct {
+	ServerURL string `json:"ServerURL"`
+	Username  string `json:"Username"`
+	Secret    string `json:"Secret"`
+}
+
+// FormatToken renders a token for humans and tools outside of the cluster:
+// login - username, password and registry URIs, as given to docker login
+// password - the password only, to be piped to docker login --password-stdin
+// dockerconfigjson - a docker config json snippet
+// credential-helper - a docker credential helper get reply
+func FormatToken(token *registry.Token, format TokenOutputFormat) ([]byte, error) {
+	switch format {
+	case TokenOutputFormatLogin, "":
+		username, password, err := token.GetUsernamePassword()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to get username and password")
+		}
+		formattedToken := fmt.Sprintf("Username: %s\nPassword: %s\n", username, password)
+		for _, registryUri := range token.GetRegistryUris() {
+			formattedToken += fmt.Sprintf("Server: %s\n", registryUri)
+		}
+		if !token.ExpiresAt.IsZero() {
+			formattedToken += fmt.Sprintf("Expires: %s\n", token.ExpiresAt.UTC().Format(time.RFC3339))
+		}
+		return []byte(formattedToken), nil
+
+	case TokenOutputFormatPassword:
+		_, password, err := token.GetUsernamePassword()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to get username and password")
+		}
+		return []byte(password + "\n"), nil
+
+	case TokenOutputFormatDockerConfigJSON:
+		return json.MarshalIndent(DockerConfigJSON{Auths: compileRegistryAuths([]*registry.Token{token})}, "", "  ")
+
+	case TokenOutputFormatCredentialHelper:
+		var serverURL string
+		if registryUris := token.GetRegistryUris(); len(registryUris) > 0 {
+			serverURL = registryUris[0]
+		}
+		credentials, err := CompileCredentialHelperCredentials(token, serverURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to compile credential helper credentials")
+		}
+		return json.Marshal(credentials)
+
+	default:
+		return nil, errors.Errorf("Unsupported token output format: %s", format)
+	}
+}
+
+// CompileCredentialHelperCredentials creates the credential helper credentials of a token for serverURL.
+// Identity tokens are passed as the secret of the special <token> username, as the protocol defines
+func CompileCredentialHelperCredentials(token *registry.Token, serverURL string) (*CredentialHelperCredentials, error) {
+	if token.IdentityToken != "" {
+		return &CredentialHelperCredentials{
+			ServerURL: serverURL,
+			Username:  credentialHelperIdentityTokenUsername,
+			Secret:    token.IdentityToken,
+		}, nil
+	}
+
+	username, password, err := token.GetUsernamePassword()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get username and password")
+	}
+
+	return &CredentialHelperCredentials{
+		ServerURL: serverURL,
+		Username:  username,
+		Secret:    password,
+	}, nil
+}
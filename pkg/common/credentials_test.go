@@ -0,0 +1,55 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CredentialsSuite struct {
+	suite.Suite
+}
+
+func (suite *CredentialsSuite) TestFormatToken() {
+	token := &registry.Token{
+
+		// AWS:password
+		Auth:        "QVdTOnBhc3N3b3Jk",
+		RegistryUri: "ecr.mock.com",
+	}
+
+	tests := []struct {
+		name           string
+		format         TokenOutputFormat
+		expectedOutput string
+	}{
+		{
+			name:           "login",
+			format:         TokenOutputFormatLogin,
+			expectedOutput: "Username: AWS\nPassword: password\nServer: ecr.mock.com\n",
+		},
+		{
+			name:           "password",
+			format:         TokenOutputFormatPassword,
+			expectedOutput: "password\n",
+		},
+		{
+			name:           "credentialHelper",
+			format:         TokenOutputFormatCredentialHelper,
+			expectedOutput: `{"ServerURL":"ecr.mock.com","Username":"AWS","Secret":"password"}`,
+		},
+	}
+	for _, test := range tests {
+		suite.Run(test.name, func() {
+			formattedToken, err := FormatToken(token, test.format)
+			suite.Require().NoError(err)
+			suite.Require().Equal(test.expectedOutput, string(formattedToken))
+		})
+	}
+}
+
+func TestCredentials(t *testing.T) {
+	suite.Run(t, new(CredentialsSuite))
+}
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/nuclio/errors"
+)
+
+// MergeDockerConfigJSON merges the auths of desiredConfig into existingConfig.
+// Entries listed in previouslyOwned are removed from existingConfig before merging, so that registries
+// we no longer publish do not linger, while entries (and top level keys) owned by others are kept as is.
+// Taking over an entry of others (e.g.: one an admin wrote before we first merged) is refused, as cleanup
+// would then remove it along with ours
+func MergeDockerConfigJSON(existingConfig []byte, previouslyOwned []string, desiredConfig []byte) ([]byte, error) {
+	existingFields, existingAuths, err := parseDockerConfigJSON(existingConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse existing docker config json")
+	}
+
+	_, desiredAuths, err := parseDockerConfigJSON(desiredConfig)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse desired docker config json")
+	}
+
+	for _, registryUri := range previouslyOwned {
+		delete(existingAuths, registryUri)
+	}
+
+	var foreignRegistryUris []string
+	for registryUri := range desiredAuths {
+		if _, found := existingAuths[registryUri]; found {
+			foreignRegistryUris = append(foreignRegistryUris, registryUri)
+		}
+	}
+	if len(foreignRegistryUris) > 0 {
+		sort.Strings(foreignRegistryUris)
+		return nil, errors.Errorf("Refusing to replace auths written by others: %s",
+			strings.Join(foreignRegistryUris, ", "))
+	}
+
+	for registryUri, auth := range desiredAuths {
+		existingAuths[registryUri] = auth
+	}
+
+	return compileDockerConfigJSON(existingFields, existingAuths)
+}
+
+// RemoveDockerConfigJSONAuths removes the auths of the given registry URIs from config, and returns the
+// resulting config along with the number of auths left in it
+func RemoveDockerConfigJSONAuths(config []byte, registryUris []string) ([]byte, int, error) {
+	fields, auths, err := parseDockerConfigJSON(config)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to parse docker config json")
+	}
+
+	for _, registryUri := range registryUris {
+		delete(auths, registryUri)
+	}
+
+	compiledConfig, err := compileDockerConfigJSON(fields, auths)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Failed to compile docker config json")
+	}
+
+	return compiledConfig, len(auths), nil
+}
+
+// GetDockerConfigJSONRegistryUris returns the sorted registry URIs found in config auths
+func GetDockerConfigJSONRegistryUris(config []byte) ([]string, error) {
+	_, auths, err := parseDockerConfigJSON(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to parse docker config json")
+	}
+
+	var registryUris []string
+	for registryUri := range auths {
+		registryUris = append(registryUris, registryUri)
+	}
+	sort.Strings(registryUris)
+	return registryUris, nil
+}
+
+// SplitRegistryUris parses a comma separated list of registry URIs, as stored in OwnedRegistriesAnnotation
+func SplitRegistryUris(registryUris string) []string {
+	var splitRegistryUris []string
+	for _, registryUri := range strings.Split(registryUris, ",") {
+		if registryUri = strings.TrimSpace(registryUri); registryUri != "" {
+			splitRegistryUris = append(splitRegistryUris, registryUri)
+		}
+	}
+	return splitRegistryUris
+}
+
+// parseDockerConfigJSON keeps both the top level fields and auth entries raw, so that
+// fields unknown to us survive a round trip
+func parseDockerConfigJSON(config []byte) (map[string]json.RawMessage, map[string]json.RawMessage, error) {
+	fields := map[string]json.RawMessage{}
+	auths := map[string]json.RawMessage{}
+
+	if len(config) == 0 {
+		return fields, auths, nil
+	}
+
+	if err := json.Unmarshal(config, &fields); err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to unmarshal docker config json")
+	}
+
+	if encodedAuths, found := fields["auths"]; found && string(encodedAuths) != "null" {
+		if err := json.Unmarshal(encodedAuths, &auths); err != nil {
+			return nil, nil, errors.Wrap(err, "Failed to unmarshal docker config json auths")
+		}
+	}
+
+	return fields, auths, nil
+}
+
+func compileDockerConfigJSON(fields map[string]json.RawMessage, auths map[string]json.RawMessage) ([]byte, error) {
+	encodedAuths, err := json.Marshal(auths)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to marshal docker config json auths")
+	}
+	fields["auths"] = encodedAuths
+
+	return json.Marshal(fields)
+}
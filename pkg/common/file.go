@@ -0,0 +1,261 @@
+package common
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/nuclio/errors"
+)
+
+const (
+	// DefaultFileMode is the mode credential files are written with, readable by their owner only
+	DefaultFileMode os.FileMode = 0600
+
+	lockFileSuffix = ".lock"
+
+	// ownedRegistriesFileSuffix is of the file next to a merged file listing the registry URIs whose auths
+	// were written by us, as OwnedRegistriesAnnotation does for secrets
+	ownedRegistriesFileSuffix = ".owned-registries"
+)
+
+// WriteFileAtomically writes data to a temporary file next to path and renames it over path,
+// so that readers never see a partially written file
+func WriteFileAtomically(path string, data []byte, mode os.FileMode) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "Failed to create dir: %s", dir)
+	}
+
+	tempFile, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Wrap(err, "Failed to create temporary file")
+	}
+	defer os.Remove(tempFile.Name())
+
+	if _, err := tempFile.Write(data); err != nil {
+		tempFile.Close()
+		return errors.Wrap(err, "Failed to write temporary file")
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return errors.Wrap(err, "Failed to sync temporary file")
+	}
+	if err := tempFile.Close(); err != nil {
+		return errors.Wrap(err, "Failed to close temporary file")
+	}
+	if err := os.Chmod(tempFile.Name(), mode); err != nil {
+		return errors.Wrap(err, "Failed to set file mode")
+	}
+
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return errors.Wrapf(err, "Failed to rename temporary file to: %s", path)
+	}
+	return nil
+}
+
+// LockFile takes an exclusive advisory lock on <path>.lock, blocking until it is available. The lock file is
+// used rather than path itself, as path is replaced on every write. Returns a function releasing the lock
+func LockFile(path string) (func() error, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, errors.Wrapf(err, "Failed to create dir: %s", filepath.Dir(path))
+	}
+
+	for {
+		lockFile, err := os.OpenFile(path+lockFileSuffix, os.O_CREATE|os.O_RDWR, DefaultFileMode)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to open lock file")
+		}
+
+		if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_EX); err != nil {
+			lockFile.Close()
+			return nil, errors.Wrap(err, "Failed to lock file")
+		}
+
+		// the lock file is removed on cleanup (see removeLockFile), a lock taken on a removed one is taken again
+		if !isLockFileCurrent(path, lockFile) {
+			lockFile.Close()
+			continue
+		}
+
+		return func() error {
+			if err := syscall.Flock(int(lockFile.Fd()), syscall.LOCK_UN); err != nil {
+				lockFile.Close()
+				return errors.Wrap(err, "Failed to unlock file")
+			}
+			return lockFile.Close()
+		}, nil
+	}
+}
+
+// RemoveFile removes a file written by WriteDockerConfigJSONFile under lock, along with its lock file
+func RemoveFile(path string) error {
+	unlock, err := LockFile(path)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to lock file: %s", path)
+	}
+	defer unlock()
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to remove file: %s", path)
+	}
+	return removeLockFile(path)
+}
+
+// WriteDockerConfigJSONFile writes a docker config json file (e.g.: /var/lib/kubelet/config.json) under lock.
+// When merge is set, the auths of desiredConfig are merged into the existing file, replacing the ones we
+// previously wrote and keeping other entries and top level keys as is
+func WriteDockerConfigJSONFile(path string,
+	desiredConfig []byte,
+	merge bool,
+	mode os.FileMode) (SecretOperation, error) {
+
+	unlock, err := LockFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to lock file: %s", path)
+	}
+	defer unlock()
+
+	operation := SecretOperationUpdate
+	existingConfig, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return "", errors.Wrapf(err, "Failed to read file: %s", path)
+		}
+		operation = SecretOperationCreate
+	}
+
+	config := desiredConfig
+	var ownedRegistryUris []string
+	if merge {
+		previouslyOwned, err := readOwnedRegistryUris(path)
+		if err != nil {
+			return "", errors.Wrap(err, "Failed to read owned registries")
+		}
+		if len(existingConfig) > 0 {
+			if config, err = MergeDockerConfigJSON(existingConfig, previouslyOwned, desiredConfig); err != nil {
+				return "", errors.Wrapf(err, "Failed to merge file: %s", path)
+			}
+		}
+
+		// the entries are recorded as ours before the file is written, so that they are known to be should
+		// writing it fail halfway, and only the desired ones once it is written
+		if ownedRegistryUris, err = GetDockerConfigJSONRegistryUris(desiredConfig); err != nil {
+			return "", errors.Wrap(err, "Failed to get owned registries")
+		}
+		if err := writeOwnedRegistryUris(path, append(previouslyOwned, ownedRegistryUris...), mode); err != nil {
+			return "", errors.Wrap(err, "Failed to write owned registries")
+		}
+	}
+
+	if operation != SecretOperationUpdate || !bytes.Equal(existingConfig, config) || !hasFileMode(path, mode) {
+		if err := WriteFileAtomically(path, config, mode); err != nil {
+			return "", errors.Wrapf(err, "Failed to write file: %s", path)
+		}
+	} else {
+		operation = SecretOperationUnchanged
+	}
+
+	if merge {
+		if err := writeOwnedRegistryUris(path, ownedRegistryUris, mode); err != nil {
+			return "", errors.Wrap(err, "Failed to write owned registries")
+		}
+	}
+	return operation, nil
+}
+
+// RemoveDockerConfigJSONFileAuths removes the auths we recorded writing to a merged docker config json file
+// under lock, keeping other entries as is, along with the record and the lock file
+func RemoveDockerConfigJSONFileAuths(path string, mode os.FileMode) (SecretOperation, error) {
+	unlock, err := LockFile(path)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to lock file: %s", path)
+	}
+	defer unlock()
+
+	operation := SecretOperationUnchanged
+	existingConfig, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrapf(err, "Failed to read file: %s", path)
+	}
+
+	if len(existingConfig) > 0 {
+		ownedRegistryUris, err := readOwnedRegistryUris(path)
+		if err != nil {
+			return "", errors.Wrap(err, "Failed to read owned registries")
+		}
+
+		config, _, err := RemoveDockerConfigJSONAuths(existingConfig, ownedRegistryUris)
+		if err != nil {
+			return "", errors.Wrapf(err, "Failed to remove auths from file: %s", path)
+		}
+
+		if !bytes.Equal(existingConfig, config) {
+			if err := WriteFileAtomically(path, config, mode); err != nil {
+				return "", errors.Wrapf(err, "Failed to write file: %s", path)
+			}
+			operation = SecretOperationUpdate
+		}
+	}
+
+	if err := os.Remove(path + ownedRegistriesFileSuffix); err != nil && !os.IsNotExist(err) {
+		return "", errors.Wrap(err, "Failed to remove owned registries")
+	}
+	if err := removeLockFile(path); err != nil {
+		return "", errors.Wrap(err, "Failed to remove lock file")
+	}
+	return operation, nil
+}
+
+// readOwnedRegistryUris returns the registry URIs whose auths we wrote to a merged file, none if it was not
+// written by us yet
+func readOwnedRegistryUris(path string) ([]string, error) {
+	ownedRegistryUris, err := os.ReadFile(path + ownedRegistriesFileSuffix)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "Failed to read file: %s", path+ownedRegistriesFileSuffix)
+	}
+	return SplitRegistryUris(string(ownedRegistryUris)), nil
+}
+
+func writeOwnedRegistryUris(path string, ownedRegistryUris []string, mode os.FileMode) error {
+	existingOwnedRegistryUris, err := readOwnedRegistryUris(path)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read owned registries")
+	}
+	if strings.Join(existingOwnedRegistryUris, ",") == strings.Join(ownedRegistryUris, ",") {
+		return nil
+	}
+	return WriteFileAtomically(path+ownedRegistriesFileSuffix, []byte(strings.Join(ownedRegistryUris, ",")), mode)
+}
+
+func hasFileMode(path string, mode os.FileMode) bool {
+	fileInfo, err := os.Stat(path)
+	return err == nil && fileInfo.Mode().Perm() == mode
+}
+
+// removeLockFile removes the lock file of path, which must be locked by the caller, so that cleanup leaves no
+// stray file behind (e.g.: in kubelet's dir)
+func removeLockFile(path string) error {
+	if err := os.Remove(path + lockFileSuffix); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "Failed to remove file: %s", path+lockFileSuffix)
+	}
+	return nil
+}
+
+// isLockFileCurrent returns whether lockFile is still the lock file of path, rather than one removed meanwhile
+func isLockFileCurrent(path string, lockFile *os.File) bool {
+	lockFileInfo, err := lockFile.Stat()
+	if err != nil {
+		return false
+	}
+	currentLockFileInfo, err := os.Stat(path + lockFileSuffix)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(lockFileInfo, currentLockFileInfo)
+}
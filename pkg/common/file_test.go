@@ -0,0 +1,145 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type FileSuite struct {
+	suite.Suite
+	path string
+}
+
+func (suite *FileSuite) SetupTest() {
+	suite.path = filepath.Join(suite.T().TempDir(), "kubelet", "config.json")
+}
+
+func (suite *FileSuite) TestWriteDockerConfigJSONFileMerge() {
+	err := os.MkdirAll(filepath.Dir(suite.path), 0755)
+	suite.Require().NoError(err)
+	err = os.WriteFile(suite.path,
+		[]byte(`{"auths":{"other.mock.com":{"auth":"b3RoZXI6b3RoZXI="}},"credsStore":"desktop"}`),
+		0644)
+	suite.Require().NoError(err)
+
+	desiredConfig := []byte(`{"auths":{"ecr.mock.com":{"auth":"QVdTOnBhc3N3b3Jk"}}}`)
+	operation, err := WriteDockerConfigJSONFile(suite.path, desiredConfig, true, DefaultFileMode)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUpdate, operation)
+
+	writtenConfig, err := os.ReadFile(suite.path)
+	suite.Require().NoError(err)
+	suite.Require().JSONEq(`{
+		"auths": {
+			"ecr.mock.com": {"auth": "QVdTOnBhc3N3b3Jk"},
+			"other.mock.com": {"auth": "b3RoZXI6b3RoZXI="}
+		},
+		"credsStore": "desktop"
+	}`, string(writtenConfig))
+
+	fileInfo, err := os.Stat(suite.path)
+	suite.Require().NoError(err)
+	suite.Require().Equal(DefaultFileMode, fileInfo.Mode().Perm())
+
+	// writing the same credentials again changes nothing
+	operation, err = WriteDockerConfigJSONFile(suite.path, desiredConfig, true, DefaultFileMode)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUnchanged, operation)
+
+	// our entry moves to another registry, the stale one is dropped and others' are kept
+	desiredConfig = []byte(`{"auths":{"other.ecr.mock.com":{"auth":"QVdTOnBhc3N3b3Jk"}}}`)
+	operation, err = WriteDockerConfigJSONFile(suite.path, desiredConfig, true, DefaultFileMode)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUpdate, operation)
+	suite.Require().Equal([]string{"other.ecr.mock.com", "other.mock.com"}, suite.getRegistryUris())
+
+	// our recorded entries are removed
+	operation, err = RemoveDockerConfigJSONFileAuths(suite.path, DefaultFileMode)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUpdate, operation)
+	suite.Require().Equal([]string{"other.mock.com"}, suite.getRegistryUris())
+	_, err = os.Stat(suite.path + ownedRegistriesFileSuffix)
+	suite.Require().True(os.IsNotExist(err))
+	_, err = os.Stat(suite.path + lockFileSuffix)
+	suite.Require().True(os.IsNotExist(err))
+}
+
+func (suite *FileSuite) TestRemoveDockerConfigJSONFileAuthsKeepsForeignEntry() {
+	err := os.MkdirAll(filepath.Dir(suite.path), 0755)
+	suite.Require().NoError(err)
+	foreignConfig := []byte(`{"auths":{"ecr.mock.com":{"auth":"YWRtaW46YWRtaW4="}}}`)
+	err = os.WriteFile(suite.path, foreignConfig, DefaultFileMode)
+	suite.Require().NoError(err)
+
+	// an admin's entry of the same registry is not taken over
+	_, err = WriteDockerConfigJSONFile(suite.path,
+		[]byte(`{"auths":{"ecr.mock.com":{"auth":"QVdTOnBhc3N3b3Jk"}}}`),
+		true,
+		DefaultFileMode)
+	suite.Require().Error(err)
+
+	// nor removed on cleanup
+	operation, err := RemoveDockerConfigJSONFileAuths(suite.path, DefaultFileMode)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUnchanged, operation)
+
+	writtenConfig, err := os.ReadFile(suite.path)
+	suite.Require().NoError(err)
+	suite.Require().Equal(foreignConfig, writtenConfig)
+}
+
+func (suite *FileSuite) TestRemoveFile() {
+	_, err := WriteDockerConfigJSONFile(suite.path,
+		[]byte(`{"auths":{"ecr.mock.com":{"auth":"QVdTOnBhc3N3b3Jk"}}}`),
+		false,
+		DefaultFileMode)
+	suite.Require().NoError(err)
+
+	err = RemoveFile(suite.path)
+	suite.Require().NoError(err)
+
+	// nothing is left behind, and the file can be locked again
+	entries, err := os.ReadDir(filepath.Dir(suite.path))
+	suite.Require().NoError(err)
+	suite.Require().Empty(entries)
+
+	unlock, err := LockFile(suite.path)
+	suite.Require().NoError(err)
+	suite.Require().NoError(unlock())
+}
+
+func (suite *FileSuite) TestWriteDockerConfigJSONFileCreate() {
+	desiredConfig := []byte(`{"auths":{"ecr.mock.com":{"auth":"QVdTOnBhc3N3b3Jk"}}}`)
+	operation, err := WriteDockerConfigJSONFile(suite.path, desiredConfig, false, 0640)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationCreate, operation)
+
+	writtenConfig, err := os.ReadFile(suite.path)
+	suite.Require().NoError(err)
+	suite.Require().Equal(desiredConfig, writtenConfig)
+
+	fileInfo, err := os.Stat(suite.path)
+	suite.Require().NoError(err)
+	suite.Require().Equal(os.FileMode(0640), fileInfo.Mode().Perm())
+
+	// no temporary files are left behind
+	entries, err := os.ReadDir(filepath.Dir(suite.path))
+	suite.Require().NoError(err)
+	suite.Require().Len(entries, 2)
+}
+
+func (suite *FileSuite) getRegistryUris() []string {
+	writtenConfig, err := os.ReadFile(suite.path)
+	suite.Require().NoError(err)
+
+	registryUris, err := GetDockerConfigJSONRegistryUris(writtenConfig)
+	suite.Require().NoError(err)
+	return registryUris
+}
+
+func TestFile(t *testing.T) {
+	suite.Run(t, new(FileSuite))
+}
@@ -0,0 +1,185 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+
+	"github.com/nuclio/errors"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+type SecretFormat string
+
+const (
+	SecretFormatDockerConfigJSON SecretFormat = "dockerconfigjson"
+	SecretFormatDockerCfg        SecretFormat = "dockercfg"
+	SecretFormatBasicAuth        SecretFormat = "basic-auth"
+	SecretFormatContainersAuth   SecretFormat = "containers-auth"
+	SecretFormatTemplate         SecretFormat = "template"
+
+	// ContainersAuthKey is the containers-auth.json file name, as read by podman, buildah and skopeo
+	ContainersAuthKey = "auth.json"
+
+	DefaultTemplateKey = "config"
+)
+
+// SecretTemplateData is what a secret template is executed with
+type SecretTemplateData struct {
+	SecretName string
+	Namespace  string
+	Tokens     []*registry.Token
+
+	// Auths are the docker config json auth entries of all tokens, by registry URI
+	Auths map[string]RegistryAuth
+}
+
+// GetSecretFormats returns all supported secret formats
+func GetSecretFormats() []SecretFormat {
+	return []SecretFormat{
+		SecretFormatDockerConfigJSON,
+		SecretFormatDockerCfg,
+		SecretFormatBasicAuth,
+		SecretFormatContainersAuth,
+		SecretFormatTemplate,
+	}
+}
+
+// ParseSecretTemplate parses a user supplied secret template
+func ParseSecretTemplate(secretTemplate string) (*template.Template, error) {
+	return template.New("secret").
+		Option("missingkey=error").
+		Funcs(template.FuncMap{
+			"base64": func(value string) string {
+				return base64.StdEncoding.EncodeToString([]byte(value))
+			},
+			"json": func(value interface{}) (string, error) {
+				encodedValue, err := json.Marshal(value)
+				return string(encodedValue), err
+			},
+		}).
+		Parse(secretTemplate)
+}
+
+// CompileSecret creates a secret object holding the tokens, rendered according to format.
+// secretTemplate and templateKey are only used by the template format
+func CompileSecret(secretName string,
+	namespace string,
+	format SecretFormat,
+	secretTemplate string,
+	templateKey string,
+	tokens []*registry.Token) (*v1.Secret, error) {
+
+	auths := compileRegistryAuths(tokens)
+
+	var registryUris []string
+	for registryUri := range auths {
+		registryUris = append(registryUris, registryUri)
+	}
+	sort.Strings(registryUris)
+
+	secret := &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      secretName,
+			Namespace: namespace,
+			Annotations: map[string]string{
+				OwnedRegistriesAnnotation: strings.Join(registryUris, ","),
+			},
+		},
+	}
+
+	switch format {
+	case SecretFormatDockerConfigJSON, "":
+		configJSON, err := json.Marshal(DockerConfigJSON{Auths: auths})
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to marshal docker config json")
+		}
+		secret.Type = v1.SecretTypeDockerConfigJson
+		secret.Data = map[string][]byte{
+			v1.DockerConfigJsonKey: configJSON,
+		}
+
+	case SecretFormatDockerCfg:
+
+		// the legacy format is the auths map itself
+		dockerCfg, err := json.Marshal(auths)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to marshal docker cfg")
+		}
+		secret.Type = v1.SecretTypeDockercfg
+		secret.Data = map[string][]byte{
+			v1.DockerConfigKey: dockerCfg,
+		}
+
+	case SecretFormatBasicAuth:
+		if len(tokens) != 1 {
+			return nil, errors.Errorf("Basic auth secret holds the credentials of a single registry, got %d",
+				len(tokens))
+		}
+		username, password, err := tokens[0].GetUsernamePassword()
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to get username and password")
+		}
+		secret.Type = v1.SecretTypeBasicAuth
+		secret.Data = map[string][]byte{
+			v1.BasicAuthUsernameKey: []byte(username),
+			v1.BasicAuthPasswordKey: []byte(password),
+		}
+
+	case SecretFormatContainersAuth:
+		authJSON, err := json.Marshal(DockerConfigJSON{Auths: auths})
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to marshal containers auth json")
+		}
+		secret.Type = v1.SecretTypeOpaque
+		secret.Data = map[string][]byte{
+			ContainersAuthKey: authJSON,
+		}
+
+	case SecretFormatTemplate:
+		parsedTemplate, err := ParseSecretTemplate(secretTemplate)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to parse secret template")
+		}
+
+		var renderedTemplate bytes.Buffer
+		if err := parsedTemplate.Execute(&renderedTemplate, &SecretTemplateData{
+			SecretName: secretName,
+			Namespace:  namespace,
+			Tokens:     tokens,
+			Auths:      auths,
+		}); err != nil {
+			return nil, errors.Wrap(err, "Failed to execute secret template")
+		}
+
+		if templateKey == "" {
+			templateKey = DefaultTemplateKey
+		}
+		secret.Type = v1.SecretTypeOpaque
+		secret.Data = map[string][]byte{
+			templateKey: renderedTemplate.Bytes(),
+		}
+
+	default:
+		return nil, errors.Errorf("Unsupported secret format: %s", format)
+	}
+
+	return secret, nil
+}
+
+// compileRegistryAuths returns the docker config json auth entries of all tokens, by registry URI
+func compileRegistryAuths(tokens []*registry.Token) map[string]RegistryAuth {
+	auths := map[string]RegistryAuth{}
+	for _, token := range tokens {
+		for _, registryUri := range token.GetRegistryUris() {
+			auths[registryUri] = CompileRegistryAuth(token)
+		}
+	}
+	return auths
+}
@@ -0,0 +1,114 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+
+	"github.com/stretchr/testify/suite"
+	"k8s.io/api/core/v1"
+)
+
+type FormatSuite struct {
+	suite.Suite
+}
+
+func (suite *FormatSuite) TestCompileSecret() {
+	tokens := []*registry.Token{
+		{
+			Username:    "AWS",
+			Password:    "password",
+			RegistryUri: "ecr.mock.com",
+		},
+	}
+
+	tests := []struct {
+		name         string
+		format       SecretFormat
+		template     string
+		templateKey  string
+		expectedType v1.SecretType
+		expectedData map[string]string
+		error        bool
+	}{
+
+		// happy
+		{
+			name:         "dockerConfigJSON",
+			format:       SecretFormatDockerConfigJSON,
+			expectedType: v1.SecretTypeDockerConfigJson,
+			expectedData: map[string]string{
+				v1.DockerConfigJsonKey: `{"auths":{"ecr.mock.com":{"username":"AWS","password":"password","auth":"QVdTOnBhc3N3b3Jk"}}}`,
+			},
+		},
+		{
+			name:         "dockerCfg",
+			format:       SecretFormatDockerCfg,
+			expectedType: v1.SecretTypeDockercfg,
+			expectedData: map[string]string{
+				v1.DockerConfigKey: `{"ecr.mock.com":{"username":"AWS","password":"password","auth":"QVdTOnBhc3N3b3Jk"}}`,
+			},
+		},
+		{
+			name:         "basicAuth",
+			format:       SecretFormatBasicAuth,
+			expectedType: v1.SecretTypeBasicAuth,
+			expectedData: map[string]string{
+				v1.BasicAuthUsernameKey: "AWS",
+				v1.BasicAuthPasswordKey: "password",
+			},
+		},
+		{
+			name:         "containersAuth",
+			format:       SecretFormatContainersAuth,
+			expectedType: v1.SecretTypeOpaque,
+			expectedData: map[string]string{
+				ContainersAuthKey: `{"auths":{"ecr.mock.com":{"username":"AWS","password":"password","auth":"QVdTOnBhc3N3b3Jk"}}}`,
+			},
+		},
+		{
+			name:         "template",
+			format:       SecretFormatTemplate,
+			template:     `{{ range $uri, $auth := .Auths }}{{ $uri }} {{ $auth.Username }} {{ base64 $auth.Password }}{{ end }}`,
+			templateKey:  "credentials",
+			expectedType: v1.SecretTypeOpaque,
+			expectedData: map[string]string{
+				"credentials": "ecr.mock.com AWS cGFzc3dvcmQ=",
+			},
+		},
+
+		// bad
+		{
+			name:     "badTemplate",
+			format:   SecretFormatTemplate,
+			template: `{{ .Missing }}`,
+			error:    true,
+		},
+		{
+			name:   "unsupported",
+			format: "unsupported",
+			error:  true,
+		},
+	}
+	for _, test := range tests {
+		suite.Run(test.name, func() {
+			secret, err := CompileSecret("secret", "namespace", test.format, test.template, test.templateKey, tokens)
+			if test.error {
+				suite.Require().Error(err)
+				return
+			}
+			suite.Require().NoError(err)
+			suite.Require().Equal(test.expectedType, secret.Type)
+
+			data := map[string]string{}
+			for key, value := range secret.Data {
+				data[key] = string(value)
+			}
+			suite.Require().Equal(test.expectedData, data)
+		})
+	}
+}
+
+func TestFormat(t *testing.T) {
+	suite.Run(t, new(FormatSuite))
+}
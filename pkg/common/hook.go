@@ -0,0 +1,98 @@
+package common
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/nuclio/errors"
+)
+
+// hookCommandTimeout bounds hook commands, so that a stuck hook does not hold back refreshes
+const hookCommandTimeout = time.Minute
+
+var hookSignals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+}
+
+// FileHook notifies whoever reads a file that it was rewritten, e.g.: a build tool running next to the
+// handler as a sidecar. Either or both of Command and Signal may be set
+type FileHook struct {
+
+	// Command is run, without a shell, after the file is written
+	Command []string `json:"command,omitempty"`
+
+	// Signal (e.g.: SIGHUP) is sent to the process whose pid is in PidFile after the file is written
+	Signal  string `json:"signal,omitempty"`
+	PidFile string `json:"pidFile,omitempty"`
+}
+
+// Validate makes sure the signal is known and has a process to be sent to
+func (fh *FileHook) Validate() error {
+	if fh.Signal == "" {
+		if fh.PidFile != "" {
+			return errors.New("Pid file requires a signal")
+		}
+		return nil
+	}
+	if _, err := fh.getSignal(); err != nil {
+		return errors.Wrap(err, "Failed to get signal")
+	}
+	if fh.PidFile == "" {
+		return errors.New("Signal requires a pid file")
+	}
+	return nil
+}
+
+// Run runs the hook command and sends the hook signal
+func (fh *FileHook) Run(ctx context.Context, path string) error {
+	if len(fh.Command) > 0 {
+		commandCtx, cancel := context.WithTimeout(ctx, hookCommandTimeout)
+		defer cancel()
+
+		command := exec.CommandContext(commandCtx, fh.Command[0], fh.Command[1:]...)
+		command.Env = append(os.Environ(), "REGISTRY_CREDS_HANDLER_PATH="+path)
+		if output, err := command.CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "Hook command failed: %s", strings.TrimSpace(string(output)))
+		}
+	}
+
+	if fh.Signal != "" {
+		signal, err := fh.getSignal()
+		if err != nil {
+			return errors.Wrap(err, "Failed to get signal")
+		}
+
+		encodedPid, err := os.ReadFile(fh.PidFile)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read pid file: %s", fh.PidFile)
+		}
+		pid, err := strconv.Atoi(strings.TrimSpace(string(encodedPid)))
+		if err != nil {
+			return errors.Wrapf(err, "Invalid pid in pid file: %s", fh.PidFile)
+		}
+
+		if err := syscall.Kill(pid, signal); err != nil {
+			return errors.Wrapf(err, "Failed to send %s to pid %d", fh.Signal, pid)
+		}
+	}
+
+	return nil
+}
+
+func (fh *FileHook) getSignal() (syscall.Signal, error) {
+	signal, found := hookSignals[strings.TrimPrefix(strings.ToUpper(fh.Signal), "SIG")]
+	if !found {
+		return 0, errors.Errorf("Unsupported signal: %s", fh.Signal)
+	}
+	return signal, nil
+}
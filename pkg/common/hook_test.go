@@ -0,0 +1,63 @@
+package common
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type HookSuite struct {
+	suite.Suite
+}
+
+func (suite *HookSuite) TestRunCommand() {
+	outputPath := filepath.Join(suite.T().TempDir(), "hook")
+	hook := &FileHook{
+		Command: []string{"sh", "-c", `echo -n "$REGISTRY_CREDS_HANDLER_PATH" > ` + outputPath},
+	}
+	suite.Require().NoError(hook.Validate())
+
+	err := hook.Run(context.Background(), "/kaniko/.docker/config.json")
+	suite.Require().NoError(err)
+
+	output, err := os.ReadFile(outputPath)
+	suite.Require().NoError(err)
+	suite.Require().Equal("/kaniko/.docker/config.json", string(output))
+}
+
+func (suite *HookSuite) TestRunFailingCommand() {
+	hook := &FileHook{Command: []string{"sh", "-c", "echo failed; exit 1"}}
+	err := hook.Run(context.Background(), "config.json")
+	suite.Require().Error(err)
+	suite.Require().Contains(err.Error(), "failed")
+}
+
+func (suite *HookSuite) TestValidate() {
+	for _, test := range []struct {
+		name        string
+		hook        *FileHook
+		expectedErr bool
+	}{
+		{name: "signal", hook: &FileHook{Signal: "SIGHUP", PidFile: "/run/build.pid"}},
+		{name: "shortSignal", hook: &FileHook{Signal: "usr1", PidFile: "/run/build.pid"}},
+		{name: "unknownSignal", hook: &FileHook{Signal: "SIGKILLALL", PidFile: "/run/build.pid"}, expectedErr: true},
+		{name: "signalWithoutPidFile", hook: &FileHook{Signal: "SIGHUP"}, expectedErr: true},
+		{name: "pidFileWithoutSignal", hook: &FileHook{PidFile: "/run/build.pid"}, expectedErr: true},
+	} {
+		suite.Run(test.name, func() {
+			err := test.hook.Validate()
+			if test.expectedErr {
+				suite.Require().Error(err)
+			} else {
+				suite.Require().NoError(err)
+			}
+		})
+	}
+}
+
+func TestHook(t *testing.T) {
+	suite.Run(t, new(HookSuite))
+}
@@ -1,6 +1,7 @@
 package common
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 
@@ -8,10 +9,33 @@ import (
 
 	"github.com/nuclio/errors"
 	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+
+	// cachedResourceVersion makes the API server serve a read from its watch cache
+	cachedResourceVersion = "0"
+
+	// OwnedRegistriesAnnotation lists the registry URIs whose auths were written by us,
+	// used to tell our entries apart from others' in merged docker config json secrets
+	OwnedRegistriesAnnotation = "registry-creds-handler.v3io.io/owned-registries"
+)
+
+type SecretOperation string
+
+const (
+	SecretOperationCreate    SecretOperation = "create"
+	SecretOperationUpdate    SecretOperation = "update"
+	SecretOperationUnchanged SecretOperation = "unchanged"
+	SecretOperationDelete    SecretOperation = "delete"
 )
 
 type DockerConfigJSON struct {
@@ -19,7 +43,11 @@ type DockerConfigJSON struct {
 }
 
 type RegistryAuth struct {
-	Auth string `json:"auth"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+	RegistryToken string `json:"registrytoken,omitempty"`
 }
 
 func GetClientConfig(kubeConfigPath string) (*rest.Config, error) {
@@ -88,46 +116,456 @@ func UpdateSecret(ctx context.Context,
 	return nil
 }
 
+// ListSecrets lists the secrets matching a label selector, in all namespaces when namespace is empty
+func ListSecrets(ctx context.Context,
+	kubeClient kubernetes.Interface,
+	namespace string,
+	labelSelector string) ([]v1.Secret, error) {
+
+	secretList, err := kubeClient.CoreV1().Secrets(namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: labelSelector,
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list secrets")
+	}
+
+	return secretList.Items, nil
+}
+
+// RemoveServiceAccountsImagePullSecrets removes the given secret names from the imagePullSecrets of
+// every service account in namespace, returning the names of the updated service accounts
+func RemoveServiceAccountsImagePullSecrets(ctx context.Context,
+	kubeClient kubernetes.Interface,
+	namespace string,
+	secretNames []string) ([]string, error) {
+
+	removedSecretNames := map[string]bool{}
+	for _, secretName := range secretNames {
+		removedSecretNames[secretName] = true
+	}
+
+	serviceAccountList, err := kubeClient.CoreV1().ServiceAccounts(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list service accounts")
+	}
+
+	var updatedServiceAccountNames []string
+	for _, serviceAccount := range serviceAccountList.Items {
+		serviceAccountName := serviceAccount.Name
+		updated := false
+
+		if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			serviceAccount, err := kubeClient.CoreV1().ServiceAccounts(namespace).Get(ctx,
+				serviceAccountName,
+				metav1.GetOptions{})
+			if err != nil {
+				return errors.Wrap(err, "Failed to get service account")
+			}
+
+			var imagePullSecrets []v1.LocalObjectReference
+			for _, imagePullSecret := range serviceAccount.ImagePullSecrets {
+				if !removedSecretNames[imagePullSecret.Name] {
+					imagePullSecrets = append(imagePullSecrets, imagePullSecret)
+				}
+			}
+			if len(imagePullSecrets) == len(serviceAccount.ImagePullSecrets) {
+				return nil
+			}
+
+			serviceAccount.ImagePullSecrets = imagePullSecrets
+			if _, err := kubeClient.CoreV1().ServiceAccounts(namespace).Update(ctx,
+				serviceAccount,
+				metav1.UpdateOptions{}); err != nil {
+				return errors.Wrapf(err, "Failed to update service account: %s", serviceAccountName)
+			}
+			updated = true
+			return nil
+		}); err != nil {
+			return updatedServiceAccountNames, err
+		}
+
+		if updated {
+			updatedServiceAccountNames = append(updatedServiceAccountNames, serviceAccountName)
+		}
+	}
+
+	return updatedServiceAccountNames, nil
+}
+
+// ReplaceServiceAccountsImagePullSecrets replaces the given secret names in the imagePullSecrets of every service
+// account in namespace with secretName, in place so that their order is kept. Service accounts named in
+// serviceAccountNames get secretName added when they do not refer to it. Returns the names of the updated
+// service accounts
+func ReplaceServiceAccountsImagePullSecrets(ctx context.Context,
+	kubeClient kubernetes.Interface,
+	namespace string,
+	replacedSecretNames []string,
+	secretName string,
+	serviceAccountNames []string) ([]string, error) {
+
+	replaced := map[string]bool{}
+	for _, replacedSecretName := range replacedSecretNames {
+		replaced[replacedSecretName] = true
+	}
+	attached := map[string]bool{}
+	for _, serviceAccountName := range serviceAccountNames {
+		attached[serviceAccountName] = true
+	}
+
+	serviceAccountList, err := kubeClient.CoreV1().ServiceAccounts(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list service accounts")
+	}
+
+	var updatedServiceAccountNames []string
+	for _, serviceAccount := range serviceAccountList.Items {
+		serviceAccountName := serviceAccount.Name
+		updated := false
+
+		if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+			serviceAccount, err := kubeClient.CoreV1().ServiceAccounts(namespace).Get(ctx,
+				serviceAccountName,
+				metav1.GetOptions{})
+			if err != nil {
+				return errors.Wrap(err, "Failed to get service account")
+			}
+
+			var imagePullSecrets []v1.LocalObjectReference
+			found := false
+			for _, imagePullSecret := range serviceAccount.ImagePullSecrets {
+				if imagePullSecret.Name == secretName || replaced[imagePullSecret.Name] {
+					if !found {
+						imagePullSecrets = append(imagePullSecrets, v1.LocalObjectReference{Name: secretName})
+						found = true
+					}
+					continue
+				}
+				imagePullSecrets = append(imagePullSecrets, imagePullSecret)
+			}
+			if !found && attached[serviceAccountName] {
+				imagePullSecrets = append(imagePullSecrets, v1.LocalObjectReference{Name: secretName})
+			}
+			if equality.Semantic.DeepEqual(imagePullSecrets, serviceAccount.ImagePullSecrets) {
+				return nil
+			}
+
+			serviceAccount.ImagePullSecrets = imagePullSecrets
+			if _, err := kubeClient.CoreV1().ServiceAccounts(namespace).Update(ctx,
+				serviceAccount,
+				metav1.UpdateOptions{}); err != nil {
+				return errors.Wrapf(err, "Failed to update service account: %s", serviceAccountName)
+			}
+			updated = true
+			return nil
+		}); err != nil {
+			return updatedServiceAccountNames, err
+		}
+
+		if updated {
+			updatedServiceAccountNames = append(updatedServiceAccountNames, serviceAccountName)
+		}
+	}
+
+	return updatedServiceAccountNames, nil
+}
+
+// PatchSecret applies a json merge patch to a secret
+func PatchSecret(ctx context.Context,
+	kubeClient kubernetes.Interface,
+	namespace string,
+	secretName string,
+	patch []byte) error {
+
+	if _, err := kubeClient.CoreV1().Secrets(namespace).Patch(ctx,
+		secretName,
+		types.MergePatchType,
+		patch,
+		metav1.PatchOptions{}); err != nil {
+		return errors.Wrapf(err, "Failed to patch secret: %s", secretName)
+	}
+
+	return nil
+}
+
+// DeleteSecret deletes a secret
+func DeleteSecret(ctx context.Context,
+	kubeClient kubernetes.Interface,
+	namespace string,
+	secretName string) error {
+
+	if err := kubeClient.CoreV1().Secrets(namespace).Delete(ctx,
+		secretName,
+		metav1.DeleteOptions{}); err != nil {
+		return errors.Wrapf(err, "Failed to delete secret: %s", secretName)
+	}
+
+	return nil
+}
+
+// DeleteSecretVersion deletes a secret only if it is still of resourceVersion, failing with a conflict otherwise
+func DeleteSecretVersion(ctx context.Context,
+	kubeClient kubernetes.Interface,
+	namespace string,
+	secretName string,
+	resourceVersion string) error {
+
+	if err := kubeClient.CoreV1().Secrets(namespace).Delete(ctx,
+		secretName,
+		metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{ResourceVersion: &resourceVersion},
+		}); err != nil {
+		return errors.Wrapf(err, "Failed to delete secret: %s", secretName)
+	}
+
+	return nil
+}
+
+// CreateOrUpdateSecret creates the secret, or patches the existing one when its content differs.
+// The first read is served from the API server cache, a stale read surfaces as a conflict
+// (the patch is conditioned on the read resourceVersion) and is retried against the latest version.
+// When merge is set, the docker config json auths of secret are merged into the existing secret's
+// rather than replacing them (see MergeRegistryAuthSecret)
 func CreateOrUpdateSecret(ctx context.Context,
 	kubeClient kubernetes.Interface,
-	secret *v1.Secret) error {
+	secret *v1.Secret,
+	merge bool) (SecretOperation, error) {
 
-	if _, err := GetSecret(ctx, kubeClient, secret.Namespace, secret.Name); err != nil {
-		if err = CreateSecret(ctx, kubeClient, secret); err != nil {
-			return errors.Wrap(err, "Failed to create secret")
+	operation := SecretOperationUnchanged
+	resourceVersion := cachedResourceVersion
+
+	if err := retry.OnError(retry.DefaultRetry, isRetryableWriteError, func() error {
+		existingSecret, err := kubeClient.CoreV1().Secrets(secret.Namespace).Get(ctx,
+			secret.Name,
+			metav1.GetOptions{ResourceVersion: resourceVersion})
+
+		// retries must not be served from cache
+		resourceVersion = ""
+
+		if err != nil {
+			if !apierrors.IsNotFound(err) {
+				return errors.Wrap(err, "Failed to get secret")
+			}
+			if err := CreateSecret(ctx, kubeClient, secret); err != nil {
+				return errors.Wrap(err, "Failed to create secret")
+			}
+			operation = SecretOperationCreate
+			return nil
+		}
+
+		desiredSecret := secret
+		if merge {
+			if desiredSecret, err = MergeRegistryAuthSecret(existingSecret, secret); err != nil {
+				return errors.Wrap(err, "Failed to merge secret")
+			}
 		}
 
-	} else {
-		if err = UpdateSecret(ctx, kubeClient, secret); err != nil {
+		patch, err := CompileSecretPatch(existingSecret, desiredSecret)
+		if err != nil {
+			return errors.Wrap(err, "Failed to compile secret patch")
+		}
+		if patch == nil {
+			operation = SecretOperationUnchanged
+			return nil
+		}
+		if err := PatchSecret(ctx, kubeClient, secret.Namespace, secret.Name, patch); err != nil {
 			return errors.Wrap(err, "Failed to update secret")
 		}
+		operation = SecretOperationUpdate
+		return nil
+	}); err != nil {
+		return "", err
 	}
-	return nil
+
+	return operation, nil
+}
+
+// CompileSecretPatch returns a json merge patch turning existingSecret into desiredSecret, or nil when
+// there is nothing to change. Only the desired labels and annotations are patched, so metadata added by
+// others is kept, while data keys missing from desiredSecret are removed
+func CompileSecretPatch(existingSecret *v1.Secret, desiredSecret *v1.Secret) ([]byte, error) {
+	if existingSecret.Type != desiredSecret.Type {
+		return nil, errors.Errorf("Secret %s/%s is of type %s, expected %s (secret type is immutable)",
+			existingSecret.Namespace,
+			existingSecret.Name,
+			existingSecret.Type,
+			desiredSecret.Type)
+	}
+
+	data := map[string]interface{}{}
+	for key, value := range desiredSecret.Data {
+		if existingValue, found := existingSecret.Data[key]; !found || !bytes.Equal(existingValue, value) {
+			data[key] = value
+		}
+	}
+	for key := range existingSecret.Data {
+		if _, found := desiredSecret.Data[key]; !found {
+			data[key] = nil
+		}
+	}
+
+	labels := compileStringMapPatch(existingSecret.Labels, desiredSecret.Labels)
+	annotations := compileStringMapPatch(existingSecret.Annotations, desiredSecret.Annotations)
+
+	if len(data) == 0 && len(labels) == 0 && len(annotations) == 0 {
+		return nil, nil
+	}
+
+	metadata := map[string]interface{}{
+		"resourceVersion": existingSecret.ResourceVersion,
+	}
+	if len(labels) > 0 {
+		metadata["labels"] = labels
+	}
+	if len(annotations) > 0 {
+		metadata["annotations"] = annotations
+	}
+
+	patch := map[string]interface{}{
+		"metadata": metadata,
+	}
+	if len(data) > 0 {
+		patch["data"] = data
+	}
+
+	return json.Marshal(patch)
 }
 
-// CompileRegistryAuthSecret creates a secret object with docker config json
-func CompileRegistryAuthSecret(token *registry.Token) (*v1.Secret, error) {
-	secret := &v1.Secret{
-		ObjectMeta: metav1.ObjectMeta{
-			Name:      token.SecretName,
-			Namespace: token.Namespace,
-		},
-		Type: "kubernetes.io/dockerconfigjson",
+// compileStringMapPatch returns the desired entries that are missing or different in existing
+func compileStringMapPatch(existing map[string]string, desired map[string]string) map[string]string {
+	patch := map[string]string{}
+	for key, value := range desired {
+		if existingValue, found := existing[key]; !found || existingValue != value {
+			patch[key] = value
+		}
 	}
+	return patch
+}
 
-	auths := map[string]RegistryAuth{}
-	auths[token.RegistryUri] = RegistryAuth{
-		Auth: token.Auth,
+// MergeRegistryAuthSecret returns a copy of desiredSecret whose docker config json holds the auths of
+// existingSecret, without the ones we previously owned, alongside the auths of desiredSecret
+func MergeRegistryAuthSecret(existingSecret *v1.Secret, desiredSecret *v1.Secret) (*v1.Secret, error) {
+	if existingSecret.Type != v1.SecretTypeDockerConfigJson {
+		return nil, errors.Errorf("Can not merge into secret %s/%s of type %s",
+			existingSecret.Namespace,
+			existingSecret.Name,
+			existingSecret.Type)
 	}
 
-	configJSON, err := json.Marshal(DockerConfigJSON{Auths: auths})
+	configJSON, err := MergeDockerConfigJSON(existingSecret.Data[v1.DockerConfigJsonKey],
+		SplitRegistryUris(existingSecret.Annotations[OwnedRegistriesAnnotation]),
+		desiredSecret.Data[v1.DockerConfigJsonKey])
 	if err != nil {
-		return nil, errors.Wrap(err, "Failed to marshal docker config json")
+		return nil, errors.Wrap(err, "Failed to merge docker config json")
 	}
 
-	secret.Data = map[string][]byte{
-		".dockerconfigjson": configJSON,
+	mergedSecret := desiredSecret.DeepCopy()
+	mergedSecret.Data = map[string][]byte{}
+	for key, value := range existingSecret.Data {
+		mergedSecret.Data[key] = value
 	}
+	mergedSecret.Data[v1.DockerConfigJsonKey] = configJSON
 
-	return secret, nil
+	return mergedSecret, nil
+}
+
+// RemoveOwnedRegistryAuths removes the docker config json auths we own, along with our metadata, from a secret,
+// leaving others' entries untouched. The secret is deleted once no auths are left in it, as long as it was not
+// written meanwhile (e.g.: someone else added an entry), in which case it is read again
+func RemoveOwnedRegistryAuths(ctx context.Context,
+	kubeClient kubernetes.Interface,
+	namespace string,
+	secretName string) (SecretOperation, error) {
+
+	operation := SecretOperationUnchanged
+
+	if err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		existingSecret, err := GetSecret(ctx, kubeClient, namespace, secretName)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				operation = SecretOperationUnchanged
+				return nil
+			}
+			return errors.Wrap(err, "Failed to get secret")
+		}
+
+		ownedRegistryUris := SplitRegistryUris(existingSecret.Annotations[OwnedRegistriesAnnotation])
+		if len(ownedRegistryUris) == 0 {
+			operation = SecretOperationUnchanged
+			return nil
+		}
+
+		configJSON, remainingAuths, err := RemoveDockerConfigJSONAuths(existingSecret.Data[v1.DockerConfigJsonKey],
+			ownedRegistryUris)
+		if err != nil {
+			return errors.Wrap(err, "Failed to remove owned auths")
+		}
+
+		if remainingAuths == 0 {
+			if err := DeleteSecretVersion(ctx,
+				kubeClient,
+				namespace,
+				secretName,
+				existingSecret.ResourceVersion); err != nil && !apierrors.IsNotFound(err) {
+				return errors.Wrap(err, "Failed to delete secret")
+			}
+			operation = SecretOperationDelete
+			return nil
+		}
+
+		patch, err := json.Marshal(map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": existingSecret.ResourceVersion,
+				"labels": map[string]interface{}{
+					MergedLabel:   nil,
+					InstanceLabel: nil,
+				},
+				"annotations": map[string]interface{}{
+					OwnedRegistriesAnnotation: nil,
+					RegistryKindsAnnotation:   nil,
+					SourcesAnnotation:         nil,
+					IssuedAtAnnotation:        nil,
+					ExpiresAtAnnotation:       nil,
+					WriterAnnotation:          nil,
+				},
+			},
+			"data": map[string]interface{}{
+				v1.DockerConfigJsonKey: configJSON,
+			},
+		})
+		if err != nil {
+			return errors.Wrap(err, "Failed to marshal secret patch")
+		}
+
+		if err := PatchSecret(ctx, kubeClient, namespace, secretName, patch); err != nil {
+			return errors.Wrap(err, "Failed to update secret")
+		}
+		operation = SecretOperationUpdate
+		return nil
+	}); err != nil {
+		return "", err
+	}
+
+	return operation, nil
+}
+
+func isRetryableWriteError(err error) bool {
+
+	// a conflict means our read was stale, already exists means someone created the secret meanwhile
+	return apierrors.IsConflict(err) || apierrors.IsAlreadyExists(err)
+}
+
+// CompileRegistryAuth creates a docker config json auth entry from a token
+func CompileRegistryAuth(token *registry.Token) RegistryAuth {
+	return RegistryAuth{
+		Username:      token.Username,
+		Password:      token.Password,
+		Auth:          token.GetAuth(),
+		IdentityToken: token.IdentityToken,
+		RegistryToken: token.RegistryToken,
+	}
+}
+
+// CompileRegistryAuthSecret creates a secret object with docker config json, holding the auths of all tokens
+func CompileRegistryAuthSecret(secretName string, namespace string, tokens []*registry.Token) (*v1.Secret, error) {
+	return CompileSecret(secretName, namespace, SecretFormatDockerConfigJSON, "", "", tokens)
 }
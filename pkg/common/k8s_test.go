@@ -0,0 +1,272 @@
+package common
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+
+	"github.com/nuclio/errors"
+	"github.com/stretchr/testify/suite"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+type K8sSuite struct {
+	suite.Suite
+	ctx context.Context
+}
+
+func (suite *K8sSuite) SetupTest() {
+	suite.ctx = context.Background()
+}
+
+func (suite *K8sSuite) TestCreateOrUpdateSecret() {
+	kubeClientSet := fake.NewSimpleClientset()
+	secret := suite.compileSecret("some auth")
+
+	operation, err := CreateOrUpdateSecret(suite.ctx, kubeClientSet, secret, false)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationCreate, operation)
+
+	// same content, nothing to write
+	operation, err = CreateOrUpdateSecret(suite.ctx, kubeClientSet, suite.compileSecret("some auth"), false)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUnchanged, operation)
+
+	// someone else labels the secret
+	existingSecret, err := GetSecret(suite.ctx, kubeClientSet, secret.Namespace, secret.Name)
+	suite.Require().NoError(err)
+	existingSecret.Labels = map[string]string{"team": "platform"}
+	existingSecret.Annotations = map[string]string{"argocd.argoproj.io/compare-options": "IgnoreExtraneous"}
+	_, err = kubeClientSet.CoreV1().Secrets(secret.Namespace).Update(suite.ctx, existingSecret, metav1.UpdateOptions{})
+	suite.Require().NoError(err)
+
+	// refreshed token is written, foreign metadata is kept
+	operation, err = CreateOrUpdateSecret(suite.ctx, kubeClientSet, suite.compileSecret("other auth"), false)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUpdate, operation)
+
+	updatedSecret, err := GetSecret(suite.ctx, kubeClientSet, secret.Namespace, secret.Name)
+	suite.Require().NoError(err)
+	suite.Require().Equal(suite.compileSecret("other auth").Data, updatedSecret.Data)
+	suite.Require().Equal("platform", updatedSecret.Labels["team"])
+	suite.Require().Equal("IgnoreExtraneous", updatedSecret.Annotations["argocd.argoproj.io/compare-options"])
+}
+
+func (suite *K8sSuite) TestCreateOrUpdateSecretGetFailure() {
+	kubeClientSet := fake.NewSimpleClientset()
+	kubeClientSet.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "secret", nil)
+	})
+
+	// a forbidden read must not be mistaken for a missing secret
+	_, err := CreateOrUpdateSecret(suite.ctx, kubeClientSet, suite.compileSecret("some auth"), false)
+	suite.Require().Error(err)
+	for _, action := range kubeClientSet.Actions() {
+		suite.Require().NotEqual("create", action.GetVerb())
+	}
+}
+
+func (suite *K8sSuite) TestCreateOrUpdateSecretConflict() {
+	kubeClientSet := fake.NewSimpleClientset(suite.compileSecret("some auth"))
+
+	conflicts := 0
+	kubeClientSet.PrependReactor("patch", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts == 0 {
+			conflicts++
+			return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "secret", nil)
+		}
+		return false, nil, nil
+	})
+
+	operation, err := CreateOrUpdateSecret(suite.ctx, kubeClientSet, suite.compileSecret("other auth"), false)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUpdate, operation)
+	suite.Require().Equal(1, conflicts)
+}
+
+func (suite *K8sSuite) TestMergeRegistryAuthSecret() {
+	existingSecret := suite.compileSecret(`{"auths":{"docker.io":{"auth":"docker hub auth"}}}`)
+	kubeClientSet := fake.NewSimpleClientset(existingSecret)
+
+	token := &registry.Token{
+		Auth:        "ecr auth",
+		RegistryUri: "ecr.mock.com",
+	}
+	secret, err := CompileRegistryAuthSecret(existingSecret.Name, existingSecret.Namespace, []*registry.Token{token})
+	suite.Require().NoError(err)
+
+	operation, err := CreateOrUpdateSecret(suite.ctx, kubeClientSet, secret, true)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUpdate, operation)
+	suite.Require().Equal([]string{"docker.io", "ecr.mock.com"}, suite.getRegistryUris(kubeClientSet))
+
+	// our entry moves to another registry, the stale one is dropped and others' are kept
+	token.RegistryUri = "other.ecr.mock.com"
+	secret, err = CompileRegistryAuthSecret(existingSecret.Name, existingSecret.Namespace, []*registry.Token{token})
+	suite.Require().NoError(err)
+
+	operation, err = CreateOrUpdateSecret(suite.ctx, kubeClientSet, secret, true)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUpdate, operation)
+	suite.Require().Equal([]string{"docker.io", "other.ecr.mock.com"}, suite.getRegistryUris(kubeClientSet))
+
+	// cleanup removes only our entry
+	operation, err = RemoveOwnedRegistryAuths(suite.ctx, kubeClientSet, secret.Namespace, secret.Name)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUpdate, operation)
+	suite.Require().Equal([]string{"docker.io"}, suite.getRegistryUris(kubeClientSet))
+}
+
+func (suite *K8sSuite) TestMergeRegistryAuthSecretForeignEntry() {
+	existingSecret := suite.compileSecret(`{"auths":{"ecr.mock.com":{"auth":"admin auth"}}}`)
+	kubeClientSet := fake.NewSimpleClientset(existingSecret)
+
+	secret, err := CompileRegistryAuthSecret(existingSecret.Name, existingSecret.Namespace, []*registry.Token{
+		{Auth: "ecr auth", RegistryUri: "ecr.mock.com"},
+	})
+	suite.Require().NoError(err)
+
+	// an entry we did not write is not taken over, as cleanup would remove it
+	_, err = CreateOrUpdateSecret(suite.ctx, kubeClientSet, secret, true)
+	suite.Require().Error(err)
+	suite.Require().Contains(errors.RootCause(err).Error(), "ecr.mock.com")
+
+	updatedSecret, err := GetSecret(suite.ctx, kubeClientSet, secret.Namespace, secret.Name)
+	suite.Require().NoError(err)
+	suite.Require().Equal(existingSecret.Data, updatedSecret.Data)
+	suite.Require().Empty(updatedSecret.Annotations[OwnedRegistriesAnnotation])
+}
+
+func (suite *K8sSuite) TestRemoveOwnedRegistryAuthsWrittenMeanwhile() {
+	secret, err := CompileRegistryAuthSecret("secret", "namespace", []*registry.Token{
+		{
+			Auth:        "ecr auth",
+			RegistryUri: "ecr.mock.com",
+		},
+	})
+	suite.Require().NoError(err)
+	secret.Annotations = map[string]string{OwnedRegistriesAnnotation: "ecr.mock.com"}
+	kubeClientSet := fake.NewSimpleClientset(secret)
+
+	// someone else adds an entry once we read the secret (the fake client does not check preconditions)
+	conflicts := 0
+	kubeClientSet.PrependReactor("delete", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicts > 0 {
+			return false, nil, nil
+		}
+		conflicts++
+
+		existingSecret := secret.DeepCopy()
+		existingSecret.Data[v1.DockerConfigJsonKey] = []byte(`{"auths":{"docker.io":{"auth":"docker hub auth"},` +
+			`"ecr.mock.com":{"auth":"ecr auth"}}}`)
+		suite.Require().NoError(kubeClientSet.Tracker().Update(v1.SchemeGroupVersion.WithResource("secrets"),
+			existingSecret,
+			"namespace"))
+		return true, nil, apierrors.NewConflict(schema.GroupResource{Resource: "secrets"}, "secret", nil)
+	})
+
+	// their entry is kept rather than deleted along with the secret
+	operation, err := RemoveOwnedRegistryAuths(suite.ctx, kubeClientSet, "namespace", "secret")
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUpdate, operation)
+	suite.Require().Equal(1, conflicts)
+	suite.Require().Equal([]string{"docker.io"}, suite.getRegistryUris(kubeClientSet))
+}
+
+func (suite *K8sSuite) TestCompileRegistryAuthSecret() {
+	tokens := []*registry.Token{
+		{
+			Username:     "AWS",
+			Password:     "password",
+			RegistryUri:  "ecr.mock.com",
+			RegistryUris: []string{"alias.ecr.mock.com", "ecr.mock.com"},
+		},
+		{
+			IdentityToken: "identity token",
+			RegistryUri:   "oauth.mock.com",
+		},
+	}
+
+	secret, err := CompileRegistryAuthSecret("secret", "namespace", tokens)
+	suite.Require().NoError(err)
+	suite.Require().Equal("alias.ecr.mock.com,ecr.mock.com,oauth.mock.com", secret.Annotations[OwnedRegistriesAnnotation])
+
+	dockerConfigJSON := DockerConfigJSON{}
+	err = json.Unmarshal(secret.Data[v1.DockerConfigJsonKey], &dockerConfigJSON)
+	suite.Require().NoError(err)
+
+	ecrAuth := RegistryAuth{
+		Username: "AWS",
+		Password: "password",
+		Auth:     base64.StdEncoding.EncodeToString([]byte("AWS:password")),
+	}
+	suite.Require().Equal(map[string]RegistryAuth{
+		"ecr.mock.com":       ecrAuth,
+		"alias.ecr.mock.com": ecrAuth,
+		"oauth.mock.com":     {IdentityToken: "identity token"},
+	}, dockerConfigJSON.Auths)
+}
+
+func (suite *K8sSuite) TestPlanCreateOrUpdateSecret() {
+	existingSecret := suite.compileSecret(`{"auths":{"docker.io":{"auth":"docker hub auth"}}}`)
+	kubeClientSet := fake.NewSimpleClientset(existingSecret)
+
+	secret, err := CompileRegistryAuthSecret(existingSecret.Name, existingSecret.Namespace, []*registry.Token{
+		{Auth: "ecr auth", RegistryUri: "ecr.mock.com"},
+	})
+	suite.Require().NoError(err)
+
+	plan, err := PlanCreateOrUpdateSecret(suite.ctx, kubeClientSet, secret, true)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationUpdate, plan.Operation)
+	suite.Require().Equal([]string{
+		"+ annotation registry-creds-handler.v3io.io/owned-registries: ecr.mock.com",
+		"+ data[.dockerconfigjson].auths[ecr.mock.com]: <redacted>",
+	}, plan.Changes)
+
+	secret.Name = "other"
+	plan, err = PlanCreateOrUpdateSecret(suite.ctx, kubeClientSet, secret, false)
+	suite.Require().NoError(err)
+	suite.Require().Equal(SecretOperationCreate, plan.Operation)
+
+	// nothing was written, and no secret value leaked
+	for _, action := range kubeClientSet.Actions() {
+		suite.Require().Equal("get", action.GetVerb())
+	}
+	suite.Require().NotContains(FormatSecretPlans([]*SecretPlan{plan}), "ecr auth")
+}
+
+func (suite *K8sSuite) getRegistryUris(kubeClientSet *fake.Clientset) []string {
+	secret, err := GetSecret(suite.ctx, kubeClientSet, "namespace", "secret")
+	suite.Require().NoError(err)
+
+	registryUris, err := GetDockerConfigJSONRegistryUris(secret.Data[v1.DockerConfigJsonKey])
+	suite.Require().NoError(err)
+	return registryUris
+}
+
+func (suite *K8sSuite) compileSecret(auth string) *v1.Secret {
+	return &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "secret",
+			Namespace: "namespace",
+		},
+		Type: v1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			v1.DockerConfigJsonKey: []byte(auth),
+		},
+	}
+}
+
+func TestK8s(t *testing.T) {
+	suite.Run(t, new(K8sSuite))
+}
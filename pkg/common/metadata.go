@@ -0,0 +1,118 @@
+package common
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+
+	"github.com/nuclio/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+const (
+	ManagedByLabel      = "app.kubernetes.io/managed-by"
+	ManagedByLabelValue = "registry-creds-handler"
+
+	// MergedLabel marks secrets someone else manages, which we merged our registry auths into
+	MergedLabel = "registry-creds-handler.v3io.io/merged"
+
+	// InstanceLabel marks secrets with the handler installation that wrote them, WriterAnnotation with the
+	// process (e.g.: pod) that last wrote them
+	InstanceLabel    = "registry-creds-handler.v3io.io/instance"
+	WriterAnnotation = "registry-creds-handler.v3io.io/writer"
+
+	RegistryKindsAnnotation = "registry-creds-handler.v3io.io/registry-kinds"
+	SourcesAnnotation       = "registry-creds-handler.v3io.io/sources"
+	IssuedAtAnnotation      = "registry-creds-handler.v3io.io/issued-at"
+	ExpiresAtAnnotation     = "registry-creds-handler.v3io.io/expires-at"
+
+	// VersionOfLabel marks immutable secret versions with the name of the secret they are a version of,
+	// CreatedAtAnnotation orders the versions
+	VersionOfLabel      = "registry-creds-handler.v3io.io/version-of"
+	CreatedAtAnnotation = "registry-creds-handler.v3io.io/created-at"
+)
+
+// SecretMetadataTemplateData is what secret name, label and annotation templates are executed with
+type SecretMetadataTemplateData struct {
+	Namespace string
+
+	// Registry is the names of the registries compiled into the secret, joined by dashes
+	Registry   string
+	Registries []string
+	Kinds      []string
+}
+
+// ParseSecretMetadataTemplate parses a secret name, label or annotation template
+func ParseSecretMetadataTemplate(metadataTemplate string) (*template.Template, error) {
+	return template.New("metadata").Option("missingkey=error").Parse(metadataTemplate)
+}
+
+// RenderSecretMetadataTemplate renders a secret name, label or annotation template, plain values render as is
+func RenderSecretMetadataTemplate(metadataTemplate string, data *SecretMetadataTemplateData) (string, error) {
+	parsedTemplate, err := ParseSecretMetadataTemplate(metadataTemplate)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to parse template: %s", metadataTemplate)
+	}
+
+	var renderedTemplate bytes.Buffer
+	if err := parsedTemplate.Execute(&renderedTemplate, data); err != nil {
+		return "", errors.Wrapf(err, "Failed to execute template: %s", metadataTemplate)
+	}
+
+	return renderedTemplate.String(), nil
+}
+
+// RenderSecretName renders a secret name template, failing unless it renders a valid secret name
+func RenderSecretName(secretNameTemplate string, data *SecretMetadataTemplateData) (string, error) {
+	secretName, err := RenderSecretMetadataTemplate(secretNameTemplate, data)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to render secret name template")
+	}
+	if errorMessages := validation.IsDNS1123Subdomain(secretName); len(errorMessages) > 0 {
+		return "", errors.Errorf("Secret name %s is not a valid DNS-1123 subdomain: %s",
+			secretName,
+			strings.Join(errorMessages, ", "))
+	}
+	return secretName, nil
+}
+
+// RenderSecretMetadataTemplates renders the values of a label or annotation templates map
+func RenderSecretMetadataTemplates(metadataTemplates map[string]string,
+	data *SecretMetadataTemplateData) (map[string]string, error) {
+
+	renderedMetadata := map[string]string{}
+	for key, metadataTemplate := range metadataTemplates {
+		renderedValue, err := RenderSecretMetadataTemplate(metadataTemplate, data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to render %s", key)
+		}
+		renderedMetadata[key] = renderedValue
+	}
+	return renderedMetadata, nil
+}
+
+// GetTokensValidity returns the latest issue time and the earliest expiry time of the tokens,
+// zero when none of them are known
+func GetTokensValidity(tokens []*registry.Token) (time.Time, time.Time) {
+	var issuedAt, expiresAt time.Time
+	for _, token := range tokens {
+		if token.IssuedAt.After(issuedAt) {
+			issuedAt = token.IssuedAt
+		}
+		if !token.ExpiresAt.IsZero() && (expiresAt.IsZero() || token.ExpiresAt.Before(expiresAt)) {
+			expiresAt = token.ExpiresAt
+		}
+	}
+	return issuedAt, expiresAt
+}
+
+// GetWriter returns the identity of this process secrets are annotated with, its hostname (the pod name in
+// a cluster)
+func GetWriter() string {
+	hostname, _ := os.Hostname()
+	return hostname
+}
@@ -0,0 +1,319 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/nuclio/errors"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// SecretPlan describes what writing a secret would change, without its secret values.
+// Plans of destinations outside of the cluster (e.g.: files) have a kind and no namespace
+type SecretPlan struct {
+	Operation SecretOperation
+	Kind      string
+	Namespace string
+	Name      string
+	Type      v1.SecretType
+
+	// Changes are human readable, redacted changes
+	Changes []string
+}
+
+// PlanCreateOrUpdateSecret returns what CreateOrUpdateSecret would do with secret, writing nothing
+func PlanCreateOrUpdateSecret(ctx context.Context,
+	kubeClient kubernetes.Interface,
+	secret *v1.Secret,
+	merge bool) (*SecretPlan, error) {
+
+	plan := &SecretPlan{
+		Namespace: secret.Namespace,
+		Name:      secret.Name,
+		Type:      secret.Type,
+	}
+
+	existingSecret, err := GetSecret(ctx, kubeClient, secret.Namespace, secret.Name)
+	if err != nil {
+		if !apierrors.IsNotFound(err) {
+			return nil, errors.Wrap(err, "Failed to get secret")
+		}
+		plan.Operation = SecretOperationCreate
+		plan.Changes = diffSecrets(&v1.Secret{}, secret)
+		return plan, nil
+	}
+
+	desiredSecret := secret
+	if merge {
+		if desiredSecret, err = MergeRegistryAuthSecret(existingSecret, secret); err != nil {
+			return nil, errors.Wrap(err, "Failed to merge secret")
+		}
+	}
+
+	patch, err := CompileSecretPatch(existingSecret, desiredSecret)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to compile secret patch")
+	}
+	if patch == nil {
+		plan.Operation = SecretOperationUnchanged
+		return plan, nil
+	}
+
+	plan.Operation = SecretOperationUpdate
+	plan.Changes = diffSecrets(existingSecret, desiredSecret)
+	return plan, nil
+}
+
+// PlanRemoveOwnedRegistryAuths returns what RemoveOwnedRegistryAuths would do with a secret, writing nothing
+func PlanRemoveOwnedRegistryAuths(existingSecret *v1.Secret) (*SecretPlan, error) {
+	plan := &SecretPlan{
+		Operation: SecretOperationUnchanged,
+		Namespace: existingSecret.Namespace,
+		Name:      existingSecret.Name,
+		Type:      existingSecret.Type,
+	}
+
+	ownedRegistryUris := SplitRegistryUris(existingSecret.Annotations[OwnedRegistriesAnnotation])
+	if len(ownedRegistryUris) == 0 {
+		return plan, nil
+	}
+
+	configJSON, remainingAuths, err := RemoveDockerConfigJSONAuths(existingSecret.Data[v1.DockerConfigJsonKey],
+		ownedRegistryUris)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to remove owned auths")
+	}
+
+	if remainingAuths == 0 {
+		return PlanDeleteSecret(existingSecret), nil
+	}
+
+	desiredSecret := existingSecret.DeepCopy()
+	desiredSecret.Data[v1.DockerConfigJsonKey] = configJSON
+	plan.Operation = SecretOperationUpdate
+	plan.Changes = diffSecrets(existingSecret, desiredSecret)
+	return plan, nil
+}
+
+// PlanDeleteSecret returns a plan deleting existingSecret
+func PlanDeleteSecret(existingSecret *v1.Secret) *SecretPlan {
+	return &SecretPlan{
+		Operation: SecretOperationDelete,
+		Namespace: existingSecret.Namespace,
+		Name:      existingSecret.Name,
+		Type:      existingSecret.Type,
+		Changes:   diffSecrets(existingSecret, &v1.Secret{}),
+	}
+}
+
+// PlanWriteDockerConfigJSONFile returns what WriteDockerConfigJSONFile would do with path, writing nothing
+func PlanWriteDockerConfigJSONFile(path string, desiredConfig []byte, merge bool) (*SecretPlan, error) {
+	plan := &SecretPlan{
+		Operation: SecretOperationUpdate,
+		Kind:      "file",
+		Name:      path,
+	}
+
+	existingConfig, err := os.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "Failed to read file: %s", path)
+		}
+		plan.Operation = SecretOperationCreate
+	}
+
+	config := desiredConfig
+	if merge && len(existingConfig) > 0 {
+		previouslyOwned, err := readOwnedRegistryUris(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to read owned registries")
+		}
+		if config, err = MergeDockerConfigJSON(existingConfig, previouslyOwned, desiredConfig); err != nil {
+			return nil, errors.Wrapf(err, "Failed to merge file: %s", path)
+		}
+	}
+
+	if plan.Operation == SecretOperationUpdate && bytes.Equal(existingConfig, config) {
+		plan.Operation = SecretOperationUnchanged
+		return plan, nil
+	}
+
+	plan.Changes = diffRegistryAuths(v1.DockerConfigJsonKey, existingConfig, config)
+	if plan.Changes == nil {
+		plan.Changes = []string{"~ <redacted>"}
+	}
+	return plan, nil
+}
+
+// FormatSecretPlans renders plans grouped by namespace, followed by a per operation summary
+func FormatSecretPlans(plans []*SecretPlan) string {
+	plansByNamespace := map[string][]*SecretPlan{}
+	var namespaces []string
+	operationCounts := map[SecretOperation]int{}
+	for _, plan := range plans {
+		if _, found := plansByNamespace[plan.Namespace]; !found {
+			namespaces = append(namespaces, plan.Namespace)
+		}
+		plansByNamespace[plan.Namespace] = append(plansByNamespace[plan.Namespace], plan)
+		operationCounts[plan.Operation]++
+	}
+	sort.Strings(namespaces)
+
+	var formattedPlans strings.Builder
+	for _, namespace := range namespaces {
+
+		// destinations outside of the cluster have no namespace
+		if namespace == "" {
+			fmt.Fprintf(&formattedPlans, "Outside the cluster:\n")
+		} else {
+			fmt.Fprintf(&formattedPlans, "Namespace %s:\n", namespace)
+		}
+		for _, plan := range plansByNamespace[namespace] {
+			if namespace == "" {
+				fmt.Fprintf(&formattedPlans, "  %s %s %s\n", plan.Operation, plan.Kind, plan.Name)
+			} else {
+				fmt.Fprintf(&formattedPlans, "  %s secret %s (%s)\n", plan.Operation, plan.Name, plan.Type)
+			}
+			for _, change := range plan.Changes {
+				fmt.Fprintf(&formattedPlans, "      %s\n", change)
+			}
+		}
+	}
+
+	fmt.Fprintf(&formattedPlans, "Plan: %d to create, %d to update, %d unchanged, %d to delete\n",
+		operationCounts[SecretOperationCreate],
+		operationCounts[SecretOperationUpdate],
+		operationCounts[SecretOperationUnchanged],
+		operationCounts[SecretOperationDelete])
+
+	return formattedPlans.String()
+}
+
+// diffSecrets returns the redacted changes between two secrets. Registry auths of docker config secrets
+// are compared entry by entry, other data keys as a whole, and metadata is shown as is
+func diffSecrets(existingSecret *v1.Secret, desiredSecret *v1.Secret) []string {
+	var changes []string
+
+	changes = append(changes, diffStringMaps("label", existingSecret.Labels, desiredSecret.Labels)...)
+	changes = append(changes, diffStringMaps("annotation", existingSecret.Annotations, desiredSecret.Annotations)...)
+
+	for _, key := range sortedDataKeys(existingSecret.Data, desiredSecret.Data) {
+		existingValue, existingFound := existingSecret.Data[key]
+		desiredValue, desiredFound := desiredSecret.Data[key]
+
+		if auths := diffRegistryAuths(key, existingValue, desiredValue); auths != nil {
+			changes = append(changes, auths...)
+			continue
+		}
+
+		switch {
+		case !existingFound:
+			changes = append(changes, fmt.Sprintf("+ data[%s]: <redacted>", key))
+		case !desiredFound:
+			changes = append(changes, fmt.Sprintf("- data[%s]: <redacted>", key))
+		case !bytes.Equal(existingValue, desiredValue):
+			changes = append(changes, fmt.Sprintf("~ data[%s]: <redacted>", key))
+		}
+	}
+
+	return changes
+}
+
+// diffRegistryAuths compares the auths of docker config data keys, returns nil if key is not one
+// or either value can not be parsed
+func diffRegistryAuths(key string, existingValue []byte, desiredValue []byte) []string {
+	if key != v1.DockerConfigJsonKey && key != ContainersAuthKey {
+		return nil
+	}
+
+	_, existingAuths, err := parseDockerConfigJSON(existingValue)
+	if err != nil {
+		return nil
+	}
+	_, desiredAuths, err := parseDockerConfigJSON(desiredValue)
+	if err != nil {
+		return nil
+	}
+
+	changes := []string{}
+	for _, registryUri := range sortedRawMessageKeys(existingAuths, desiredAuths) {
+		existingAuth, existingFound := existingAuths[registryUri]
+		desiredAuth, desiredFound := desiredAuths[registryUri]
+		switch {
+		case !existingFound:
+			changes = append(changes, fmt.Sprintf("+ data[%s].auths[%s]: <redacted>", key, registryUri))
+		case !desiredFound:
+			changes = append(changes, fmt.Sprintf("- data[%s].auths[%s]: <redacted>", key, registryUri))
+		case !bytes.Equal(existingAuth, desiredAuth):
+			changes = append(changes, fmt.Sprintf("~ data[%s].auths[%s]: <redacted>", key, registryUri))
+		}
+	}
+	return changes
+}
+
+// diffStringMaps returns the changes of the desired entries, entries missing from desired are
+// only removed when desired is empty (i.e.: the whole object is removed)
+func diffStringMaps(kind string, existing map[string]string, desired map[string]string) []string {
+	var keys []string
+	for key := range desired {
+		keys = append(keys, key)
+	}
+	if len(desired) == 0 {
+		for key := range existing {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	var changes []string
+	for _, key := range keys {
+		existingValue, existingFound := existing[key]
+		desiredValue, desiredFound := desired[key]
+		switch {
+		case !existingFound:
+			changes = append(changes, fmt.Sprintf("+ %s %s: %s", kind, key, desiredValue))
+		case !desiredFound:
+			changes = append(changes, fmt.Sprintf("- %s %s: %s", kind, key, existingValue))
+		case existingValue != desiredValue:
+			changes = append(changes, fmt.Sprintf("~ %s %s: %s -> %s", kind, key, existingValue, desiredValue))
+		}
+	}
+	return changes
+}
+
+func sortedDataKeys(dataMaps ...map[string][]byte) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, dataMap := range dataMaps {
+		for key := range dataMap {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func sortedRawMessageKeys(rawMessageMaps ...map[string]json.RawMessage) []string {
+	seen := map[string]bool{}
+	var keys []string
+	for _, rawMessageMap := range rawMessageMaps {
+		for key := range rawMessageMap {
+			if !seen[key] {
+				seen[key] = true
+				keys = append(keys, key)
+			}
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+const dockerHubHost = "docker.io"
+
+// dockerHubHostAliases are the hosts docker hub is known by, e.g.: docker asks credential helpers for
+// https://index.docker.io/v1/
+var dockerHubHostAliases = []string{"index.docker.io", "registry-1.docker.io"}
+
+// NormalizeRegistryUri strips the scheme, trailing slashes and the docker hub v1 path from a registry URI,
+// so that URIs given by users, docker and registries compare equal (e.g.: https://host/v1/ -> host)
+func NormalizeRegistryUri(registryUri string) string {
+	registryUri = strings.TrimSpace(registryUri)
+	if strings.Contains(registryUri, "://") {
+		if parsedUri, err := url.Parse(registryUri); err == nil {
+			registryUri = parsedUri.Host + parsedUri.Path
+		}
+	}
+	registryUri = strings.TrimSuffix(registryUri, "/")
+	for _, apiVersionPath := range []string{"/v1", "/v2"} {
+		registryUri = strings.TrimSuffix(registryUri, apiVersionPath)
+	}
+	registryUri = strings.ToLower(registryUri)
+
+	host, registryPath := splitRegistryUri(registryUri)
+	for _, dockerHubHostAlias := range dockerHubHostAliases {
+		if host == dockerHubHostAlias {
+			return strings.TrimSuffix(dockerHubHost+"/"+registryPath, "/")
+		}
+	}
+	return registryUri
+}
+
+// GetImageRegistryHost returns the registry host of an image reference, docker.io for images without one
+func GetImageRegistryHost(image string) string {
+	firstComponent := strings.SplitN(image, "/", 2)[0]
+
+	// as docker does, the first component is a host if it looks like one
+	if !strings.Contains(image, "/") || !isHost(firstComponent) {
+		return dockerHubHost
+	}
+	return strings.ToLower(firstComponent)
+}
+
+// MatchRegistryUri returns whether an image, or a registry URI, is served by a registry URI pattern.
+// Patterns may use globs within host labels (e.g.: *.dkr.ecr.*.amazonaws.com) and may have a path prefix,
+// in which case the image repository must be under it
+func MatchRegistryUri(pattern string, image string) bool {
+	pattern = NormalizeRegistryUri(pattern)
+	image = strings.ToLower(strings.TrimSpace(image))
+
+	// server URLs (e.g.: https://host/v2/ or a bare host) are matched as registry URIs
+	if strings.Contains(image, "://") || (!strings.Contains(image, "/") && isHost(image)) {
+		image = NormalizeRegistryUri(image)
+	}
+
+	patternHost, patternPath := splitRegistryUri(pattern)
+	imageHost, imagePath := splitRegistryUri(image)
+	if !isHost(imageHost) {
+		imageHost, imagePath = dockerHubHost, image
+	}
+
+	if !matchHost(patternHost, imageHost) {
+		return false
+	}
+
+	return patternPath == "" || imagePath == patternPath || strings.HasPrefix(imagePath, patternPath+"/")
+}
+
+// isHost returns whether an image reference component is a registry host
+func isHost(component string) bool {
+	return strings.ContainsAny(component, ".:") || component == "localhost"
+}
+
+func splitRegistryUri(registryUri string) (string, string) {
+	hostAndPath := strings.SplitN(registryUri, "/", 2)
+	if len(hostAndPath) == 1 {
+		return hostAndPath[0], ""
+	}
+	return hostAndPath[0], strings.TrimSuffix(hostAndPath[1], "/")
+}
+
+// matchHost matches host labels one by one, as kubelet does for credential provider matchImages
+func matchHost(patternHost string, host string) bool {
+	patternHostname, patternPort := splitPort(patternHost)
+	hostname, port := splitPort(host)
+	if patternPort != port {
+		return false
+	}
+
+	patternLabels := strings.Split(patternHostname, ".")
+	labels := strings.Split(hostname, ".")
+	if len(patternLabels) != len(labels) {
+		return false
+	}
+
+	for index := range patternLabels {
+		if matched, err := path.Match(patternLabels[index], labels[index]); err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+func splitPort(host string) (string, string) {
+	if index := strings.LastIndex(host, ":"); index != -1 {
+		return host[:index], host[index+1:]
+	}
+	return host, ""
+}
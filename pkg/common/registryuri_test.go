@@ -0,0 +1,96 @@
+package common
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistryUriSuite struct {
+	suite.Suite
+}
+
+func (suite *RegistryUriSuite) TestMatchRegistryUri() {
+	tests := []struct {
+		name          string
+		pattern       string
+		image         string
+		expectedMatch bool
+	}{
+		{
+			name:          "serverURL",
+			pattern:       "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			image:         "https://123456789012.dkr.ecr.us-east-1.amazonaws.com/v2/",
+			expectedMatch: true,
+		},
+		{
+			name:          "image",
+			pattern:       "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			image:         "123456789012.dkr.ecr.us-east-1.amazonaws.com/app:latest",
+			expectedMatch: true,
+		},
+		{
+			name:          "glob",
+			pattern:       "*.dkr.ecr.*.amazonaws.com",
+			image:         "123456789012.dkr.ecr.eu-west-1.amazonaws.com/app",
+			expectedMatch: true,
+		},
+		{
+			name:          "globLabelCount",
+			pattern:       "*.amazonaws.com",
+			image:         "123456789012.dkr.ecr.eu-west-1.amazonaws.com/app",
+			expectedMatch: false,
+		},
+		{
+			name:          "pathPrefix",
+			pattern:       "registry.example.com/team",
+			image:         "registry.example.com/team/app:1.0",
+			expectedMatch: true,
+		},
+		{
+			name:          "otherPath",
+			pattern:       "registry.example.com/team",
+			image:         "registry.example.com/teams/app:1.0",
+			expectedMatch: false,
+		},
+		{
+			name:          "port",
+			pattern:       "localhost:5000",
+			image:         "localhost:5000/app",
+			expectedMatch: true,
+		},
+		{
+			name:          "otherPort",
+			pattern:       "localhost:5000",
+			image:         "localhost:5001/app",
+			expectedMatch: false,
+		},
+		{
+			name:          "dockerHub",
+			pattern:       "https://index.docker.io/v1/",
+			image:         "library/nginx",
+			expectedMatch: true,
+		},
+		{
+			name:          "dockerHubServerURL",
+			pattern:       "docker.io",
+			image:         "https://index.docker.io/v1/",
+			expectedMatch: true,
+		},
+		{
+			name:          "notDockerHub",
+			pattern:       "registry.example.com",
+			image:         "nginx",
+			expectedMatch: false,
+		},
+	}
+	for _, test := range tests {
+		suite.Run(test.name, func() {
+			suite.Require().Equal(test.expectedMatch, MatchRegistryUri(test.pattern, test.image))
+		})
+	}
+}
+
+func TestRegistryUri(t *testing.T) {
+	suite.Run(t, new(RegistryUriSuite))
+}
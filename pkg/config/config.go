@@ -0,0 +1,467 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+	"github.com/v3io/registry-creds-handler/pkg/verifier"
+	"github.com/v3io/registry-creds-handler/pkg/webhook"
+
+	"github.com/nuclio/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	DefaultRefreshRate         int64 = 60
+	DefaultNamespace                 = "default"
+	DefaultNearExpiryThreshold int64 = 30
+	DefaultMaxPodsPerMinute    int64 = 10
+	DefaultRotationGracePeriod int64 = 60
+	DefaultInstance                  = "default"
+)
+
+// Config describes the registries to authenticate against and the secrets to publish their credentials to.
+// Targets are optional, as commands serving credentials directly (e.g.: get-token) only need registries
+type Config struct {
+
+	// Instance identifies this installation of the handler, its secrets are labeled with it so that cleanup only
+	// finds its own among those of other installations in the cluster (default: default)
+	Instance string `json:"instance,omitempty"`
+
+	Registries    []Registry     `json:"registries"`
+	Targets       []Target       `json:"targets"`
+	Notifications *Notifications `json:"notifications,omitempty"`
+	Remediation   *Remediation   `json:"remediation,omitempty"`
+}
+
+// Remediation restarts controller owned pods that failed pulling images with expired credentials once their
+// secret is refreshed, in namespaces opted in with the registry-creds-handler.v3io.io/remediate-image-pulls label
+type Remediation struct {
+
+	// MaxPodsPerMinute is how many pods may be restarted per minute (default: 10)
+	MaxPodsPerMinute int64 `json:"maxPodsPerMinute,omitempty"`
+}
+
+// Notifications describe where refresh failures and near expiry alerts are sent to
+type Notifications struct {
+
+	// NearExpiryThreshold is how long, in minutes, before the last good credentials of a registry
+	// expire that a failing refresh also alerts about their expiry (default: 30)
+	NearExpiryThreshold int64 `json:"nearExpiryThreshold,omitempty"`
+
+	// Webhooks are chat-style incoming webhooks (e.g.: Slack) alerts are posted to
+	Webhooks []webhook.Options `json:"webhooks,omitempty"`
+}
+
+// Registry is a registry whose authorization token is refreshed on its own schedule
+type Registry struct {
+
+	// Name identifies the registry within the config, targets refer to registries by name
+	Name string `json:"name"`
+
+	// Kind is the registry kind to authenticate against (e.g.: ecr)
+	Kind string `json:"kind"`
+
+	// RegistryUri is the registry URI to use for authentication, optional for ecr registries whose URI is
+	// discovered from their authorization tokens
+	RegistryUri string `json:"registryUri,omitempty"`
+
+	// RegistryUris are additional hostnames to publish the same credentials under
+	RegistryUris []string `json:"registryUris,omitempty"`
+
+	// Creds are the kind specific credentials, entries must be in lowerCamelCase
+	Creds json.RawMessage `json:"creds,omitempty"`
+
+	// RefreshRate is the credentials refresh rate in minutes
+	RefreshRate int64 `json:"refreshRate,omitempty"`
+
+	// Verify logs in to the registry's /v2/ endpoint with every new token, and optionally fetches a test manifest,
+	// before publishing it. A token failing verification is discarded, keeping the last good one in place
+	Verify *verifier.Options `json:"verify,omitempty"`
+}
+
+// Target is a pull secret, or another sink kind, compiled from the tokens of one or more registries
+type Target struct {
+
+	// Kind is the sink kind the credentials are published to (kubernetes, file or a kind registered by an
+	// embedder, default: file when Path is set, kubernetes otherwise)
+	Kind string `json:"kind,omitempty"`
+
+	// Options are the kind specific options (e.g.: of vault, or of kinds registered by embedders),
+	// entries must be in lowerCamelCase
+	Options json.RawMessage `json:"options,omitempty"`
+
+	// SecretName is the secret name, may be a go template using {{ .Namespace }}, {{ .Registry }},
+	// {{ .Registries }} and {{ .Kinds }}
+	SecretName string `json:"secretName"`
+	Namespace  string `json:"namespace,omitempty"`
+
+	// Labels and Annotations are added to the secret, values may be templates as SecretName is
+	Labels      map[string]string `json:"labels,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+
+	// Registries are the names of the registries whose tokens are compiled into the secret,
+	// when empty all registries are compiled
+	Registries []string `json:"registries,omitempty"`
+
+	// Merge merges the registry credentials into an existing secret, keeping entries of other registries.
+	// Only supported by the dockerconfigjson format
+	Merge bool `json:"merge,omitempty"`
+
+	// Format is the secret format tokens are rendered as
+	// (dockerconfigjson, dockercfg, basic-auth, containers-auth or template, default: dockerconfigjson)
+	Format common.SecretFormat `json:"format,omitempty"`
+
+	// Template is a go template rendering the secret value, used by the template format
+	Template string `json:"template,omitempty"`
+
+	// TemplateKey is the secret data key the template is rendered to (default: config)
+	TemplateKey string `json:"templateKey,omitempty"`
+
+	// Rotation writes every token to a new immutable version of the secret rather than updating it in place
+	Rotation *Rotation `json:"rotation,omitempty"`
+
+	// Path is a host file (e.g.: /var/lib/kubelet/config.json) to write the credentials to instead of a secret,
+	// for nodes whose kubelet can not use credential provider plugins. Only supported by the dockerconfigjson
+	// and containers-auth formats, Merge keeps the entries of others in the file
+	Path string `json:"path,omitempty"`
+
+	// FileMode is the octal mode the file is written with (default: 0600)
+	FileMode string `json:"fileMode,omitempty"`
+
+	// Hook is run whenever the file is rewritten, e.g.: to signal a build tool running next to the handler
+	Hook *common.FileHook `json:"hook,omitempty"`
+
+	// Instance is the config instance, filled in from it
+	Instance string `json:"-"`
+
+	// RegistryNames and RegistryKinds are the names and kinds of the registries compiled into the secret,
+	// filled in from the config so that templates render the same whichever registries currently hold tokens
+	RegistryNames []string `json:"-"`
+	RegistryKinds []string `json:"-"`
+}
+
+// Rotation describes how immutable secret versions are rolled over. Service accounts referring to a previous
+// version are moved to the latest one, while previous versions are kept for a grace period, e.g.: for pods
+// still pulling with them or to roll back to
+type Rotation struct {
+
+	// GracePeriod is how long, in minutes, a superseded version is kept before it is deleted (default: 60)
+	GracePeriod int64 `json:"gracePeriod,omitempty"`
+
+	// ServiceAccounts are the names of service accounts the latest version is added to the imagePullSecrets of,
+	// along with the ones already referring to a previous version
+	ServiceAccounts []string `json:"serviceAccounts,omitempty"`
+}
+
+// Load reads a config file, in either YAML or JSON format
+func Load(path string) (*Config, error) {
+	encodedConfig, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to read config file: %s", path)
+	}
+
+	config := &Config{}
+	if err := yaml.UnmarshalStrict(encodedConfig, config); err != nil {
+		return nil, errors.Wrapf(err, "Failed to parse config file: %s", path)
+	}
+
+	if err := config.EnrichAndValidate(); err != nil {
+		return nil, errors.Wrap(err, "Failed to enrich and validate config")
+	}
+
+	return config, nil
+}
+
+// EnrichAndValidate fills in defaults and makes sure targets refer to known registries
+func (c *Config) EnrichAndValidate() error {
+	if len(c.Registries) == 0 {
+		return errors.New("At least one registry is required")
+	}
+
+	if c.Instance == "" {
+		c.Instance = DefaultInstance
+	}
+	if errorMessages := validation.IsValidLabelValue(c.Instance); len(errorMessages) > 0 {
+		return errors.Errorf("Instance %s is not a valid label value: %s",
+			c.Instance,
+			strings.Join(errorMessages, ", "))
+	}
+
+	registryNames := map[string]bool{}
+	for index := range c.Registries {
+		configRegistry := &c.Registries[index]
+		if configRegistry.Name == "" {
+			configRegistry.Name = configRegistry.Kind
+		}
+		if configRegistry.Name == "" {
+			return errors.Errorf("Registry #%d must have a name or a kind", index)
+		}
+		if registryNames[configRegistry.Name] {
+			return errors.Errorf("Registry name must be unique: %s", configRegistry.Name)
+		}
+		if configRegistry.RefreshRate <= 0 {
+			configRegistry.RefreshRate = DefaultRefreshRate
+		}
+		registryNames[configRegistry.Name] = true
+	}
+
+	if c.Notifications != nil {
+		if c.Notifications.NearExpiryThreshold <= 0 {
+			c.Notifications.NearExpiryThreshold = DefaultNearExpiryThreshold
+		}
+		for index, notificationWebhook := range c.Notifications.Webhooks {
+			if notificationWebhook.URL == "" {
+				return errors.Errorf("Notification webhook #%d URL must not be empty", index)
+			}
+		}
+	}
+
+	if c.Remediation != nil && c.Remediation.MaxPodsPerMinute <= 0 {
+		c.Remediation.MaxPodsPerMinute = DefaultMaxPodsPerMinute
+	}
+
+	for index := range c.Targets {
+		target := &c.Targets[index]
+		target.Instance = c.Instance
+		target.RegistryNames, target.RegistryKinds = nil, nil
+		for _, configRegistry := range c.Registries {
+			if !target.IncludesRegistry(configRegistry.Name) {
+				continue
+			}
+			target.RegistryNames = append(target.RegistryNames, configRegistry.Name)
+			target.RegistryKinds = appendUnique(target.RegistryKinds, configRegistry.Kind)
+		}
+		target.Kind = target.GetKind()
+		if target.Kind != sink.KubernetesSinkKind {
+			if target.Rotation != nil {
+				return errors.Errorf("Target #%d rotation is only supported by %s targets", index, sink.KubernetesSinkKind)
+			}
+			if target.Kind == sink.FileSinkKind {
+				if err := target.enrichAndValidateFile(); err != nil {
+					return errors.Wrapf(err, "Target #%d is invalid", index)
+				}
+			}
+			if err := validateTargetRegistries(target, registryNames); err != nil {
+				return errors.Wrap(err, "Failed to validate target registries")
+			}
+			continue
+		}
+		if target.SecretName == "" {
+			return errors.Errorf("Target #%d secret name must not be empty", index)
+		}
+		if target.Namespace == "" {
+			target.Namespace = DefaultNamespace
+		}
+		if err := target.validateMetadataTemplates(); err != nil {
+			return errors.Wrapf(err, "Target %s metadata is invalid", target.SecretName)
+		}
+		if _, err := common.RenderSecretName(target.SecretName, target.GetMetadataTemplateData()); err != nil {
+			return errors.Wrapf(err, "Target %s secret name is invalid", target.SecretName)
+		}
+		if err := target.enrichAndValidateFormat(); err != nil {
+			return errors.Wrapf(err, "Target %s format is invalid", target.SecretName)
+		}
+		if target.Rotation != nil {
+			if target.Merge {
+				return errors.Errorf("Target %s can not both merge and rotate", target.SecretName)
+			}
+			if target.Rotation.GracePeriod <= 0 {
+				target.Rotation.GracePeriod = DefaultRotationGracePeriod
+			}
+		}
+		if err := validateTargetRegistries(target, registryNames); err != nil {
+			return errors.Wrap(err, "Failed to validate target registries")
+		}
+		if target.Format == common.SecretFormatBasicAuth &&
+			len(target.Registries) != 1 &&
+			!(len(target.Registries) == 0 && len(c.Registries) == 1) {
+			return errors.Errorf("Target %s format %s requires exactly one registry",
+				target.SecretName,
+				common.SecretFormatBasicAuth)
+		}
+	}
+
+	return nil
+}
+
+// GetCreds returns the registry credentials as expected by the registry factory
+func (r *Registry) GetCreds() string {
+	if len(r.Creds) == 0 || string(r.Creds) == "null" {
+		return ""
+	}
+
+	// creds may be given either as an object or as a JSON encoded string
+	var encodedCreds string
+	if err := json.Unmarshal(r.Creds, &encodedCreds); err == nil {
+		return encodedCreds
+	}
+	return string(r.Creds)
+}
+
+// RequiresCluster returns whether any of the targets is a secret, other kinds are written without a cluster
+func (c *Config) RequiresCluster() bool {
+	for index := range c.Targets {
+		if c.Targets[index].GetKind() == sink.KubernetesSinkKind {
+			return true
+		}
+	}
+	return false
+}
+
+// GetKind returns the target sink kind, defaulting by whether a path is set
+func (t *Target) GetKind() string {
+	switch {
+	case t.Kind != "":
+		return t.Kind
+	case t.Path != "":
+		return sink.FileSinkKind
+	default:
+		return sink.KubernetesSinkKind
+	}
+}
+
+// String describes the target in messages
+func (t *Target) String() string {
+	switch t.GetKind() {
+	case sink.KubernetesSinkKind:
+		return fmt.Sprintf("secret %s/%s", t.Namespace, t.SecretName)
+	case sink.FileSinkKind:
+		return fmt.Sprintf("file %s", t.Path)
+	default:
+		return fmt.Sprintf("%s sink", t.Kind)
+	}
+}
+
+// GetFileMode returns the mode the target file is written with
+func (t *Target) GetFileMode() os.FileMode {
+	fileMode, err := strconv.ParseUint(t.FileMode, 8, 32)
+	if err != nil {
+		return common.DefaultFileMode
+	}
+	return os.FileMode(fileMode)
+}
+
+// GetMetadataTemplateData returns what the secret name, label and annotation templates are executed with
+func (t *Target) GetMetadataTemplateData() *common.SecretMetadataTemplateData {
+	return &common.SecretMetadataTemplateData{
+		Namespace:  t.Namespace,
+		Registry:   strings.Join(t.RegistryNames, "-"),
+		Registries: t.RegistryNames,
+		Kinds:      t.RegistryKinds,
+	}
+}
+
+// IncludesRegistry returns whether the tokens of the given registry are compiled into the target
+func (t *Target) IncludesRegistry(registryName string) bool {
+	if len(t.Registries) == 0 {
+		return true
+	}
+	for _, targetRegistryName := range t.Registries {
+		if targetRegistryName == registryName {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Target) enrichAndValidateFormat() error {
+	if t.Format == "" {
+		t.Format = common.SecretFormatDockerConfigJSON
+	}
+
+	supported := false
+	for _, format := range common.GetSecretFormats() {
+		supported = supported || format == t.Format
+	}
+	if !supported {
+		return errors.Errorf("Unsupported secret format: %s", t.Format)
+	}
+
+	if t.Merge && t.Format != common.SecretFormatDockerConfigJSON {
+		return errors.Errorf("Merge is only supported by the %s format", common.SecretFormatDockerConfigJSON)
+	}
+
+	if t.Format == common.SecretFormatTemplate {
+		if t.Template == "" {
+			return errors.New("Template must not be empty")
+		}
+		if _, err := common.ParseSecretTemplate(t.Template); err != nil {
+			return errors.Wrap(err, "Failed to parse template")
+		}
+		if t.TemplateKey == "" {
+			t.TemplateKey = common.DefaultTemplateKey
+		}
+	}
+
+	return nil
+}
+
+func (t *Target) enrichAndValidateFile() error {
+	if t.Path == "" {
+		return errors.New("Path must not be empty")
+	}
+	if t.Format == "" {
+		t.Format = common.SecretFormatDockerConfigJSON
+	}
+	if t.Format != common.SecretFormatDockerConfigJSON && t.Format != common.SecretFormatContainersAuth {
+		return errors.Errorf("Files are only supported by the %s and %s formats",
+			common.SecretFormatDockerConfigJSON,
+			common.SecretFormatContainersAuth)
+	}
+
+	if t.FileMode != "" {
+		if fileMode, err := strconv.ParseUint(t.FileMode, 8, 32); err != nil || fileMode > 0777 {
+			return errors.Errorf("File mode must be an octal permission (e.g.: 0600): %s", t.FileMode)
+		}
+	}
+
+	if t.Hook != nil {
+		if err := t.Hook.Validate(); err != nil {
+			return errors.Wrap(err, "Hook is invalid")
+		}
+	}
+
+	return nil
+}
+
+func validateTargetRegistries(target *Target, registryNames map[string]bool) error {
+	for _, registryName := range target.Registries {
+		if !registryNames[registryName] {
+			return errors.Errorf("Target %s refers to an unknown registry: %s", target, registryName)
+		}
+	}
+	return nil
+}
+
+func (t *Target) validateMetadataTemplates() error {
+	metadataTemplates := []string{t.SecretName}
+	for _, metadata := range []map[string]string{t.Labels, t.Annotations} {
+		for _, metadataTemplate := range metadata {
+			metadataTemplates = append(metadataTemplates, metadataTemplate)
+		}
+	}
+
+	for _, metadataTemplate := range metadataTemplates {
+		if _, err := common.ParseSecretMetadataTemplate(metadataTemplate); err != nil {
+			return errors.Wrapf(err, "Failed to parse template: %s", metadataTemplate)
+		}
+	}
+
+	return nil
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, existingValue := range values {
+		if existingValue == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
@@ -0,0 +1,117 @@
+package credentialhelper
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/registrycredshandler"
+
+	"github.com/nuclio/errors"
+)
+
+const (
+	// tokenExpirationMargin is how long before expiring a cached token is no longer served
+	tokenExpirationMargin = 5 * time.Minute
+
+	cacheDirMode  = 0700
+	cacheFileMode = 0600
+)
+
+// TokenCache keeps tokens on disk between credential helper invocations, as docker runs a helper
+// process per pull and registries rate limit token requests
+type TokenCache struct {
+	dir string
+	now func() time.Time
+}
+
+// NewTokenCache creates a cache in dir, caching is disabled when dir is empty
+func NewTokenCache(dir string) *TokenCache {
+	return &TokenCache{
+		dir: dir,
+		now: time.Now,
+	}
+}
+
+// GetDefaultTokenCacheDir returns the user cache dir of the handler, empty if the user has none
+func GetDefaultTokenCacheDir() string {
+	userCacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(userCacheDir, "registry-creds-handler")
+}
+
+// Get returns the cached token of a source for a server, nil if there is none or it is about to expire
+func (tc *TokenCache) Get(source *registrycredshandler.Source, serverURL string) *registry.Token {
+	if tc == nil || tc.dir == "" {
+		return nil
+	}
+
+	encodedToken, err := os.ReadFile(tc.getPath(source, serverURL))
+	if err != nil {
+		return nil
+	}
+
+	token := &registry.Token{}
+	if err := json.Unmarshal(encodedToken, token); err != nil {
+		return nil
+	}
+
+	if token.ExpiresAt.IsZero() || !tc.now().Add(tokenExpirationMargin).Before(token.ExpiresAt) {
+		return nil
+	}
+	return token
+}
+
+// Set caches the token of a source for a server, tokens without an expiration are not cached
+func (tc *TokenCache) Set(source *registrycredshandler.Source, serverURL string, token *registry.Token) error {
+	if tc == nil || tc.dir == "" || token.ExpiresAt.IsZero() {
+		return nil
+	}
+
+	if err := os.MkdirAll(tc.dir, cacheDirMode); err != nil {
+		return errors.Wrap(err, "Failed to create cache dir")
+	}
+
+	encodedToken, err := json.Marshal(token)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode token")
+	}
+
+	// write and rename, so that concurrent helpers never read a partial token
+	cacheFile, err := os.CreateTemp(tc.dir, ".token-*")
+	if err != nil {
+		return errors.Wrap(err, "Failed to create cache file")
+	}
+	defer os.Remove(cacheFile.Name())
+
+	if _, err := cacheFile.Write(encodedToken); err != nil {
+		cacheFile.Close()
+		return errors.Wrap(err, "Failed to write cache file")
+	}
+	if err := cacheFile.Close(); err != nil {
+		return errors.Wrap(err, "Failed to close cache file")
+	}
+	if err := os.Chmod(cacheFile.Name(), cacheFileMode); err != nil {
+		return errors.Wrap(err, "Failed to set cache file mode")
+	}
+
+	if err := os.Rename(cacheFile.Name(), tc.getPath(source, serverURL)); err != nil {
+		return errors.Wrap(err, "Failed to rename cache file")
+	}
+	return nil
+}
+
+// getPath returns the cache file of a source for a server, keyed by the source name and the server so that
+// configs sharing a source name do not share tokens, and sources issuing a token per registry (e.g.: ecr
+// registries of several regions) cache each
+func (tc *TokenCache) getPath(source *registrycredshandler.Source, serverURL string) string {
+	key := sha256.Sum256([]byte(source.Name + "\x00" + common.NormalizeRegistryUri(serverURL)))
+	return filepath.Join(tc.dir, hex.EncodeToString(key[:])+".json")
+}
@@ -0,0 +1,150 @@
+package credentialhelper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/registrycredshandler"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+)
+
+const (
+	GetAction   = "get"
+	ListAction  = "list"
+	StoreAction = "store"
+	EraseAction = "erase"
+
+	// BinaryPrefix is the prefix docker expects credential helper binaries to be named with
+	BinaryPrefix = "docker-credential-"
+
+	// credentialsNotFoundMessage is the message docker expects when a helper has no credentials for a server
+	credentialsNotFoundMessage = "credentials not found in native keychain"
+)
+
+var ErrCredentialsNotFound = errors.New(credentialsNotFoundMessage)
+
+// Helper implements the docker credential helper protocol on top of the handler registries,
+// so that build machines authenticate through ~/.docker/config.json credHelpers
+type Helper struct {
+	logger  logger.Logger
+	handler *registrycredshandler.Handler
+	cache   *TokenCache
+}
+
+func NewHelper(parentLogger logger.Logger, handler *registrycredshandler.Handler, cache *TokenCache) (*Helper, error) {
+	return &Helper{
+		logger:  parentLogger.GetChild("credential-helper"),
+		handler: handler,
+		cache:   cache,
+	}, nil
+}
+
+// Run runs a credential helper action, reading its input from in and writing its reply to out
+func (h *Helper) Run(ctx context.Context, action string, in io.Reader, out io.Writer) error {
+	switch action {
+	case GetAction:
+		serverURL, err := io.ReadAll(in)
+		if err != nil {
+			return errors.Wrap(err, "Failed to read server URL")
+		}
+
+		credentials, err := h.Get(ctx, strings.TrimSpace(string(serverURL)))
+		if err != nil {
+
+			// docker looks for this message on stdout
+			if errors.RootCause(err) == ErrCredentialsNotFound {
+				fmt.Fprintln(out, credentialsNotFoundMessage)
+			}
+			return errors.Wrap(err, "Failed to get credentials")
+		}
+		return json.NewEncoder(out).Encode(credentials)
+
+	case ListAction:
+		return json.NewEncoder(out).Encode(h.List())
+
+	// credentials are issued by the registries, there is nothing to store or erase
+	case StoreAction, EraseAction:
+		if _, err := io.Copy(io.Discard, in); err != nil {
+			return errors.Wrap(err, "Failed to read input")
+		}
+		return nil
+
+	default:
+		return errors.Errorf("Unknown credential helper action: %s", action)
+	}
+}
+
+// Get returns the credentials for a server URL, served from the cache until they expire
+func (h *Helper) Get(ctx context.Context, serverURL string) (*common.CredentialHelperCredentials, error) {
+	source, _ := h.handler.FindSource(serverURL)
+	discovered := false
+
+	// sources without configured registry URIs are only known to serve the server once their token was
+	// fetched, by a previous invocation if it was cached
+	if source == nil {
+		for _, discoverableSource := range h.handler.GetDiscoverableSources() {
+			if token := h.cache.Get(discoverableSource, serverURL); token != nil {
+				return common.CompileCredentialHelperCredentials(token, serverURL)
+			}
+		}
+
+		var err error
+		if source, _, err = h.handler.DiscoverSource(ctx, serverURL); err != nil {
+			return nil, errors.Wrap(err, "Failed to discover registry")
+		}
+		discovered = true
+	}
+	if source == nil {
+		return nil, ErrCredentialsNotFound
+	}
+
+	token := h.cache.Get(source, serverURL)
+	if token == nil {
+		h.logger.DebugWithCtx(ctx, "Getting token", "source", source.Name, "serverURL", serverURL)
+
+		// discovered sources were just refreshed
+		if discovered {
+			token, _ = h.handler.GetLastImageToken(source.Name, serverURL)
+		}
+		if token == nil {
+			var err error
+			if token, _, err = h.handler.GetImageToken(ctx, source.Name, serverURL); err != nil {
+				return nil, errors.Wrapf(err, "Failed to get token from registry: %s", source.Name)
+			}
+		}
+		if err := h.cache.Set(source, serverURL, token); err != nil {
+			h.logger.WarnWithCtx(ctx, "Failed to cache token", "source", source.Name, "err", err.Error())
+		}
+	}
+
+	return common.CompileCredentialHelperCredentials(token, serverURL)
+}
+
+// List returns the configured registry URIs, along with their username where known from the cache
+func (h *Helper) List() map[string]string {
+	registryUris := map[string]string{}
+	for _, source := range h.handler.GetSources() {
+		for _, registryUri := range append([]string{source.RegistryUri}, source.RegistryUris...) {
+			if registryUri == "" {
+				continue
+			}
+			username := ""
+			if token := h.cache.Get(source, registryUri); token != nil {
+				username, _, _ = token.GetUsernamePassword()
+			}
+			registryUris[registryUri] = username
+		}
+	}
+	return registryUris
+}
+
+// IsCredentialHelperBinary returns whether the binary was invoked as a docker credential helper
+func IsCredentialHelperBinary(binaryName string) bool {
+	return strings.HasPrefix(binaryName, BinaryPrefix)
+}
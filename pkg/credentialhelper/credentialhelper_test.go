@@ -0,0 +1,122 @@
+package credentialhelper
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/registry/mock"
+	"github.com/v3io/registry-creds-handler/pkg/registrycredshandler"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type HelperSuite struct {
+	suite.Suite
+	mockedRegistry *mock.Registry
+	helper         *Helper
+}
+
+func (suite *HelperSuite) SetupTest() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stderr, "humanreadable")
+	suite.mockedRegistry, _ = mock.NewRegistry(loggerInstance, "", "", "", "ecr.mock.com")
+	source := &registrycredshandler.Source{
+		Name:        "mock",
+		Registry:    suite.mockedRegistry,
+		RegistryUri: "ecr.mock.com",
+	}
+	handler, err := registrycredshandler.NewHandler(loggerInstance, nil, []*registrycredshandler.Source{source}, nil)
+	suite.Require().NoError(err)
+
+	suite.helper, err = NewHelper(loggerInstance, handler, NewTokenCache(suite.T().TempDir()))
+	suite.Require().NoError(err)
+}
+
+func (suite *HelperSuite) TestGetCachesTokens() {
+	suite.mockedRegistry.On("GetAuthToken").Return(&registry.Token{
+
+		// AWS:password
+		Auth:        "QVdTOnBhc3N3b3Jk",
+		RegistryUri: "ecr.mock.com",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}, nil).Once()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		output := &bytes.Buffer{}
+		err := suite.helper.Run(context.Background(), GetAction, strings.NewReader("https://ecr.mock.com\n"), output)
+		suite.Require().NoError(err)
+		suite.Require().JSONEq(`{"ServerURL":"https://ecr.mock.com","Username":"AWS","Secret":"password"}`,
+			output.String())
+	}
+
+	// the second get is served from the cache
+	suite.mockedRegistry.AssertNumberOfCalls(suite.T(), "GetAuthToken", 1)
+}
+
+func (suite *HelperSuite) TestGetExpiringTokenIsRefreshed() {
+	suite.mockedRegistry.On("GetAuthToken").Return(&registry.Token{
+		Auth:        "QVdTOnBhc3N3b3Jk",
+		RegistryUri: "ecr.mock.com",
+		ExpiresAt:   time.Now().Add(time.Minute),
+	}, nil)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		_, err := suite.helper.Get(context.Background(), "ecr.mock.com")
+		suite.Require().NoError(err)
+	}
+
+	suite.mockedRegistry.AssertNumberOfCalls(suite.T(), "GetAuthToken", 2)
+}
+
+func (suite *HelperSuite) TestGetUnknownServer() {
+	output := &bytes.Buffer{}
+	err := suite.helper.Run(context.Background(), GetAction, strings.NewReader("other.mock.com"), output)
+	suite.Require().Error(err)
+	suite.Require().Equal(credentialsNotFoundMessage+"\n", output.String())
+	suite.mockedRegistry.AssertNotCalled(suite.T(), "GetAuthToken")
+}
+
+func (suite *HelperSuite) TestGetDiscoversRegistryWithoutUri() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stderr, "humanreadable")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "")
+	mockedRegistry.On("GetAuthToken").Return(&registry.Token{
+		Auth:        "QVdTOnBhc3N3b3Jk",
+		RegistryUri: "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+		ExpiresAt:   time.Now().Add(time.Hour),
+	}, nil)
+	cacheDir := suite.T().TempDir()
+
+	// every invocation is a fresh process, with no token fetched yet
+	for attempt := 0; attempt < 2; attempt++ {
+		handler, err := registrycredshandler.NewHandler(loggerInstance,
+			nil,
+			[]*registrycredshandler.Source{{Name: "prod", Registry: mockedRegistry}},
+			nil)
+		suite.Require().NoError(err)
+		helper, err := NewHelper(loggerInstance, handler, NewTokenCache(cacheDir))
+		suite.Require().NoError(err)
+
+		credentials, err := helper.Get(context.Background(), "123456789012.dkr.ecr.us-east-1.amazonaws.com")
+		suite.Require().NoError(err)
+		suite.Require().Equal("password", credentials.Secret)
+	}
+
+	// the second invocation is served from the cache
+	mockedRegistry.AssertNumberOfCalls(suite.T(), "GetAuthToken", 1)
+}
+
+func (suite *HelperSuite) TestList() {
+	output := &bytes.Buffer{}
+	err := suite.helper.Run(context.Background(), ListAction, strings.NewReader(""), output)
+	suite.Require().NoError(err)
+	suite.Require().JSONEq(`{"ecr.mock.com":""}`, output.String())
+}
+
+func TestHelper(t *testing.T) {
+	suite.Run(t, new(HelperSuite))
+}
@@ -0,0 +1,141 @@
+package credentialprovider
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/registrycredshandler"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// cacheDurationMargin is how long before a token expires kubelet stops using it
+const cacheDurationMargin = 5 * time.Minute
+
+// Provider implements the kubelet credential provider plugin protocol on top of the handler registries,
+// so that nodes pull images without pull secrets
+type Provider struct {
+	logger  logger.Logger
+	handler *registrycredshandler.Handler
+	now     func() time.Time
+}
+
+func NewProvider(parentLogger logger.Logger, handler *registrycredshandler.Handler) (*Provider, error) {
+	return &Provider{
+		logger:  parentLogger.GetChild("credential-provider"),
+		handler: handler,
+		now:     time.Now,
+	}, nil
+}
+
+// Run reads a credential provider request from in and writes the response to out
+func (p *Provider) Run(ctx context.Context, in io.Reader, out io.Writer) error {
+	request := &CredentialProviderRequest{}
+	if err := json.NewDecoder(in).Decode(request); err != nil {
+		return errors.Wrap(err, "Failed to decode request")
+	}
+
+	response, err := p.Provide(ctx, request)
+	if err != nil {
+		return errors.Wrap(err, "Failed to provide credentials")
+	}
+
+	return json.NewEncoder(out).Encode(response)
+}
+
+// Provide returns the credentials for the request image, an empty response if no registry serves it
+// so that kubelet goes on with other providers and pull secrets
+func (p *Provider) Provide(ctx context.Context,
+	request *CredentialProviderRequest) (*CredentialProviderResponse, error) {
+
+	if request.Kind != RequestKind {
+		return nil, errors.Errorf("Unsupported request kind: %s", request.Kind)
+	}
+	if !isSupportedAPIVersion(request.APIVersion) {
+		return nil, errors.Errorf("Unsupported API version: %s", request.APIVersion)
+	}
+	if request.Image == "" {
+		return nil, errors.New("Image must not be empty")
+	}
+
+	response := &CredentialProviderResponse{
+		TypeMeta: metav1.TypeMeta{
+			Kind:       ResponseKind,
+			APIVersion: request.APIVersion,
+		},
+		CacheKeyType: RegistryPluginCacheKeyType,
+	}
+
+	source, registryUri := p.handler.FindSource(request.Image)
+	discovered := false
+	if source == nil {
+		var err error
+		if source, registryUri, err = p.handler.DiscoverSource(ctx, request.Image); err != nil {
+			return nil, errors.Wrap(err, "Failed to discover registry")
+		}
+		discovered = true
+	}
+	if source == nil {
+		p.logger.DebugWithCtx(ctx, "No registry serves image", "image", request.Image)
+		return response, nil
+	}
+
+	// sources issuing a token per registry (e.g.: ecr registries of several regions) are keyed by the
+	// registry of the token serving the image. Discovered sources were just refreshed
+	var token *registry.Token
+	var tokenRegistryUri string
+	if discovered {
+		token, tokenRegistryUri = p.handler.GetLastImageToken(source.Name, request.Image)
+	}
+	if token == nil {
+		var err error
+		if token, tokenRegistryUri, err = p.handler.GetImageToken(ctx, source.Name, request.Image); err != nil {
+			return nil, errors.Wrapf(err, "Failed to get token from registry: %s", source.Name)
+		}
+	}
+	if tokenRegistryUri != "" {
+		registryUri = tokenRegistryUri
+	}
+
+	username, password, err := token.GetUsernamePassword()
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get username and password")
+	}
+
+	// kubelet matches the auth keys against images the same way we matched the image
+	response.Auth = map[string]AuthConfig{
+		common.NormalizeRegistryUri(registryUri): {
+			Username: username,
+			Password: password,
+		},
+	}
+
+	if !token.ExpiresAt.IsZero() {
+		cacheDuration := token.ExpiresAt.Sub(p.now()) - cacheDurationMargin
+		if cacheDuration < 0 {
+			cacheDuration = 0
+		}
+		response.CacheDuration = &metav1.Duration{Duration: cacheDuration}
+	}
+
+	p.logger.DebugWithCtx(ctx, "Provided credentials",
+		"image", request.Image,
+		"source", source.Name,
+		"registryUri", registryUri)
+	return response, nil
+}
+
+func isSupportedAPIVersion(apiVersion string) bool {
+	for _, supportedAPIVersion := range supportedAPIVersions {
+		if apiVersion == supportedAPIVersion {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,139 @@
+package credentialprovider
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/registry/mock"
+	"github.com/v3io/registry-creds-handler/pkg/registrycredshandler"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ProviderSuite struct {
+	suite.Suite
+	mockedRegistry *mock.Registry
+	provider       *Provider
+	now            time.Time
+}
+
+func (suite *ProviderSuite) SetupTest() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stderr, "humanreadable")
+	suite.mockedRegistry, _ = mock.NewRegistry(loggerInstance, "", "", "", "ecr.mock.com")
+	source := &registrycredshandler.Source{
+		Name:         "mock",
+		Registry:     suite.mockedRegistry,
+		RegistryUri:  "ecr.mock.com",
+		RegistryUris: []string{"*.ecr-mirror.mock.com"},
+	}
+	handler, err := registrycredshandler.NewHandler(loggerInstance, nil, []*registrycredshandler.Source{source}, nil)
+	suite.Require().NoError(err)
+
+	suite.provider, err = NewProvider(loggerInstance, handler)
+	suite.Require().NoError(err)
+	suite.now = time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)
+	suite.provider.now = func() time.Time { return suite.now }
+}
+
+func (suite *ProviderSuite) TestProvide() {
+	suite.mockedRegistry.On("GetAuthToken").Return(&registry.Token{
+
+		// AWS:password
+		Auth:        "QVdTOnBhc3N3b3Jk",
+		RegistryUri: "ecr.mock.com",
+		ExpiresAt:   suite.now.Add(12 * time.Hour),
+	}, nil)
+
+	for _, test := range []struct {
+		name             string
+		image            string
+		expectedResponse string
+	}{
+		{
+			name:  "registryUri",
+			image: "ecr.mock.com/app:latest",
+			expectedResponse: `{
+				"kind": "CredentialProviderResponse",
+				"apiVersion": "credentialprovider.kubelet.k8s.io/v1",
+				"cacheKeyType": "Registry",
+				"cacheDuration": "11h55m0s",
+				"auth": {"ecr.mock.com": {"username": "AWS", "password": "password"}}
+			}`,
+		},
+		{
+			name:  "glob",
+			image: "us.ecr-mirror.mock.com/app:latest",
+			expectedResponse: `{
+				"kind": "CredentialProviderResponse",
+				"apiVersion": "credentialprovider.kubelet.k8s.io/v1",
+				"cacheKeyType": "Registry",
+				"cacheDuration": "11h55m0s",
+				"auth": {"*.ecr-mirror.mock.com": {"username": "AWS", "password": "password"}}
+			}`,
+		},
+		{
+			name:  "unknownRegistry",
+			image: "docker.io/library/nginx",
+			expectedResponse: `{
+				"kind": "CredentialProviderResponse",
+				"apiVersion": "credentialprovider.kubelet.k8s.io/v1",
+				"cacheKeyType": "Registry"
+			}`,
+		},
+	} {
+		suite.Run(test.name, func() {
+			request := `{"kind":"CredentialProviderRequest","apiVersion":"credentialprovider.kubelet.k8s.io/v1","image":"` +
+				test.image + `"}`
+			output := &bytes.Buffer{}
+			err := suite.provider.Run(context.Background(), strings.NewReader(request), output)
+			suite.Require().NoError(err)
+			suite.Require().JSONEq(test.expectedResponse, output.String())
+		})
+	}
+}
+
+func (suite *ProviderSuite) TestProvideDiscoversRegistryWithoutUri() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stderr, "humanreadable")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "")
+	mockedRegistry.On("GetAuthToken").Return(&registry.Token{
+		Auth:        "QVdTOnBhc3N3b3Jk",
+		RegistryUri: "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+		ExpiresAt:   suite.now.Add(12 * time.Hour),
+	}, nil)
+	handler, err := registrycredshandler.NewHandler(loggerInstance,
+		nil,
+		[]*registrycredshandler.Source{{Name: "prod", Registry: mockedRegistry}},
+		nil)
+	suite.Require().NoError(err)
+	suite.provider.handler = handler
+
+	request := `{"kind":"CredentialProviderRequest","apiVersion":"credentialprovider.kubelet.k8s.io/v1",` +
+		`"image":"123456789012.dkr.ecr.us-east-1.amazonaws.com/app:latest"}`
+	output := &bytes.Buffer{}
+	suite.Require().NoError(suite.provider.Run(context.Background(), strings.NewReader(request), output))
+	suite.Require().JSONEq(`{
+		"kind": "CredentialProviderResponse",
+		"apiVersion": "credentialprovider.kubelet.k8s.io/v1",
+		"cacheKeyType": "Registry",
+		"cacheDuration": "11h55m0s",
+		"auth": {"123456789012.dkr.ecr.us-east-1.amazonaws.com": {"username": "AWS", "password": "password"}}
+	}`, output.String())
+	mockedRegistry.AssertNumberOfCalls(suite.T(), "GetAuthToken", 1)
+}
+
+func (suite *ProviderSuite) TestProvideUnsupportedAPIVersion() {
+	request := `{"kind":"CredentialProviderRequest","apiVersion":"credentialprovider.kubelet.k8s.io/v2","image":"ecr.mock.com/app"}`
+	err := suite.provider.Run(context.Background(), strings.NewReader(request), &bytes.Buffer{})
+	suite.Require().Error(err)
+	suite.mockedRegistry.AssertNotCalled(suite.T(), "GetAuthToken")
+}
+
+func TestProvider(t *testing.T) {
+	suite.Run(t, new(ProviderSuite))
+}
@@ -0,0 +1,56 @@
+package credentialprovider
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// the kubelet credential provider API (credentialprovider.kubelet.k8s.io), as defined by k8s.io/kubelet.
+// replies are given in the API version of the request
+const (
+	APIGroup = "credentialprovider.kubelet.k8s.io"
+
+	RequestKind  = "CredentialProviderRequest"
+	ResponseKind = "CredentialProviderResponse"
+)
+
+var supportedAPIVersions = []string{
+	APIGroup + "/v1",
+	APIGroup + "/v1beta1",
+	APIGroup + "/v1alpha1",
+}
+
+type PluginCacheKeyType string
+
+const (
+	ImagePluginCacheKeyType    PluginCacheKeyType = "Image"
+	RegistryPluginCacheKeyType PluginCacheKeyType = "Registry"
+	GlobalPluginCacheKeyType   PluginCacheKeyType = "Global"
+)
+
+// CredentialProviderRequest is what kubelet sends the plugin on stdin, per image pull
+type CredentialProviderRequest struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// Image is the container image being pulled
+	Image string `json:"image"`
+}
+
+// CredentialProviderResponse is what the plugin replies with on stdout
+type CredentialProviderResponse struct {
+	metav1.TypeMeta `json:",inline"`
+
+	// CacheKeyType is the granularity kubelet caches the credentials in
+	CacheKeyType PluginCacheKeyType `json:"cacheKeyType"`
+
+	// CacheDuration is how long kubelet caches the credentials, kubelet uses its configured
+	// default when it is not set
+	CacheDuration *metav1.Duration `json:"cacheDuration,omitempty"`
+
+	// Auth is the credentials by the image patterns they are valid for
+	Auth map[string]AuthConfig `json:"auth,omitempty"`
+}
+
+type AuthConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
@@ -0,0 +1,221 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/registrycredshandler"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+	"github.com/v3io/registry-creds-handler/pkg/verifier"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	loginCheck  = "registry login"
+	accessCheck = "secrets access"
+)
+
+// secretVerbs are the verbs the handler uses on the secrets of target namespaces
+var secretVerbs = []string{"get", "create", "update", "patch"}
+
+// Result is the outcome of a check of a subject (e.g.: a registry or a namespace)
+type Result struct {
+	Subject string
+	*registry.Diagnosis
+}
+
+// Doctor runs the checks of the whole credentials path, from the config to logging in to the registries,
+// recording the outcome of each along with how to fix it
+type Doctor struct {
+	logger  logger.Logger
+	results []*Result
+}
+
+func NewDoctor(parentLogger logger.Logger) (*Doctor, error) {
+	return &Doctor{
+		logger: parentLogger.GetChild("doctor"),
+	}, nil
+}
+
+// Record records the outcome of a check
+func (d *Doctor) Record(subject string, diagnosis *registry.Diagnosis) {
+	d.logger.DebugWith("Check done",
+		"subject", subject,
+		"check", diagnosis.Check,
+		"status", diagnosis.Status)
+	d.results = append(d.results, &Result{Subject: subject, Diagnosis: diagnosis})
+}
+
+// CheckRegistries runs the registry kind specific checks of every registry, then logs in to it with a token
+func (d *Doctor) CheckRegistries(ctx context.Context, handler *registrycredshandler.Handler) {
+	for _, source := range handler.GetSources() {
+		subject := fmt.Sprintf("registry %s", source.Name)
+
+		if diagnoser, ok := source.Registry.(registry.Diagnoser); ok {
+			for _, diagnosis := range diagnoser.Diagnose(ctx) {
+				d.Record(subject, diagnosis)
+			}
+		}
+
+		d.Record(subject, d.diagnoseLogin(ctx, handler, source))
+	}
+}
+
+// CheckAccess checks, with SelfSubjectAccessReviews, that secrets may be written in every target namespace
+func (d *Doctor) CheckAccess(ctx context.Context, kubeClientSet kubernetes.Interface, targets []*config.Target) {
+	namespaces := map[string]bool{}
+	for _, target := range targets {
+		if target.GetKind() == sink.KubernetesSinkKind {
+			namespaces[target.Namespace] = true
+		}
+	}
+
+	var sortedNamespaces []string
+	for namespace := range namespaces {
+		sortedNamespaces = append(sortedNamespaces, namespace)
+	}
+	sort.Strings(sortedNamespaces)
+
+	for _, namespace := range sortedNamespaces {
+		d.Record(fmt.Sprintf("namespace %s", namespace), diagnoseSecretsAccess(ctx, kubeClientSet, namespace))
+	}
+}
+
+// Failed returns whether any of the checks failed
+func (d *Doctor) Failed() bool {
+	for _, result := range d.results {
+		if result.Status == registry.DiagnosisStatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// Results returns the outcome of the checks, in the order they ran
+func (d *Doctor) Results() []*Result {
+	return d.results
+}
+
+// Format formats the outcome of the checks for humans, along with the fixes of the ones that did not pass
+func (d *Doctor) Format() string {
+	var formattedResults strings.Builder
+	for _, result := range d.results {
+		fmt.Fprintf(&formattedResults, "%-5s %s: %s: %s\n",
+			strings.ToUpper(string(result.Status)),
+			result.Subject,
+			result.Check,
+			result.Message)
+		if result.Fix != "" && result.Status != registry.DiagnosisStatusPass {
+			fmt.Fprintf(&formattedResults, "      fix: %s\n", result.Fix)
+		}
+	}
+	return formattedResults.String()
+}
+
+// diagnoseLogin gets the tokens of the registry, and logs in to the registry's /v2/ endpoint with each
+func (d *Doctor) diagnoseLogin(ctx context.Context,
+	handler *registrycredshandler.Handler,
+	source *registrycredshandler.Source) *registry.Diagnosis {
+
+	// tokens of registries configured to verify them are verified when they are fetched
+	tokens, err := handler.GetTokens(ctx, source.Name)
+	if err != nil {
+		return &registry.Diagnosis{
+			Check:   loginCheck,
+			Status:  registry.DiagnosisStatusFail,
+			Message: fmt.Sprintf("Failed to get a token: %s", errors.RootCause(err).Error()),
+			Fix:     "Fix the registry credentials, see the checks above",
+		}
+	}
+
+	if source.Verifier == nil {
+		tokenVerifier, err := verifier.NewVerifier(d.logger, verifier.Options{})
+		if err != nil {
+			return &registry.Diagnosis{
+				Check:   loginCheck,
+				Status:  registry.DiagnosisStatusFail,
+				Message: fmt.Sprintf("Failed to create verifier: %s", errors.RootCause(err).Error()),
+			}
+		}
+		for _, token := range tokens {
+			if err := tokenVerifier.Verify(ctx, token); err != nil {
+				return &registry.Diagnosis{
+					Check:  loginCheck,
+					Status: registry.DiagnosisStatusFail,
+					Message: fmt.Sprintf("Failed to log in to %s: %s",
+						token.RegistryUri,
+						errors.RootCause(err).Error()),
+					Fix: "Check the registry URI is the one the credentials are issued for, " +
+						"and that the handler can reach it",
+				}
+			}
+		}
+	}
+
+	var registryUris []string
+	for _, token := range tokens {
+		registryUris = append(registryUris, token.GetRegistryUris()...)
+	}
+	return &registry.Diagnosis{
+		Check:   loginCheck,
+		Status:  registry.DiagnosisStatusPass,
+		Message: fmt.Sprintf("Logged in to %s", strings.Join(registryUris, ", ")),
+	}
+}
+
+func diagnoseSecretsAccess(ctx context.Context,
+	kubeClientSet kubernetes.Interface,
+	namespace string) *registry.Diagnosis {
+
+	var deniedVerbs []string
+	for _, verb := range secretVerbs {
+		review, err := kubeClientSet.AuthorizationV1().SelfSubjectAccessReviews().Create(ctx,
+			&authorizationv1.SelfSubjectAccessReview{
+				Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+					ResourceAttributes: &authorizationv1.ResourceAttributes{
+						Namespace: namespace,
+						Verb:      verb,
+						Resource:  "secrets",
+					},
+				},
+			},
+			metav1.CreateOptions{})
+		if err != nil {
+			return &registry.Diagnosis{
+				Check:   accessCheck,
+				Status:  registry.DiagnosisStatusFail,
+				Message: fmt.Sprintf("Failed to review access: %s", err.Error()),
+				Fix:     "Check the handler can reach the Kubernetes API (--kubeconfig-path, or run in the cluster)",
+			}
+		}
+		if !review.Status.Allowed {
+			deniedVerbs = append(deniedVerbs, verb)
+		}
+	}
+
+	if len(deniedVerbs) > 0 {
+		return &registry.Diagnosis{
+			Check:   accessCheck,
+			Status:  registry.DiagnosisStatusFail,
+			Message: fmt.Sprintf("Not allowed to %s secrets", strings.Join(deniedVerbs, ", ")),
+			Fix: fmt.Sprintf("Bind the handler service account to a role allowing %s on secrets in namespace %s",
+				strings.Join(secretVerbs, ", "),
+				namespace),
+		}
+	}
+
+	return &registry.Diagnosis{
+		Check:   accessCheck,
+		Status:  registry.DiagnosisStatusPass,
+		Message: fmt.Sprintf("Allowed to %s secrets", strings.Join(secretVerbs, ", ")),
+	}
+}
@@ -0,0 +1,147 @@
+package doctor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/registry/mock"
+	"github.com/v3io/registry-creds-handler/pkg/registrycredshandler"
+	"github.com/v3io/registry-creds-handler/pkg/verifier"
+
+	"github.com/nuclio/logger"
+	"github.com/stretchr/testify/suite"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// diagnosingRegistry is a mocked registry that diagnoses itself
+type diagnosingRegistry struct {
+	*mock.Registry
+	diagnoses []*registry.Diagnosis
+}
+
+func (r *diagnosingRegistry) Diagnose(ctx context.Context) []*registry.Diagnosis {
+	return r.diagnoses
+}
+
+type DoctorSuite struct {
+	suite.Suite
+	logger         logger.Logger
+	registryServer *httptest.Server
+	registryHost   string
+}
+
+func (suite *DoctorSuite) SetupTest() {
+	suite.logger, _ = common.CreateLogger("test", true, os.Stdout, "humanreadable")
+
+	// a registry accepting a single password
+	suite.registryServer = httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter,
+		request *http.Request) {
+		if username, password, _ := request.BasicAuth(); username != "AWS" || password != "good" {
+			responseWriter.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		responseWriter.WriteHeader(http.StatusOK)
+	}))
+	suite.registryHost = strings.TrimPrefix(suite.registryServer.URL, "http://")
+}
+
+func (suite *DoctorSuite) TearDownTest() {
+	suite.registryServer.Close()
+}
+
+func (suite *DoctorSuite) TestCheckRegistries() {
+	tokenVerifier, err := verifier.NewVerifier(suite.logger, verifier.Options{PlainHTTP: true})
+	suite.Require().NoError(err)
+
+	goodRegistry, _ := mock.NewRegistry(suite.logger, "", "", "", suite.registryHost)
+	goodRegistry.On("GetAuthToken").
+		Return(&registry.Token{Username: "AWS", Password: "good", RegistryUri: suite.registryHost}, nil)
+	badRegistry, _ := mock.NewRegistry(suite.logger, "", "", "", suite.registryHost)
+	badRegistry.On("GetAuthToken").
+		Return(&registry.Token{Username: "AWS", Password: "bad", RegistryUri: suite.registryHost}, nil)
+
+	handler, err := registrycredshandler.NewHandler(suite.logger, nil, []*registrycredshandler.Source{
+		{
+			Name: "good",
+			Registry: &diagnosingRegistry{
+				Registry: goodRegistry,
+				diagnoses: []*registry.Diagnosis{
+					{Check: "identity", Status: registry.DiagnosisStatusPass, Message: "Authenticated"},
+					{Check: "account", Status: registry.DiagnosisStatusWarn, Message: "Other account", Fix: "Allow it"},
+				},
+			},
+			Verifier: tokenVerifier,
+		},
+		{Name: "bad", Registry: badRegistry, Verifier: tokenVerifier},
+	}, nil)
+	suite.Require().NoError(err)
+
+	handlerDoctor, err := NewDoctor(suite.logger)
+	suite.Require().NoError(err)
+	handlerDoctor.CheckRegistries(context.Background(), handler)
+
+	suite.Require().True(handlerDoctor.Failed())
+	suite.Require().Equal([]string{
+		"registry good identity pass",
+		"registry good account warn",
+		"registry good registry login pass",
+		"registry bad registry login fail",
+	}, suite.summarize(handlerDoctor.Results()))
+
+	formattedResults := handlerDoctor.Format()
+	suite.Require().Contains(formattedResults, "WARN  registry good: account: Other account\n      fix: Allow it\n")
+	suite.Require().Contains(formattedResults, "FAIL  registry bad: registry login: Failed to get a token: "+
+		"Registry rejected the credentials (401 Unauthorized)\n")
+}
+
+func (suite *DoctorSuite) TestCheckAccess() {
+	kubeClientSet := fake.NewSimpleClientset()
+
+	// secrets may only be read in the locked namespace
+	kubeClientSet.PrependReactor("create",
+		"selfsubjectaccessreviews",
+		func(action k8stesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+			attributes := review.Spec.ResourceAttributes
+			review.Status.Allowed = attributes.Namespace != "locked" || attributes.Verb == "get"
+			return true, review, nil
+		})
+
+	handlerDoctor, err := NewDoctor(suite.logger)
+	suite.Require().NoError(err)
+	handlerDoctor.CheckAccess(context.Background(), kubeClientSet, []*config.Target{
+		{Kind: "kubernetes", SecretName: "pull", Namespace: "team"},
+		{Kind: "kubernetes", SecretName: "other-pull", Namespace: "team"},
+		{Kind: "kubernetes", SecretName: "pull", Namespace: "locked"},
+		{Kind: "file", Path: "/var/lib/kubelet/config.json"},
+	})
+
+	suite.Require().True(handlerDoctor.Failed())
+	suite.Require().Equal([]string{
+		"namespace locked secrets access fail",
+		"namespace team secrets access pass",
+	}, suite.summarize(handlerDoctor.Results()))
+	suite.Require().Equal("Not allowed to create, update, patch secrets", handlerDoctor.Results()[0].Message)
+}
+
+func (suite *DoctorSuite) summarize(results []*Result) []string {
+	var summaries []string
+	for _, result := range results {
+		summaries = append(summaries, strings.Join([]string{result.Subject, result.Check, string(result.Status)}, " "))
+	}
+	return summaries
+}
+
+func TestDoctorSuite(t *testing.T) {
+	suite.Run(t, new(DoctorSuite))
+}
@@ -0,0 +1,29 @@
+package notifier
+
+import (
+	"context"
+	"time"
+)
+
+type AlertKind string
+
+const (
+	RefreshFailureAlertKind AlertKind = "refresh-failure"
+	NearExpiryAlertKind     AlertKind = "near-expiry"
+)
+
+// Alert is something operators should know about a registry credentials
+type Alert struct {
+	Kind     AlertKind
+	Registry string
+	Message  string
+
+	// ExpiresAt is when the last good credentials of the registry expire, zero if unknown
+	ExpiresAt time.Time
+}
+
+type Notifier interface {
+
+	// Notify sends an alert
+	Notify(ctx context.Context, alert *Alert) error
+}
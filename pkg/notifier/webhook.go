@@ -0,0 +1,42 @@
+package notifier
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/v3io/registry-creds-handler/pkg/webhook"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+)
+
+// chatMessage is understood by chat-style incoming webhooks (e.g.: Slack, Mattermost, Rocket.Chat)
+type chatMessage struct {
+	Text string `json:"text"`
+}
+
+// WebhookNotifier sends alerts to a chat-style incoming webhook
+type WebhookNotifier struct {
+	client *webhook.Client
+}
+
+func NewWebhookNotifier(parentLogger logger.Logger, options webhook.Options) (*WebhookNotifier, error) {
+	client, err := webhook.NewClient(parentLogger.GetChild("notifier"), options)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create webhook client")
+	}
+
+	return &WebhookNotifier{
+		client: client,
+	}, nil
+}
+
+// Notify posts the alert as a chat message
+func (wn *WebhookNotifier) Notify(ctx context.Context, alert *Alert) error {
+	if err := wn.client.Post(ctx, &chatMessage{
+		Text: fmt.Sprintf("registry-creds-handler %s (%s): %s", alert.Kind, alert.Registry, alert.Message),
+	}); err != nil {
+		return errors.Wrap(err, "Failed to post alert")
+	}
+	return nil
+}
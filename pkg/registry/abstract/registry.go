@@ -1,6 +1,8 @@
 package abstract
 
 import (
+	"context"
+
 	"github.com/v3io/registry-creds-handler/pkg/registry"
 
 	"github.com/nuclio/errors"
@@ -33,16 +35,33 @@ func NewRegistry(loggerInstance logger.Logger,
 	return abstractRegistry, nil
 }
 
+// Validate validates the base registry parameters, the secret name is optional as the secrets
+// tokens are compiled into are described by the handler targets
 func (ar *Registry) Validate() error {
-	if ar.SecretName == "" {
-		return errors.New("Secret Name must not be empty")
-	}
 	if ar.RegistryUri == "" {
 		return errors.New("Registry URI must not be empty")
 	}
+	return ar.ValidateOptionalRegistryUri()
+}
+
+// ValidateOptionalRegistryUri validates the base registry parameters of kinds that discover the registry URI
+// when it is omitted (e.g.: ecr, from its authorization tokens)
+func (ar *Registry) ValidateOptionalRegistryUri() error {
 	if ar.Namespace == "" {
 		ar.Logger.DebugWith("Did not receive namespace, using `default`")
 		ar.Namespace = "default"
 	}
 	return nil
 }
+
+// GetAuthTokens gets the single authorization token of registries issuing one
+func (ar *Registry) GetAuthTokens(ctx context.Context) ([]*registry.Token, error) {
+	token, err := ar.registry.GetAuthToken(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get authorization token")
+	}
+	if token == nil {
+		return nil, errors.New("Registry issued no authorization token")
+	}
+	return []*registry.Token{token}, nil
+}
@@ -3,25 +3,41 @@ package ecr
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"os"
 	"strings"
+	"sync"
 
 	"github.com/v3io/registry-creds-handler/pkg/common"
 	"github.com/v3io/registry-creds-handler/pkg/registry"
 	"github.com/v3io/registry-creds-handler/pkg/registry/abstract"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/nuclio/errors"
 	"github.com/nuclio/logger"
 )
 
+const (
+	identityCheck    = "aws identity"
+	permissionCheck  = "ecr:GetAuthorizationToken permission"
+	registryUriCheck = "registry uri"
+)
+
 type Registry struct {
 	*abstract.Registry
-	awsCreds registry.AWSCreds
+	awsCreds     registry.AWSCreds
+	registryHost *RegistryHost
+
+	// scopes are the region and account combinations tokens are issued for
+	scopes []*scope
 }
 
 func NewRegistry(parentLogger logger.Logger,
@@ -67,25 +83,47 @@ func (r *Registry) enrich() error {
 		r.Logger.WarnWith("Failed to parse json AWS credentials, checking env", "err", err.Error())
 	}
 
-	awsCreds.Region = common.GetFirstNonEmptyString(
-		[]string{awsCreds.Region, strings.TrimSpace(os.Getenv("AWS_DEFAULT_REGION"))})
+	// the env region and role are defaults of the listed regions and accounts
+	if len(awsCreds.Regions) == 0 {
+		awsCreds.Region = common.GetFirstNonEmptyString(
+			[]string{awsCreds.Region, strings.TrimSpace(os.Getenv("AWS_DEFAULT_REGION"))})
+	}
 	awsCreds.AccessKeyID = common.GetFirstNonEmptyString(
 		[]string{awsCreds.AccessKeyID, strings.TrimSpace(os.Getenv("AWS_ACCESS_KEY_ID"))})
 	awsCreds.SecretAccessKey = common.GetFirstNonEmptyString(
 		[]string{awsCreds.SecretAccessKey, strings.TrimSpace(os.Getenv("AWS_SECRET_ACCESS_KEY"))})
-	awsCreds.AssumeRole = common.GetFirstNonEmptyString(
-		[]string{awsCreds.AssumeRole, strings.TrimSpace(os.Getenv("AWS_ROLE_ARN"))})
+	if len(awsCreds.Accounts) == 0 {
+		awsCreds.AssumeRole = common.GetFirstNonEmptyString(
+			[]string{awsCreds.AssumeRole, strings.TrimSpace(os.Getenv("AWS_ROLE_ARN"))})
+	}
 	r.awsCreds = awsCreds
 
+	// ECR registry URIs are normalized to their hostname, which is what docker looks credentials up by, and
+	// imply the region when it is omitted. Other URIs (e.g.: of a proxy in front of ECR) are kept as they are
+	if IsRegistryUri(r.RegistryUri) {
+		registryHost, err := ParseRegistryUri(r.RegistryUri)
+		if err != nil {
+			return errors.Wrap(err, "Failed to parse registry URI")
+		}
+		r.registryHost = registryHost
+		r.RegistryUri = registryHost.String()
+		if r.awsCreds.Region == "" && len(r.awsCreds.Regions) == 0 {
+			r.Logger.DebugWith("Using the registry URI region", "region", registryHost.Region)
+			r.awsCreds.Region = registryHost.Region
+		}
+	}
+
+	r.scopes = r.compileScopes()
+
 	return nil
 }
 
 func (r *Registry) validate() error {
-	if err := r.Registry.Validate(); err != nil {
+	if err := r.Registry.ValidateOptionalRegistryUri(); err != nil {
 		return errors.Wrap(err, "Failed to validate base parameters")
 	}
 
-	if r.awsCreds.Region == "" {
+	if r.awsCreds.Region == "" && len(r.awsCreds.Regions) == 0 {
 		return errors.New("AWS Region is required")
 	}
 
@@ -97,16 +135,71 @@ func (r *Registry) validate() error {
 		return errors.New("AWS Secret Access Key is required")
 	}
 
+	if err := r.validateScopeSettings(); err != nil {
+		return errors.Wrap(err, "Failed to validate regions and accounts")
+	}
+
+	for _, tokenScope := range r.scopes {
+		if err := r.validateScope(tokenScope); err != nil {
+			return errors.Wrap(err, "Failed to validate registry URI")
+		}
+	}
+
 	return nil
 }
 
+// GetAuthToken gets the authorization token of the first region and account
 func (r *Registry) GetAuthToken(ctx context.Context) (*registry.Token, error) {
-	ecrClient := r.createECRClient(ctx)
+	return r.getScopeAuthToken(ctx, r.scopes[0])
+}
+
+// GetAuthTokens gets an authorization token of every region and account in parallel. Failing to get any of them
+// fails, along with the tokens of the others so that they are published while the last good ones of the failed
+// regions and accounts are kept
+func (r *Registry) GetAuthTokens(ctx context.Context) ([]*registry.Token, error) {
+	tokens := make([]*registry.Token, len(r.scopes))
+	tokenErrors := make([]error, len(r.scopes))
+
+	tokensWaitGroup := sync.WaitGroup{}
+	for index, tokenScope := range r.scopes {
+		tokensWaitGroup.Add(1)
+		go func(index int, tokenScope *scope) {
+			defer tokensWaitGroup.Done()
+			tokens[index], tokenErrors[index] = r.getScopeAuthToken(ctx, tokenScope)
+		}(index, tokenScope)
+	}
+	tokensWaitGroup.Wait()
+
+	var issuedTokens []*registry.Token
+	var firstErr error
+	var failedScopes []string
+	for index, err := range tokenErrors {
+		if err != nil {
+			failedScopes = append(failedScopes, r.scopes[index].String())
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		issuedTokens = append(issuedTokens, tokens[index])
+	}
+	if firstErr != nil {
+		return issuedTokens, errors.Wrapf(firstErr,
+			"Failed to get authorization tokens of: %s",
+			strings.Join(failedScopes, ", "))
+	}
+
+	return tokens, nil
+}
+
+func (r *Registry) getScopeAuthToken(ctx context.Context, tokenScope *scope) (*registry.Token, error) {
+	ecrClient := r.createECRClient(ctx, tokenScope)
 
 	r.Logger.DebugWithCtx(ctx, "Getting authorization token",
 		"SecretName", r.SecretName,
-		"Namespace", r.Namespace)
-	resp, err := ecrClient.GetAuthorizationToken(&ecr.GetAuthorizationTokenInput{})
+		"Namespace", r.Namespace,
+		"Scope", tokenScope.String())
+	resp, err := ecrClient.GetAuthorizationTokenWithContext(ctx, &ecr.GetAuthorizationTokenInput{})
 
 	if err != nil {
 		r.Logger.WarnWithCtx(ctx, "Failed to get authorization token", "error", err.Error())
@@ -117,12 +210,12 @@ func (r *Registry) GetAuthToken(ctx context.Context) (*registry.Token, error) {
 	// AuthorizationData is a list as it used to return a token per registry, that is now deprecated.
 	// The returned token can be used to access any Amazon ECR registry that the IAM principal has access to.
 	for _, auth := range resp.AuthorizationData {
-		token := &registry.Token{
-			SecretName:  r.SecretName,
-			Namespace:   r.Namespace,
-			Auth:        *auth.AuthorizationToken,
-			RegistryUri: r.RegistryUri,
+		token, err := r.compileToken(ctx, ecrClient, auth, tokenScope.registryUri)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to compile token")
 		}
+		token.Scope = tokenScope.String()
+
 		r.Logger.InfoWithCtx(ctx, "Got authorization token", "ExpiresAt", auth.ExpiresAt)
 		return token, nil
 	}
@@ -130,21 +223,263 @@ func (r *Registry) GetAuthToken(ctx context.Context) (*registry.Token, error) {
 	return nil, errors.New("Failed to retrieve access token")
 }
 
-func (r *Registry) createECRClient(ctx context.Context) *ecr.ECR {
-	r.Logger.DebugWithCtx(ctx, "Creating ECR Client",
-		"region", r.awsCreds.Region,
-		"assumeRole", r.awsCreds.AssumeRole)
+// compileToken compiles a token of authorization data. Its proxy endpoint is the registry of the credentials
+// account and region, which is the registry URI when none is given
+func (r *Registry) compileToken(ctx context.Context,
+	ecrClient ecriface.ECRAPI,
+	auth *ecr.AuthorizationData,
+	registryUri string) (*registry.Token, error) {
+
+	proxyEndpoint := common.NormalizeRegistryUri(aws.StringValue(auth.ProxyEndpoint))
+	token := &registry.Token{
+		SecretName:  r.SecretName,
+		Namespace:   r.Namespace,
+		Auth:        aws.StringValue(auth.AuthorizationToken),
+		RegistryUri: common.GetFirstNonEmptyString([]string{registryUri, proxyEndpoint}),
+		ExpiresAt:   aws.TimeValue(auth.ExpiresAt),
+	}
+	if token.RegistryUri == "" {
+		return nil, errors.New("Authorization data has no proxy endpoint, a registry URI is required")
+	}
+
+	// the token decodes to AWS:<password>
+	var err error
+	if token.Username, token.Password, err = token.GetUsernamePassword(); err != nil {
+		return nil, errors.Wrap(err, "Failed to decode authorization token")
+	}
+
+	if r.awsCreds.DiscoverAliases && proxyEndpoint != "" {
+		token.RegistryUris = r.discoverAliases(ctx, ecrClient, proxyEndpoint)
+	}
+
+	return token, nil
+}
+
+// discoverAliases returns the pull through cache prefixes of the registry, and the registries it replicates to
+// in the same region. Registries replicated to in other regions are skipped, as ECR tokens are only valid in the
+// region they are issued in. Aliases are best effort, failing to discover them does not fail the token
+func (r *Registry) discoverAliases(ctx context.Context, ecrClient ecriface.ECRAPI, proxyEndpoint string) []string {
+	var aliases []string
+
+	if err := ecrClient.DescribePullThroughCacheRulesPagesWithContext(ctx,
+		&ecr.DescribePullThroughCacheRulesInput{},
+		func(output *ecr.DescribePullThroughCacheRulesOutput, lastPage bool) bool {
+			for _, rule := range output.PullThroughCacheRules {
+				aliases = append(aliases, fmt.Sprintf("%s/%s",
+					proxyEndpoint,
+					aws.StringValue(rule.EcrRepositoryPrefix)))
+			}
+			return true
+		}); err != nil {
+		r.Logger.WarnWithCtx(ctx, "Failed to describe pull through cache rules", "err", err.Error())
+	}
+
+	registryDescription, err := ecrClient.DescribeRegistryWithContext(ctx, &ecr.DescribeRegistryInput{})
+	if err != nil {
+		r.Logger.WarnWithCtx(ctx, "Failed to describe registry", "err", err.Error())
+		return aliases
+	}
+	if registryDescription.ReplicationConfiguration == nil {
+		return aliases
+	}
+
+	registryHost, err := ParseRegistryUri(proxyEndpoint)
+	if err != nil {
+		r.Logger.WarnWithCtx(ctx, "Failed to parse proxy endpoint, skipping replicated registries",
+			"proxyEndpoint", proxyEndpoint,
+			"err", errors.RootCause(err).Error())
+		return aliases
+	}
+
+	for _, rule := range registryDescription.ReplicationConfiguration.Rules {
+		for _, destination := range rule.Destinations {
+			replicatedRegistryHost := &RegistryHost{
+				Account: aws.StringValue(destination.RegistryId),
+				Region:  aws.StringValue(destination.Region),
+				FIPS:    registryHost.FIPS,
+				China:   registryHost.China,
+			}
+			if replicatedRegistryHost.Region != registryHost.Region {
+				r.Logger.DebugWithCtx(ctx, "Skipping registry replicated to another region",
+					"registry", replicatedRegistryHost.String())
+				continue
+			}
+			aliases = append(aliases, replicatedRegistryHost.String())
+		}
+	}
+
+	return aliases
+}
+
+// Diagnose checks, for every region and account, the AWS identity of the credentials, their
+// ecr:GetAuthorizationToken permission, and that the registry URI belongs to their region and account
+func (r *Registry) Diagnose(ctx context.Context) []*registry.Diagnosis {
+	var diagnoses []*registry.Diagnosis
+	for _, tokenScope := range r.scopes {
+		diagnoses = append(diagnoses, r.diagnoseScope(ctx, tokenScope)...)
+	}
+	return diagnoses
+}
+
+func (r *Registry) diagnoseScope(ctx context.Context, tokenScope *scope) []*registry.Diagnosis {
+	sessionInstance, clientConfig := r.createSession(ctx, tokenScope)
+
+	identity, err := sts.New(sessionInstance, clientConfig).GetCallerIdentityWithContext(ctx,
+		&sts.GetCallerIdentityInput{})
+	if err != nil {
+		fix := "Check the access key ID and secret access key (creds, or $AWS_ACCESS_KEY_ID and " +
+			"$AWS_SECRET_ACCESS_KEY) are valid and active"
+		if tokenScope.assumeRole != "" {
+			fix = fmt.Sprintf("Check the access keys are valid and active, and that role %s exists and trusts them",
+				tokenScope.assumeRole)
+		}
+		return []*registry.Diagnosis{
+			{
+				Check:   r.describeScope(identityCheck, tokenScope),
+				Status:  registry.DiagnosisStatusFail,
+				Message: fmt.Sprintf("Failed to get caller identity: %s", err.Error()),
+				Fix:     fix,
+			},
+			{
+				Check:   r.describeScope(permissionCheck, tokenScope),
+				Status:  registry.DiagnosisStatusSkip,
+				Message: "No AWS identity",
+			},
+			{
+				Check:   r.describeScope(registryUriCheck, tokenScope),
+				Status:  registry.DiagnosisStatusSkip,
+				Message: "No AWS identity",
+			},
+		}
+	}
+
+	identityArn := aws.StringValue(identity.Arn)
+	diagnoses := []*registry.Diagnosis{
+		{
+			Check:   r.describeScope(identityCheck, tokenScope),
+			Status:  registry.DiagnosisStatusPass,
+			Message: fmt.Sprintf("Authenticated as %s", identityArn),
+		},
+	}
+
+	if _, err := ecr.New(sessionInstance, clientConfig).GetAuthorizationTokenWithContext(ctx,
+		&ecr.GetAuthorizationTokenInput{}); err != nil {
+		fix := fmt.Sprintf("Check ECR is reachable in region %s", tokenScope.region)
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "AccessDeniedException" {
+			fix = fmt.Sprintf("Allow ecr:GetAuthorizationToken (on resource *) for %s", identityArn)
+		}
+		diagnoses = append(diagnoses, &registry.Diagnosis{
+			Check:   r.describeScope(permissionCheck, tokenScope),
+			Status:  registry.DiagnosisStatusFail,
+			Message: fmt.Sprintf("Failed to get authorization token: %s", err.Error()),
+			Fix:     fix,
+		})
+	} else {
+		diagnoses = append(diagnoses, &registry.Diagnosis{
+			Check:   r.describeScope(permissionCheck, tokenScope),
+			Status:  registry.DiagnosisStatusPass,
+			Message: "ecr:GetAuthorizationToken is allowed",
+		})
+	}
+
+	registryUriDiagnosis := r.diagnoseRegistryUri(tokenScope, aws.StringValue(identity.Account))
+	registryUriDiagnosis.Check = r.describeScope(registryUriDiagnosis.Check, tokenScope)
+	return append(diagnoses, registryUriDiagnosis)
+}
+
+// diagnoseRegistryUri checks the registry URI is of the credentials region, and of their account. Other
+// accounts' registries may be pulled from if their repository policies allow it, so those are only warned about
+func (r *Registry) diagnoseRegistryUri(tokenScope *scope, account string) *registry.Diagnosis {
+	if tokenScope.registryUri == "" {
+		return &registry.Diagnosis{
+			Check:   registryUriCheck,
+			Status:  registry.DiagnosisStatusPass,
+			Message: "Registry URI is discovered from the authorization token proxy endpoint",
+		}
+	}
+
+	if !IsRegistryUri(tokenScope.registryUri) {
+		return &registry.Diagnosis{
+			Check:   registryUriCheck,
+			Status:  registry.DiagnosisStatusWarn,
+			Message: fmt.Sprintf("Registry URI %s is not an ECR hostname, assuming it is a proxy to ECR", tokenScope.registryUri),
+			Fix:     fmt.Sprintf("Set the registry URI to %s.dkr.ecr.%s.amazonaws.com", account, tokenScope.region),
+		}
+	}
+
+	registryHost, err := ParseRegistryUri(tokenScope.registryUri)
+	if err != nil {
+		return &registry.Diagnosis{
+			Check:   registryUriCheck,
+			Status:  registry.DiagnosisStatusFail,
+			Message: err.Error(),
+			Fix:     fmt.Sprintf("Set the registry URI to %s.dkr.ecr.%s.amazonaws.com", account, tokenScope.region),
+		}
+	}
+
+	if registryHost.Region != tokenScope.region {
+		return &registry.Diagnosis{
+			Check:  registryUriCheck,
+			Status: registry.DiagnosisStatusFail,
+			Message: fmt.Sprintf("Registry URI region %s does not match the credentials region %s",
+				registryHost.Region,
+				tokenScope.region),
+			Fix: fmt.Sprintf("Set the region to %s, ECR tokens are only valid in the region they are issued in",
+				registryHost.Region),
+		}
+	}
+
+	if registryHost.Account != account {
+		return &registry.Diagnosis{
+			Check:  registryUriCheck,
+			Status: registry.DiagnosisStatusWarn,
+			Message: fmt.Sprintf("Registry URI account %s differs from the credentials account %s",
+				registryHost.Account,
+				account),
+			Fix: fmt.Sprintf("Make sure the repository policies of account %s allow account %s to pull",
+				registryHost.Account,
+				account),
+		}
+	}
+
+	return &registry.Diagnosis{
+		Check:  registryUriCheck,
+		Status: registry.DiagnosisStatusPass,
+		Message: fmt.Sprintf("Registry URI matches account %s and region %s",
+			registryHost.Account,
+			registryHost.Region),
+	}
+}
+
+func (r *Registry) createECRClient(ctx context.Context, tokenScope *scope) *ecr.ECR {
+	sessionInstance, clientConfig := r.createSession(ctx, tokenScope)
+	return ecr.New(sessionInstance, clientConfig)
+}
+
+// createSession creates an AWS session of the static credentials in the scope region, along with the client
+// config assuming the scope role when there is one
+func (r *Registry) createSession(ctx context.Context, tokenScope *scope) (*session.Session, *aws.Config) {
+	r.Logger.DebugWithCtx(ctx, "Creating AWS session",
+		"region", tokenScope.region,
+		"assumeRole", tokenScope.assumeRole)
 
-	sessionInstance := session.Must(session.NewSession(&aws.Config{
-		Region: aws.String(r.awsCreds.Region),
+	sessionConfig := &aws.Config{
+		Region: aws.String(tokenScope.region),
 		Credentials: credentials.NewStaticCredentials(r.awsCreds.AccessKeyID,
 			r.awsCreds.SecretAccessKey,
-			"")}))
+			""),
+	}
+
+	// FIPS registries are served tokens by the FIPS endpoints
+	if tokenScope.registryHost != nil && tokenScope.registryHost.FIPS {
+		sessionConfig.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	sessionInstance := session.Must(session.NewSession(sessionConfig))
 
-	if r.awsCreds.AssumeRole != "" {
-		creds := stscreds.NewCredentials(sessionInstance, r.awsCreds.AssumeRole)
-		return ecr.New(sessionInstance, &aws.Config{Credentials: creds})
+	if tokenScope.assumeRole != "" {
+		creds := stscreds.NewCredentials(sessionInstance, tokenScope.assumeRole)
+		return sessionInstance, &aws.Config{Credentials: creds}
 	}
 
-	return ecr.New(sessionInstance)
+	return sessionInstance, &aws.Config{}
 }
@@ -1,19 +1,56 @@
 package ecr
 
 import (
+	"context"
+	"encoding/base64"
 	"os"
 	"testing"
 
 	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
 	"github.com/v3io/registry-creds-handler/pkg/registry/abstract"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ecr"
+	"github.com/aws/aws-sdk-go/service/ecr/ecriface"
+	"github.com/nuclio/errors"
 	"github.com/stretchr/testify/suite"
 )
 
+// fakeECRClient describes a registry, the rest of the ECR API is not implemented
+type fakeECRClient struct {
+	ecriface.ECRAPI
+	pullThroughCacheRules    []*ecr.PullThroughCacheRule
+	replicationConfiguration *ecr.ReplicationConfiguration
+}
+
+func (c *fakeECRClient) DescribePullThroughCacheRulesPagesWithContext(ctx aws.Context,
+	input *ecr.DescribePullThroughCacheRulesInput,
+	fn func(*ecr.DescribePullThroughCacheRulesOutput, bool) bool,
+	opts ...request.Option) error {
+	fn(&ecr.DescribePullThroughCacheRulesOutput{PullThroughCacheRules: c.pullThroughCacheRules}, true)
+	return nil
+}
+
+func (c *fakeECRClient) DescribeRegistryWithContext(ctx aws.Context,
+	input *ecr.DescribeRegistryInput,
+	opts ...request.Option) (*ecr.DescribeRegistryOutput, error) {
+	return &ecr.DescribeRegistryOutput{ReplicationConfiguration: c.replicationConfiguration}, nil
+}
+
 type ECRSuite struct {
 	suite.Suite
 }
 
+func (suite *ECRSuite) SetupTest() {
+
+	// tests setting the AWS env must not leak it to others
+	for _, envName := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_ROLE_ARN", "AWS_DEFAULT_REGION"} {
+		suite.Require().NoError(os.Unsetenv(envName))
+	}
+}
+
 func (suite *ECRSuite) TestEnrichAndValidateECRParams() {
 	loggerInstance, err := common.CreateLogger("test", true, os.Stdout, "humanreadable")
 	suite.Require().NoError(err)
@@ -132,6 +169,179 @@ func (suite *ECRSuite) TestEnrichAndValidateECRParams() {
 	}
 }
 
+func (suite *ECRSuite) TestEnrichAndValidateRegistryUri() {
+	loggerInstance, err := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	suite.Require().NoError(err)
+
+	for _, testCase := range []struct {
+		name                string
+		creds               string
+		registryUri         string
+		expectedRegistryUri string
+		expectedRegion      string
+		expectedError       string
+	}{
+		{
+			name:                "deriveRegion",
+			creds:               `{"accessKeyID": "id", "secretAccessKey": "key"}`,
+			registryUri:         "https://123456789012.dkr.ecr.eu-west-1.amazonaws.com/team/app",
+			expectedRegistryUri: "123456789012.dkr.ecr.eu-west-1.amazonaws.com",
+			expectedRegion:      "eu-west-1",
+		},
+		{
+			name:                "matchingRole",
+			creds:               `{"region": "us-east-1", "accessKeyID": "id", "secretAccessKey": "key", "assumeRole": "arn:aws:iam::123456789012:role/puller"}`,
+			registryUri:         "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			expectedRegistryUri: "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			expectedRegion:      "us-east-1",
+		},
+		{
+			name:           "discovered",
+			creds:          `{"region": "us-east-1", "accessKeyID": "id", "secretAccessKey": "key"}`,
+			expectedRegion: "us-east-1",
+		},
+		{
+			name:                "proxy",
+			creds:               `{"region": "us-east-1", "accessKeyID": "id", "secretAccessKey": "key"}`,
+			registryUri:         "ecr-proxy.example.com/team",
+			expectedRegistryUri: "ecr-proxy.example.com/team",
+			expectedRegion:      "us-east-1",
+		},
+		{
+			name:          "regionMismatch",
+			creds:         `{"region": "us-east-1", "accessKeyID": "id", "secretAccessKey": "key"}`,
+			registryUri:   "123456789012.dkr.ecr.eu-west-1.amazonaws.com",
+			expectedError: "Registry URI region eu-west-1 does not match the AWS region us-east-1",
+		},
+		{
+			name:          "roleAccountMismatch",
+			creds:         `{"region": "us-east-1", "accessKeyID": "id", "secretAccessKey": "key", "assumeRole": "arn:aws:iam::210987654321:role/puller"}`,
+			registryUri:   "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			expectedError: "Registry URI account 123456789012 does not match the assumed role account 210987654321",
+		},
+		{
+			name:          "malformed",
+			creds:         `{"region": "us-east-1", "accessKeyID": "id", "secretAccessKey": "key"}`,
+			registryUri:   "12345.dkr.ecr.us-east-1.amazonaws.com",
+			expectedError: "Not an ECR registry hostname (<account>.dkr.ecr[-fips].<region>.amazonaws.com[.cn]): 12345.dkr.ecr.us-east-1.amazonaws.com",
+		},
+	} {
+		suite.Run(testCase.name, func() {
+			r := &Registry{
+				Registry: &abstract.Registry{
+					Logger:      loggerInstance,
+					Namespace:   "namespace",
+					Creds:       testCase.creds,
+					RegistryUri: testCase.registryUri,
+				},
+			}
+			err := r.EnrichAndValidate()
+			if testCase.expectedError != "" {
+				suite.Require().Error(err)
+				suite.Require().Equal(testCase.expectedError, errors.RootCause(err).Error())
+				return
+			}
+			suite.Require().NoError(err)
+			suite.Require().Equal(testCase.expectedRegistryUri, r.RegistryUri)
+			suite.Require().Equal(testCase.expectedRegion, r.awsCreds.Region)
+		})
+	}
+}
+
+func (suite *ECRSuite) TestCompileToken() {
+	loggerInstance, err := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	suite.Require().NoError(err)
+
+	ecrClient := &fakeECRClient{
+		pullThroughCacheRules: []*ecr.PullThroughCacheRule{
+			{EcrRepositoryPrefix: aws.String("docker-hub")},
+			{EcrRepositoryPrefix: aws.String("quay")},
+		},
+		replicationConfiguration: &ecr.ReplicationConfiguration{
+			Rules: []*ecr.ReplicationRule{
+				{
+					Destinations: []*ecr.ReplicationDestination{
+						{Region: aws.String("us-east-1"), RegistryId: aws.String("210987654321")},
+						{Region: aws.String("eu-west-1"), RegistryId: aws.String("123456789012")},
+					},
+				},
+			},
+		},
+	}
+	auth := &ecr.AuthorizationData{
+		AuthorizationToken: aws.String(base64.StdEncoding.EncodeToString([]byte("AWS:password"))),
+		ProxyEndpoint:      aws.String("https://123456789012.dkr.ecr.us-east-1.amazonaws.com"),
+	}
+
+	for _, testCase := range []struct {
+		name                 string
+		registryUri          string
+		discoverAliases      bool
+		expectedRegistryUris []string
+	}{
+		{
+			name:                 "configured",
+			registryUri:          "ecr-proxy.example.com",
+			expectedRegistryUris: []string{"ecr-proxy.example.com"},
+		},
+		{
+			name:                 "discovered",
+			expectedRegistryUris: []string{"123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+		},
+		{
+			name:            "aliases",
+			discoverAliases: true,
+			expectedRegistryUris: []string{
+				"123456789012.dkr.ecr.us-east-1.amazonaws.com",
+				"123456789012.dkr.ecr.us-east-1.amazonaws.com/docker-hub",
+				"123456789012.dkr.ecr.us-east-1.amazonaws.com/quay",
+				"210987654321.dkr.ecr.us-east-1.amazonaws.com",
+			},
+		},
+	} {
+		suite.Run(testCase.name, func() {
+			r := &Registry{
+				Registry: &abstract.Registry{Logger: loggerInstance},
+				awsCreds: registry.AWSCreds{Region: "us-east-1", DiscoverAliases: testCase.discoverAliases},
+			}
+
+			token, err := r.compileToken(context.Background(), ecrClient, auth, testCase.registryUri)
+			suite.Require().NoError(err)
+			suite.Require().Equal("AWS", token.Username)
+			suite.Require().Equal("password", token.Password)
+			suite.Require().Equal(testCase.expectedRegistryUris, token.GetRegistryUris())
+		})
+	}
+
+	// without a registry URI to fall back to, the proxy endpoint is required
+	r := &Registry{Registry: &abstract.Registry{Logger: loggerInstance}}
+	_, err = r.compileToken(context.Background(), ecrClient, &ecr.AuthorizationData{
+		AuthorizationToken: auth.AuthorizationToken,
+	}, "")
+	suite.Require().Error(err)
+}
+
+func (suite *ECRSuite) TestDiagnoseRegistryUri() {
+	for _, testCase := range []struct {
+		name           string
+		registryUri    string
+		expectedStatus registry.DiagnosisStatus
+	}{
+		{name: "match", registryUri: "https://123456789012.dkr.ecr.us-east-1.amazonaws.com/", expectedStatus: registry.DiagnosisStatusPass},
+		{name: "otherAccount", registryUri: "210987654321.dkr.ecr.us-east-1.amazonaws.com", expectedStatus: registry.DiagnosisStatusWarn},
+		{name: "otherRegion", registryUri: "123456789012.dkr.ecr.eu-west-1.amazonaws.com", expectedStatus: registry.DiagnosisStatusFail},
+		{name: "notECR", registryUri: "mock.com", expectedStatus: registry.DiagnosisStatusWarn},
+		{name: "malformed", registryUri: "12345.dkr.ecr.us-east-1.amazonaws.com", expectedStatus: registry.DiagnosisStatusFail},
+		{name: "discovered", registryUri: "", expectedStatus: registry.DiagnosisStatusPass},
+	} {
+		suite.Run(testCase.name, func() {
+			r := &Registry{}
+			tokenScope := &scope{region: "us-east-1", registryUri: testCase.registryUri}
+			suite.Require().Equal(testCase.expectedStatus, r.diagnoseRegistryUri(tokenScope, "123456789012").Status)
+		})
+	}
+}
+
 func TestECR(t *testing.T) {
 	suite.Run(t, new(ECRSuite))
 }
@@ -0,0 +1,159 @@
+package ecr
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+
+	"github.com/nuclio/errors"
+)
+
+// accountIDPattern matches AWS account IDs
+var accountIDPattern = regexp.MustCompile(`^[0-9]{12}$`)
+
+// scope is a region and account combination a token is issued for
+type scope struct {
+	region     string
+	assumeRole string
+
+	// registryUri is the registry URI the token is published under, its proxy endpoint when empty
+	registryUri string
+
+	// registryHost is the parsed registryUri, nil when it is empty or not an ECR hostname (e.g.: of a proxy)
+	registryHost *RegistryHost
+}
+
+func (s *scope) String() string {
+	if s.registryHost != nil {
+		return s.registryHost.String()
+	}
+	if s.assumeRole != "" {
+		return fmt.Sprintf("%s %s", s.region, s.assumeRole)
+	}
+	return s.region
+}
+
+// compileScopes compiles the region and account combinations tokens are issued for, a single one of the region,
+// assumed role and registry URI unless regions or accounts are listed
+func (r *Registry) compileScopes() []*scope {
+	if len(r.awsCreds.Regions) == 0 && len(r.awsCreds.Accounts) == 0 {
+		return []*scope{
+			{
+				region:       r.awsCreds.Region,
+				assumeRole:   r.awsCreds.AssumeRole,
+				registryUri:  r.RegistryUri,
+				registryHost: r.registryHost,
+			},
+		}
+	}
+
+	regions := r.awsCreds.Regions
+	if len(regions) == 0 {
+		regions = []string{r.awsCreds.Region}
+	}
+	accounts := r.awsCreds.Accounts
+	if len(accounts) == 0 {
+		accounts = []registry.AWSAccount{{AssumeRole: r.awsCreds.AssumeRole}}
+	}
+
+	var scopes []*scope
+	for _, region := range regions {
+		for _, account := range accounts {
+			accountScope := &scope{
+				region:     region,
+				assumeRole: account.AssumeRole,
+			}
+
+			// the registry of the account, or the proxy endpoint of the credentials account
+			accountID := account.ID
+			if accountID == "" && account.AssumeRole != "" {
+				accountID, _ = getRoleAccount(account.AssumeRole)
+			}
+			if accountID != "" {
+				accountScope.registryHost = &RegistryHost{
+					Account: accountID,
+					Region:  region,
+					China:   strings.HasPrefix(region, "cn-"),
+				}
+				accountScope.registryUri = accountScope.registryHost.String()
+			}
+
+			scopes = append(scopes, accountScope)
+		}
+	}
+	return scopes
+}
+
+// validateScopeSettings validates the regions and accounts tokens are issued for are either listed, or given by
+// the region, assumed role and registry URI
+func (r *Registry) validateScopeSettings() error {
+	if len(r.awsCreds.Regions) > 0 && r.awsCreds.Region != "" {
+		return errors.New("AWS Region and regions are mutually exclusive")
+	}
+	if len(r.awsCreds.Accounts) > 0 && r.awsCreds.AssumeRole != "" {
+		return errors.New("AWS assume role and accounts are mutually exclusive")
+	}
+	if (len(r.awsCreds.Regions) > 0 || len(r.awsCreds.Accounts) > 0) && r.RegistryUri != "" {
+		return errors.New("Registry URI must be omitted when listing regions or accounts, " +
+			"the registry of every region and account is published")
+	}
+
+	for index, region := range r.awsCreds.Regions {
+		if region == "" {
+			return errors.Errorf("AWS region #%d must not be empty", index)
+		}
+	}
+	for index, account := range r.awsCreds.Accounts {
+		if account.ID == "" && account.AssumeRole == "" {
+			return errors.Errorf("AWS account #%d must have an ID or a role to assume", index)
+		}
+		if account.ID != "" && !accountIDPattern.MatchString(account.ID) {
+			return errors.Errorf("AWS account #%d ID must be 12 digits: %s", index, account.ID)
+		}
+	}
+
+	return nil
+}
+
+// validateScope validates the registry a token is published under belongs to the region it is issued in, as ECR
+// tokens are only valid in their region, and to the account of the assumed role when there is one
+func (r *Registry) validateScope(tokenScope *scope) error {
+	if tokenScope.registryHost == nil {
+		return nil
+	}
+
+	if tokenScope.registryHost.Region != tokenScope.region {
+		return errors.Errorf("Registry URI region %s does not match the AWS region %s",
+			tokenScope.registryHost.Region,
+			tokenScope.region)
+	}
+
+	if tokenScope.assumeRole == "" {
+		return nil
+	}
+
+	roleAccount, err := getRoleAccount(tokenScope.assumeRole)
+	if err != nil {
+		r.Logger.WarnWith("Failed to get the assumed role account, not validating it",
+			"assumeRole", tokenScope.assumeRole,
+			"err", errors.RootCause(err).Error())
+		return nil
+	}
+	if tokenScope.registryHost.Account != roleAccount {
+		return errors.Errorf("Registry URI account %s does not match the assumed role account %s",
+			tokenScope.registryHost.Account,
+			roleAccount)
+	}
+
+	return nil
+}
+
+// describeScope names a check of a scope, when there are several
+func (r *Registry) describeScope(check string, tokenScope *scope) string {
+	if len(r.scopes) == 1 {
+		return check
+	}
+	return fmt.Sprintf("%s (%s)", check, tokenScope)
+}
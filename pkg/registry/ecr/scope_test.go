@@ -0,0 +1,146 @@
+package ecr
+
+import (
+	"os"
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/registry/abstract"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	"github.com/stretchr/testify/suite"
+)
+
+type ScopeSuite struct {
+	suite.Suite
+	logger logger.Logger
+}
+
+func (suite *ScopeSuite) SetupTest() {
+	suite.logger, _ = common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	for _, envName := range []string{"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_ROLE_ARN", "AWS_DEFAULT_REGION"} {
+		suite.Require().NoError(os.Unsetenv(envName))
+	}
+}
+
+func (suite *ScopeSuite) TestCompileScopes() {
+	for _, testCase := range []struct {
+		name           string
+		creds          string
+		registryUri    string
+		expectedScopes []string
+	}{
+		{
+			name:           "single",
+			creds:          `{"region": "us-east-1"}`,
+			registryUri:    "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			expectedScopes: []string{"123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+		},
+		{
+			name:           "singleDiscovered",
+			creds:          `{"region": "us-east-1"}`,
+			expectedScopes: []string{"us-east-1"},
+		},
+		{
+			name:  "regions",
+			creds: `{"regions": ["us-east-1", "eu-west-1"], "assumeRole": "arn:aws:iam::123456789012:role/puller"}`,
+			expectedScopes: []string{
+				"123456789012.dkr.ecr.us-east-1.amazonaws.com",
+				"123456789012.dkr.ecr.eu-west-1.amazonaws.com",
+			},
+		},
+		{
+			name: "regionsAndAccounts",
+			creds: `{"regions": ["us-east-1", "cn-north-1"], "accounts": [` +
+				`{"assumeRole": "arn:aws:iam::123456789012:role/puller"}, {"id": "210987654321"}]}`,
+			expectedScopes: []string{
+				"123456789012.dkr.ecr.us-east-1.amazonaws.com",
+				"210987654321.dkr.ecr.us-east-1.amazonaws.com",
+				"123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn",
+				"210987654321.dkr.ecr.cn-north-1.amazonaws.com.cn",
+			},
+		},
+		{
+			name:  "accountsOfRegion",
+			creds: `{"region": "eu-west-1", "accounts": [{"assumeRole": "puller"}]}`,
+			expectedScopes: []string{
+				"eu-west-1 puller",
+			},
+		},
+	} {
+		suite.Run(testCase.name, func() {
+			r := suite.newRegistry(testCase.creds, testCase.registryUri)
+			suite.Require().NoError(r.EnrichAndValidate())
+
+			var scopes []string
+			for _, tokenScope := range r.scopes {
+				scopes = append(scopes, tokenScope.String())
+			}
+			suite.Require().Equal(testCase.expectedScopes, scopes)
+		})
+	}
+}
+
+func (suite *ScopeSuite) TestValidateScopes() {
+	for _, testCase := range []struct {
+		name          string
+		creds         string
+		registryUri   string
+		expectedError string
+	}{
+		{
+			name:          "regionAndRegions",
+			creds:         `{"region": "us-east-1", "regions": ["eu-west-1"]}`,
+			expectedError: "AWS Region and regions are mutually exclusive",
+		},
+		{
+			name:          "assumeRoleAndAccounts",
+			creds:         `{"region": "us-east-1", "assumeRole": "puller", "accounts": [{"id": "123456789012"}]}`,
+			expectedError: "AWS assume role and accounts are mutually exclusive",
+		},
+		{
+			name:        "registryUriAndRegions",
+			creds:       `{"regions": ["us-east-1"]}`,
+			registryUri: "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			expectedError: "Registry URI must be omitted when listing regions or accounts, " +
+				"the registry of every region and account is published",
+		},
+		{
+			name:          "emptyAccount",
+			creds:         `{"region": "us-east-1", "accounts": [{}]}`,
+			expectedError: "AWS account #0 must have an ID or a role to assume",
+		},
+		{
+			name:          "invalidAccountID",
+			creds:         `{"region": "us-east-1", "accounts": [{"id": "1234"}]}`,
+			expectedError: "AWS account #0 ID must be 12 digits: 1234",
+		},
+		{
+			name:          "accountRoleMismatch",
+			creds:         `{"regions": ["us-east-1"], "accounts": [{"id": "123456789012", "assumeRole": "arn:aws:iam::210987654321:role/puller"}]}`,
+			expectedError: "Registry URI account 123456789012 does not match the assumed role account 210987654321",
+		},
+	} {
+		suite.Run(testCase.name, func() {
+			err := suite.newRegistry(testCase.creds, testCase.registryUri).EnrichAndValidate()
+			suite.Require().Error(err)
+			suite.Require().Equal(testCase.expectedError, errors.RootCause(err).Error())
+		})
+	}
+}
+
+func (suite *ScopeSuite) newRegistry(creds string, registryUri string) *Registry {
+	return &Registry{
+		Registry: &abstract.Registry{
+			Logger:      suite.logger,
+			Namespace:   "namespace",
+			Creds:       `{"accessKeyID": "id", "secretAccessKey": "key", ` + creds[1:],
+			RegistryUri: registryUri,
+		},
+	}
+}
+
+func TestScopeSuite(t *testing.T) {
+	suite.Run(t, new(ScopeSuite))
+}
@@ -0,0 +1,78 @@
+package ecr
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/nuclio/errors"
+)
+
+const ecrHostMarker = ".dkr.ecr"
+
+// registryHostPattern matches ECR registry hostnames, <account>.dkr.ecr[-fips].<region>.amazonaws.com[.cn]
+var registryHostPattern = regexp.MustCompile(
+	`^([0-9]{12})\.dkr\.ecr(-fips)?\.([a-z]{2}(?:-[a-z]+)+-[0-9]+)\.amazonaws\.com(\.cn)?$`)
+
+// RegistryHost is an ECR registry hostname, broken into the account and region it belongs to
+type RegistryHost struct {
+	Account string
+	Region  string
+	FIPS    bool
+	China   bool
+}
+
+// String renders the registry hostname, which is the key docker looks its credentials up by
+func (rh *RegistryHost) String() string {
+	fipsSuffix := ""
+	if rh.FIPS {
+		fipsSuffix = "-fips"
+	}
+	chinaSuffix := ""
+	if rh.China {
+		chinaSuffix = ".cn"
+	}
+	return fmt.Sprintf("%s.dkr.ecr%s.%s.amazonaws.com%s", rh.Account, fipsSuffix, rh.Region, chinaSuffix)
+}
+
+// ParseRegistryUri parses the hostname of an ECR registry URI, ignoring its scheme and path
+// (e.g.: https://123456789012.dkr.ecr.us-east-1.amazonaws.com/team/app)
+func ParseRegistryUri(registryUri string) (*RegistryHost, error) {
+	host := strings.SplitN(common.NormalizeRegistryUri(registryUri), "/", 2)[0]
+
+	match := registryHostPattern.FindStringSubmatch(host)
+	if match == nil {
+		return nil, errors.Errorf("Not an ECR registry hostname "+
+			"(<account>.dkr.ecr[-fips].<region>.amazonaws.com[.cn]): %s",
+			host)
+	}
+
+	return &RegistryHost{
+		Account: match[1],
+		FIPS:    match[2] != "",
+		Region:  match[3],
+		China:   match[4] != "",
+	}, nil
+}
+
+// IsRegistryUri returns whether a registry URI looks like an ECR one, valid or not. Other URIs (e.g.: of a
+// proxy in front of ECR) are used as they are
+func IsRegistryUri(registryUri string) bool {
+	host := strings.SplitN(common.NormalizeRegistryUri(registryUri), "/", 2)[0]
+	return strings.Contains(host, ecrHostMarker) && strings.Contains(host, ".amazonaws.com")
+}
+
+// getRoleAccount returns the account of a role ARN, e.g.: arn:aws:iam::123456789012:role/puller
+func getRoleAccount(roleArn string) (string, error) {
+	parsedArn, err := arn.Parse(roleArn)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to parse role ARN: %s", roleArn)
+	}
+	if parsedArn.Service != "iam" || parsedArn.AccountID == "" {
+		return "", errors.Errorf("Not an IAM role ARN: %s", roleArn)
+	}
+	return parsedArn.AccountID, nil
+}
@@ -0,0 +1,78 @@
+package ecr
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type URISuite struct {
+	suite.Suite
+}
+
+func (suite *URISuite) TestParseRegistryUri() {
+	for _, testCase := range []struct {
+		registryUri          string
+		expectedRegistryHost *RegistryHost
+		expectedHost         string
+	}{
+		{
+			registryUri:          "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+			expectedRegistryHost: &RegistryHost{Account: "123456789012", Region: "us-east-1"},
+			expectedHost:         "123456789012.dkr.ecr.us-east-1.amazonaws.com",
+		},
+		{
+			registryUri:          "https://123456789012.DKR.ECR.eu-west-1.amazonaws.com/team/app/",
+			expectedRegistryHost: &RegistryHost{Account: "123456789012", Region: "eu-west-1"},
+			expectedHost:         "123456789012.dkr.ecr.eu-west-1.amazonaws.com",
+		},
+		{
+			registryUri:          "123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com/v2/",
+			expectedRegistryHost: &RegistryHost{Account: "123456789012", Region: "us-gov-west-1", FIPS: true},
+			expectedHost:         "123456789012.dkr.ecr-fips.us-gov-west-1.amazonaws.com",
+		},
+		{
+			registryUri:          "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn",
+			expectedRegistryHost: &RegistryHost{Account: "123456789012", Region: "cn-north-1", China: true},
+			expectedHost:         "123456789012.dkr.ecr.cn-north-1.amazonaws.com.cn",
+		},
+	} {
+		registryHost, err := ParseRegistryUri(testCase.registryUri)
+		suite.Require().NoError(err, testCase.registryUri)
+		suite.Require().Equal(testCase.expectedRegistryHost, registryHost)
+		suite.Require().Equal(testCase.expectedHost, registryHost.String())
+	}
+
+	for _, registryUri := range []string{
+		"mock.com",
+		"12345.dkr.ecr.us-east-1.amazonaws.com",
+		"123456789012.dkr.ecr.amazonaws.com",
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com.evil.com",
+	} {
+		_, err := ParseRegistryUri(registryUri)
+		suite.Require().Error(err, registryUri)
+	}
+}
+
+func (suite *URISuite) TestIsRegistryUri() {
+	suite.Require().True(IsRegistryUri("https://12345.dkr.ecr.us-east-1.amazonaws.com"))
+	suite.Require().False(IsRegistryUri("mock.com"))
+	suite.Require().False(IsRegistryUri("ecr-proxy.example.com/dkr.ecr"))
+}
+
+func (suite *URISuite) TestGetRoleAccount() {
+	roleAccount, err := getRoleAccount("arn:aws:iam::123456789012:role/puller")
+	suite.Require().NoError(err)
+	suite.Require().Equal("123456789012", roleAccount)
+
+	roleAccount, err = getRoleAccount("arn:aws-cn:iam::210987654321:role/path/puller")
+	suite.Require().NoError(err)
+	suite.Require().Equal("210987654321", roleAccount)
+
+	_, err = getRoleAccount("puller")
+	suite.Require().Error(err)
+}
+
+func TestURISuite(t *testing.T) {
+	suite.Run(t, new(URISuite))
+}
@@ -9,4 +9,16 @@ type Registry interface {
 
 	// GetAuthToken get an authorization token for the registry
 	GetAuthToken(ctx context.Context) (*Token, error)
+
+	// GetAuthTokens get the authorization tokens for the registry, registries spanning several regions or
+	// accounts (e.g.: ecr) issue one for each. When only some were issued, they are returned along with the error
+	GetAuthTokens(ctx context.Context) ([]*Token, error)
+}
+
+// Diagnoser is implemented by registries that can diagnose their credentials step by step, e.g.: for the
+// doctor command
+type Diagnoser interface {
+
+	// Diagnose runs the registry kind specific checks, returning the outcome of each
+	Diagnose(ctx context.Context) []*Diagnosis
 }
@@ -1,5 +1,13 @@
 package registry
 
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/nuclio/errors"
+)
+
 const (
 	ECRRegistryKind string = "ecr"
 )
@@ -9,6 +17,45 @@ type Token struct {
 	Namespace   string
 	Auth        string
 	RegistryUri string
+
+	// RegistryUris are additional hostnames the same credentials are valid for
+	RegistryUris []string
+
+	// Username and Password are the credentials Auth encodes, when the registry issues them separately
+	Username string
+	Password string
+
+	// IdentityToken and RegistryToken are used by registries issuing OAuth refresh or bearer tokens
+	IdentityToken string
+	RegistryToken string
+
+	// IssuedAt is when the credentials were issued
+	IssuedAt time.Time
+
+	// ExpiresAt is when the credentials expire, zero if unknown
+	ExpiresAt time.Time
+
+	// Scope is the region and account the token was issued for by registries issuing several (e.g.: ecr),
+	// so that the token of a failing one is kept while others are refreshed
+	Scope string
+}
+
+// DiagnosisStatus is the outcome of a diagnosis check
+type DiagnosisStatus string
+
+const (
+	DiagnosisStatusPass DiagnosisStatus = "pass"
+	DiagnosisStatusWarn DiagnosisStatus = "warn"
+	DiagnosisStatusFail DiagnosisStatus = "fail"
+	DiagnosisStatusSkip DiagnosisStatus = "skip"
+)
+
+// Diagnosis is the outcome of a single check, along with how to fix it when it did not pass
+type Diagnosis struct {
+	Check   string
+	Status  DiagnosisStatus
+	Message string
+	Fix     string
 }
 
 type AWSCreds struct {
@@ -16,4 +63,63 @@ type AWSCreds struct {
 	AccessKeyID     string `json:"accessKeyID,omitempty"`
 	SecretAccessKey string `json:"secretAccessKey,omitempty"`
 	AssumeRole      string `json:"assumeRole,omitempty"`
+
+	// Regions and Accounts get a token for every region and account combination, instead of Region and
+	// AssumeRole, as ECR tokens are only valid in the region they are issued in
+	Regions  []string     `json:"regions,omitempty"`
+	Accounts []AWSAccount `json:"accounts,omitempty"`
+
+	// DiscoverAliases publishes the tokens under the registry pull through cache prefixes, and the registries
+	// it replicates to in the same region, as discovered through the ECR API
+	DiscoverAliases bool `json:"discoverAliases,omitempty"`
+}
+
+// AWSAccount is an account whose registries are pulled from, by assuming its role, or with the credentials when
+// there is none (e.g.: of registries whose repository policies allow the credentials to pull)
+type AWSAccount struct {
+
+	// ID is the account ID, the assumed role account when omitted
+	ID         string `json:"id,omitempty"`
+	AssumeRole string `json:"assumeRole,omitempty"`
+}
+
+// GetRegistryUris returns RegistryUri followed by RegistryUris, without empty or duplicate entries
+func (t *Token) GetRegistryUris() []string {
+	var registryUris []string
+	seen := map[string]bool{}
+	for _, registryUri := range append([]string{t.RegistryUri}, t.RegistryUris...) {
+		if registryUri == "" || seen[registryUri] {
+			continue
+		}
+		seen[registryUri] = true
+		registryUris = append(registryUris, registryUri)
+	}
+	return registryUris
+}
+
+// GetAuth returns Auth, or encodes it from Username and Password when it is missing
+func (t *Token) GetAuth() string {
+	if t.Auth != "" || t.Username == "" {
+		return t.Auth
+	}
+	return base64.StdEncoding.EncodeToString([]byte(t.Username + ":" + t.Password))
+}
+
+// GetUsernamePassword returns Username and Password, or decodes them from Auth when they are missing
+func (t *Token) GetUsernamePassword() (string, string, error) {
+	if t.Username != "" || t.Auth == "" {
+		return t.Username, t.Password, nil
+	}
+
+	decodedAuth, err := base64.StdEncoding.DecodeString(t.Auth)
+	if err != nil {
+		return "", "", errors.Wrap(err, "Failed to decode auth")
+	}
+
+	usernamePassword := strings.SplitN(string(decodedAuth), ":", 2)
+	if len(usernamePassword) != 2 {
+		return "", "", errors.New("Auth is expected to encode <username>:<password>")
+	}
+
+	return usernamePassword[0], usernamePassword[1], nil
 }
@@ -2,64 +2,480 @@ package registrycredshandler
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/notifier"
 	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/remediation"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+	"github.com/v3io/registry-creds-handler/pkg/sink/factory"
+	sinkkubernetes "github.com/v3io/registry-creds-handler/pkg/sink/kubernetes"
+	"github.com/v3io/registry-creds-handler/pkg/verifier"
 
 	"github.com/nuclio/errors"
 	"github.com/nuclio/logger"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 )
 
+const (
+
+	// remediationTimeout bounds remediating pods in the background
+	remediationTimeout = time.Minute
+
+	// notificationTimeout bounds sending an alert in the background, notificationRepeatInterval is how long the
+	// same alert of a source is held back for once sent
+	notificationTimeout        = time.Minute
+	notificationRepeatInterval = time.Hour
+)
+
+// Source is a registry whose authorization token is refreshed on its own schedule
+type Source struct {
+	Name        string
+	Kind        string
+	Registry    registry.Registry
+	RefreshRate time.Duration
+
+	// RegistryUri and RegistryUris are the hostnames the source token is published under,
+	// RegistryUris are added to the token while RegistryUri is only used for placeholder tokens
+	RegistryUri  string
+	RegistryUris []string
+
+	// Verifier verifies every new token against the registry before it is kept, if set
+	Verifier *verifier.Verifier
+}
+
 type Handler struct {
 	logger        logger.Logger
 	kubeClientSet kubernetes.Interface
-	registry      registry.Registry
-	refreshRate   time.Duration
-	registryKind  string
+	sources       []*Source
+	targets       []*config.Target
+
+	// instance is the handler installation whose secrets cleanup finds, writer is this process, which
+	// cleanup on shutdown limits itself to
+	instance string
+	writer   string
+
+	// sinks are the destinations of the targets credentials, by their target
+	sinks map[*config.Target]sink.Sink
+
+	// notifiers are alerted of refresh failures, and of credentials about to expire while failing to refresh
+	notifiers           []notifier.Notifier
+	nearExpiryThreshold time.Duration
+
+	// notifiedAt is when every alert was last sent, by its source, kind and message, so that a source failing
+	// every refresh is not alerted of each. Alerts are sent in the background, tracked by notificationsWaitGroup
+	notifiedAt             map[string]time.Time
+	notificationsLock      sync.Mutex
+	notificationsWaitGroup sync.WaitGroup
+
+	// remediator restarts pods stuck pulling images once the secret they pull with is written, if set. Pods are
+	// remediated in the background, tracked by remediationsWaitGroup, so that writing other targets is not held up
+	remediator            *remediation.Remediator
+	remediationsWaitGroup sync.WaitGroup
+
+	// tokens holds the last good tokens of every source by its name, so that a failing
+	// source does not drop the entries of others from the targets
+	tokens     map[string][]*registry.Token
+	tokensLock sync.RWMutex
 }
 
 func NewHandler(logger logger.Logger,
 	kubeClientSet kubernetes.Interface,
-	registry registry.Registry,
-	refreshRate int64,
-	registryKind string) (*Handler, error) {
+	sources []*Source,
+	targets []*config.Target) (*Handler, error) {
+
+	sinks := map[*config.Target]sink.Sink{}
+	for _, target := range targets {
+		targetSink, err := factory.CreateSink(logger, kubeClientSet, target)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to create sink of %s", target)
+		}
+		sinks[target] = targetSink
+	}
 
 	return &Handler{
 		logger:        logger.GetChild("handler"),
 		kubeClientSet: kubeClientSet,
-		registry:      registry,
-		refreshRate:   time.Duration(refreshRate) * time.Minute,
-		registryKind:  registryKind,
+		sources:       sources,
+		targets:       targets,
+		instance:      config.DefaultInstance,
+		writer:        common.GetWriter(),
+		sinks:         sinks,
+		notifiedAt:    map[string]time.Time{},
+		tokens:        map[string][]*registry.Token{},
 	}, nil
 }
 
-func (h *Handler) Start() error {
+// SetInstance sets the handler installation whose secrets cleanup finds
+func (h *Handler) SetInstance(instance string) {
+	h.instance = instance
+}
+
+// SetNotifiers sets who is alerted of refresh failures, near expiry alerts are sent along with them when the last
+// good credentials of the registry expire within nearExpiryThreshold
+func (h *Handler) SetNotifiers(notifiers []notifier.Notifier, nearExpiryThreshold time.Duration) {
+	h.notifiers = notifiers
+	h.nearExpiryThreshold = nearExpiryThreshold
+}
+
+// SetRemediator sets who restarts pods that failed pulling images once their secret is written
+func (h *Handler) SetRemediator(remediator *remediation.Remediator) {
+	h.remediator = remediator
+}
+
+// Start refreshes the targets secrets until ctx is canceled
+func (h *Handler) Start(ctx context.Context) error {
 	h.logger.InfoWith("Handler starting...")
 
-	// Create ctx, no need for cancel func
-	ctx := context.Background()
+	if len(h.sources) == 0 {
+		return errors.New("At least one source is required")
+	}
+	if len(h.targets) == 0 {
+		return errors.New("At least one target is required")
+	}
 
-	if err := h.createOrUpdateSecret(ctx); err != nil {
-		return errors.Wrap(err, "Failed to create or update secret")
+	// get an initial token from every source, we can go on as long as one of them succeeded
+	var refreshErrors []error
+	for _, source := range h.sources {
+		refreshed, err := h.refreshTokens(ctx, source)
+		if err != nil {
+			h.logger.WarnWithCtx(ctx, "Failed to get initial token",
+				"source", source.Name,
+				"err", err.Error())
+			h.notifyRefreshFailure(ctx, source, err)
+		}
+		if !refreshed {
+			refreshErrors = append(refreshErrors, err)
+		}
+	}
+	if len(refreshErrors) == len(h.sources) {
+		return errors.Wrap(refreshErrors[0], "Failed to get a token from any source")
 	}
 
-	// spawn a goroutine for refreshing the secret
-	go func() {
+	// an unhealthy sink may recover, e.g.: once its RBAC or volume is in place
+	for _, target := range h.targets {
+		if err := h.sinks[target].Health(ctx); err != nil {
+			h.logger.WarnWithCtx(ctx, "Sink is unhealthy",
+				"Target", target.String(),
+				"err", err.Error())
+		}
+	}
 
-		h.logger.InfoWithCtx(ctx, "Starting secret refresher")
-		if err := h.keepRefreshingSecret(ctx); err != nil {
-			h.logger.ErrorWithCtx(ctx, "Failed and stopped refreshing secret", "err", err.Error())
-			return
+	for _, target := range h.targets {
+		if err := h.writeTarget(ctx, target); err != nil {
+			return errors.Wrapf(err, "Failed to write %s", target)
 		}
-		h.logger.WarnWithCtx(ctx, "Stopped refreshing secret")
-	}()
-	select {}
+	}
+
+	// spawn a goroutine per source for refreshing its token and the secrets it is compiled into
+	refreshersWaitGroup := sync.WaitGroup{}
+	for _, source := range h.sources {
+		refreshersWaitGroup.Add(1)
+		go func(source *Source) {
+			defer refreshersWaitGroup.Done()
+
+			h.logger.InfoWithCtx(ctx, "Starting secret refresher", "source", source.Name)
+			if err := h.keepRefreshingSecret(ctx, source); err != nil {
+				h.logger.WarnWithCtx(ctx, "Stopped refreshing secret",
+					"source", source.Name,
+					"err", err.Error())
+				return
+			}
+			h.logger.WarnWithCtx(ctx, "Stopped refreshing secret", "source", source.Name)
+		}(source)
+	}
+	refreshersWaitGroup.Wait()
+	h.notificationsWaitGroup.Wait()
+	h.remediationsWaitGroup.Wait()
+
+	h.logger.InfoWith("Handler stopped")
+	return nil
 }
 
-// keepRefreshingSecret will refresh the secret after every h.refreshRate until ctx is closed
-func (h *Handler) keepRefreshingSecret(ctx context.Context) error {
+// Sync runs a single refresh of all sources and targets, failing with a summary if any of them failed
+func (h *Handler) Sync(ctx context.Context) error {
+	h.logger.InfoWithCtx(ctx, "Syncing")
+
+	if len(h.targets) == 0 {
+		return errors.New("At least one target is required")
+	}
+
+	var failures []string
+	for _, source := range h.sources {
+		if err := h.refreshToken(ctx, source); err != nil {
+			h.logger.WarnWithCtx(ctx, "Failed to refresh token",
+				"source", source.Name,
+				"err", err.Error())
+			h.notifyRefreshFailure(ctx, source, err)
+			failures = append(failures, fmt.Sprintf("registry %s: %s", source.Name, errors.RootCause(err).Error()))
+		}
+	}
+
+	for _, target := range h.targets {
+		if len(h.getTargetCredentials(target).Tokens) == 0 {
+			failures = append(failures, fmt.Sprintf("%s: no token is available", target))
+			continue
+		}
+		if err := h.writeTarget(ctx, target); err != nil {
+			h.logger.WarnWithCtx(ctx, "Failed to sync target",
+				"Target", target.String(),
+				"err", err.Error())
+			failures = append(failures, fmt.Sprintf("%s: %s", target, errors.RootCause(err).Error()))
+		}
+	}
+
+	// a sync is a one-off, its alerts are sent and its pods remediated before it is done
+	h.notificationsWaitGroup.Wait()
+	h.remediationsWaitGroup.Wait()
+
+	if len(failures) > 0 {
+		return errors.Errorf("Sync failed, %d out of %d registries and %d secrets:\n  %s",
+			len(failures),
+			len(h.sources),
+			len(h.targets),
+			strings.Join(failures, "\n  "))
+	}
+
+	h.logger.InfoWithCtx(ctx, "Synced successfully",
+		"Registries", len(h.sources),
+		"Secrets", len(h.targets))
+	return nil
+}
+
+// Cleanup removes everything the handler installation created. The targets sinks delete what they published,
+// then secrets of the installation are deleted and removed from service accounts imagePullSecrets, while only
+// our own entries are stripped from secrets we merged into, including ones of targets no longer configured
+func (h *Handler) Cleanup(ctx context.Context) error {
+	return h.cleanup(ctx, false)
+}
+
+// CleanupOnShutdown removes what Cleanup does, but only secrets this process was the last to write, so that
+// a replacement of it (e.g.: during a rolling update) keeps the secrets it already wrote
+func (h *Handler) CleanupOnShutdown(ctx context.Context) error {
+	return h.cleanup(ctx, true)
+}
+
+func (h *Handler) cleanup(ctx context.Context, ownWritesOnly bool) error {
+	h.logger.InfoWithCtx(ctx, "Cleaning up", "instance", h.instance, "ownWritesOnly", ownWritesOnly)
+
+	var cleanupErrors []error
+	for _, target := range h.targets {
+
+		// secrets are found by their labels below, where the last writer of each is known
+		if ownWritesOnly && target.GetKind() == sink.KubernetesSinkKind {
+			continue
+		}
+		if err := h.sinks[target].Delete(ctx, h.getTargetCleanupCredentials(target)); err != nil {
+			h.logger.WarnWithCtx(ctx, "Failed to delete target",
+				"Target", target.String(),
+				"err", err.Error())
+			cleanupErrors = append(cleanupErrors, err)
+		}
+	}
+
+	// secrets can only be found in a cluster
+	if h.kubeClientSet == nil {
+		if len(cleanupErrors) > 0 {
+			return errors.Wrapf(cleanupErrors[0], "Failed to clean up, %d errors occurred", len(cleanupErrors))
+		}
+		return nil
+	}
+
+	managedSecrets, mergedSecrets, err := h.listCleanupSecrets(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to list secrets to clean up")
+	}
+	if ownWritesOnly {
+		managedSecrets = h.filterOwnWrites(managedSecrets)
+		mergedSecrets = h.filterOwnWrites(mergedSecrets)
+	}
+
+	deletedSecretNames := map[string][]string{}
+
+	for _, secret := range managedSecrets {
+
+		// a secret written since it was listed (e.g.: by a replacement of this process) is kept
+		err := common.DeleteSecretVersion(ctx, h.kubeClientSet, secret.Namespace, secret.Name, secret.ResourceVersion)
+		if apierrors.IsConflict(errors.RootCause(err)) {
+			h.logger.InfoWithCtx(ctx, "Secret was written meanwhile, keeping it",
+				"SecretName", secret.Name,
+				"Namespace", secret.Namespace)
+			continue
+		}
+		if err != nil && !apierrors.IsNotFound(errors.RootCause(err)) {
+			h.logger.WarnWithCtx(ctx, "Failed to delete secret",
+				"SecretName", secret.Name,
+				"Namespace", secret.Namespace,
+				"err", err.Error())
+			cleanupErrors = append(cleanupErrors, err)
+			continue
+		}
+		h.logger.InfoWithCtx(ctx, "Secret deleted",
+			"SecretName", secret.Name,
+			"Namespace", secret.Namespace)
+		deletedSecretNames[secret.Namespace] = append(deletedSecretNames[secret.Namespace], secret.Name)
+	}
+
+	for _, secret := range mergedSecrets {
+		operation, err := common.RemoveOwnedRegistryAuths(ctx, h.kubeClientSet, secret.Namespace, secret.Name)
+		if err != nil {
+			h.logger.WarnWithCtx(ctx, "Failed to remove owned entries from secret",
+				"SecretName", secret.Name,
+				"Namespace", secret.Namespace,
+				"err", err.Error())
+			cleanupErrors = append(cleanupErrors, err)
+			continue
+		}
+		h.logger.InfoWithCtx(ctx, "Owned entries removed from secret",
+			"SecretName", secret.Name,
+			"Namespace", secret.Namespace,
+			"Operation", operation)
+		if operation == common.SecretOperationDelete {
+			deletedSecretNames[secret.Namespace] = append(deletedSecretNames[secret.Namespace], secret.Name)
+		}
+	}
+
+	for namespace, secretNames := range deletedSecretNames {
+		serviceAccountNames, err := common.RemoveServiceAccountsImagePullSecrets(ctx,
+			h.kubeClientSet,
+			namespace,
+			secretNames)
+		if err != nil {
+			h.logger.WarnWithCtx(ctx, "Failed to remove secrets from service accounts",
+				"Namespace", namespace,
+				"err", err.Error())
+			cleanupErrors = append(cleanupErrors, err)
+			continue
+		}
+		if len(serviceAccountNames) > 0 {
+			h.logger.InfoWithCtx(ctx, "Secrets removed from service accounts",
+				"Namespace", namespace,
+				"ServiceAccounts", serviceAccountNames)
+		}
+	}
+
+	if len(cleanupErrors) > 0 {
+		return errors.Wrapf(cleanupErrors[0], "Failed to clean up, %d errors occurred", len(cleanupErrors))
+	}
+
+	h.logger.InfoWithCtx(ctx, "Cleaned up successfully",
+		"ManagedSecrets", len(managedSecrets),
+		"MergedSecrets", len(mergedSecrets))
+	return nil
+}
+
+// Plan returns what a sync would change in the targets secrets, writing nothing. Tokens are fetched from
+// the sources unless placeholders is set, falling back to placeholder tokens when fetching fails
+func (h *Handler) Plan(ctx context.Context, placeholders bool) ([]*common.SecretPlan, error) {
+	for _, source := range h.sources {
+		if !placeholders {
+			err := h.refreshToken(ctx, source)
+			if err == nil {
+				continue
+			}
+			h.logger.WarnWithCtx(ctx, "Failed to get token, planning with a placeholder",
+				"source", source.Name,
+				"err", err.Error())
+		}
+
+		h.tokensLock.Lock()
+		h.tokens[source.Name] = []*registry.Token{
+			{
+				Username:     "placeholder",
+				Password:     "placeholder",
+				RegistryUri:  source.RegistryUri,
+				RegistryUris: source.RegistryUris,
+				IssuedAt:     time.Now(),
+			},
+		}
+		h.tokensLock.Unlock()
+	}
+
+	var plans []*common.SecretPlan
+	for _, target := range h.targets {
+		plan, err := h.sinks[target].Plan(ctx, h.getTargetCredentials(target))
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to plan %s", target)
+		}
+		plans = append(plans, plan)
+	}
+
+	return plans, nil
+}
+
+// PlanCleanup returns what Cleanup would change, writing nothing
+func (h *Handler) PlanCleanup(ctx context.Context) ([]*common.SecretPlan, error) {
+	managedSecrets, mergedSecrets, err := h.listCleanupSecrets(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list secrets to clean up")
+	}
+
+	var plans []*common.SecretPlan
+	for index := range managedSecrets {
+		plans = append(plans, common.PlanDeleteSecret(&managedSecrets[index]))
+	}
+	for index := range mergedSecrets {
+		plan, err := common.PlanRemoveOwnedRegistryAuths(&mergedSecrets[index])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to plan secret %s/%s",
+				mergedSecrets[index].Namespace,
+				mergedSecrets[index].Name)
+		}
+		plans = append(plans, plan)
+	}
+
+	return plans, nil
+}
+
+// listCleanupSecrets lists the secrets of the handler installation we manage, and the secrets someone else
+// manages that it merged into
+func (h *Handler) listCleanupSecrets(ctx context.Context) ([]v1.Secret, []v1.Secret, error) {
+	managedSecrets, err := common.ListSecrets(ctx,
+		h.kubeClientSet,
+		metav1.NamespaceAll,
+		fmt.Sprintf("%s=%s,%s=%s",
+			common.ManagedByLabel,
+			common.ManagedByLabelValue,
+			common.InstanceLabel,
+			h.instance))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to list managed secrets")
+	}
+
+	mergedSecrets, err := common.ListSecrets(ctx,
+		h.kubeClientSet,
+		metav1.NamespaceAll,
+		fmt.Sprintf("%s=true,%s=%s", common.MergedLabel, common.InstanceLabel, h.instance))
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Failed to list merged secrets")
+	}
+
+	return managedSecrets, mergedSecrets, nil
+}
+
+// filterOwnWrites returns the secrets this process was the last to write
+func (h *Handler) filterOwnWrites(secrets []v1.Secret) []v1.Secret {
+	var ownSecrets []v1.Secret
+	for _, secret := range secrets {
+		if secret.Annotations[common.WriterAnnotation] == h.writer {
+			ownSecrets = append(ownSecrets, secret)
+		}
+	}
+	return ownSecrets
+}
+
+// keepRefreshingSecret will refresh the source token and the secrets it is compiled into
+// after every source.RefreshRate until ctx is closed
+func (h *Handler) keepRefreshingSecret(ctx context.Context, source *Source) error {
 
 	// Keep trying until we're timed out or got a result or got an error
 	for {
@@ -70,37 +486,599 @@ func (h *Handler) keepRefreshingSecret(ctx context.Context) error {
 			return errors.Wrap(ctx.Err(), "Context was canceled, stopped refreshing secret")
 
 		// Got a tick, time to refresh secret
-		case <-time.After(h.refreshRate):
-			if err := h.createOrUpdateSecret(ctx); err != nil {
-				h.logger.WarnWithCtx(ctx, "Failed to refresh secret", "error", err.Error())
+		case <-time.After(source.RefreshRate):
+			refreshed, err := h.refreshTokens(ctx, source)
+			if err != nil {
+				h.logger.WarnWithCtx(ctx, "Failed to refresh token, keeping the last good one",
+					"source", source.Name,
+					"refreshed", refreshed,
+					"error", err.Error())
+				h.notifyRefreshFailure(ctx, source, err)
+			}
+			if !refreshed {
+				continue
+			}
+			for _, target := range h.targets {
+				if !target.IncludesRegistry(source.Name) {
+					continue
+				}
+				if err := h.writeTarget(ctx, target); err != nil {
+					h.logger.WarnWithCtx(ctx, "Failed to refresh target",
+						"source", source.Name,
+						"target", target.String(),
+						"error", err.Error())
+				}
 			}
 		}
 	}
 }
 
-// createOrUpdateSecret get token from registry, create or update secret with new token
-func (h *Handler) createOrUpdateSecret(ctx context.Context) error {
-
-	token, err := h.registry.GetAuthToken(ctx)
+// GetToken refreshes the tokens of a source by its name, and returns the first as it would be published.
+// Sources issuing several tokens (e.g.: ecr registries of several regions) are better served by GetTokens
+func (h *Handler) GetToken(ctx context.Context, sourceName string) (*registry.Token, error) {
+	tokens, err := h.GetTokens(ctx, sourceName)
 	if err != nil {
-		return errors.Wrap(err, "Failed to get authorization token")
+		return nil, errors.Wrap(err, "Failed to get tokens")
 	}
+	return tokens[0], nil
+}
+
+// GetTokens refreshes the tokens of a source by its name, and returns them as they would be published
+func (h *Handler) GetTokens(ctx context.Context, sourceName string) ([]*registry.Token, error) {
+	for _, source := range h.sources {
+		if source.Name != sourceName {
+			continue
+		}
+		refreshed, err := h.refreshTokens(ctx, source)
+		if !refreshed {
+			return nil, errors.Wrap(err, "Failed to refresh token")
+		}
+		if err != nil {
+			h.logger.WarnWithCtx(ctx, "Failed to refresh some tokens, keeping their last good ones",
+				"source", source.Name,
+				"err", err.Error())
+		}
+
+		h.tokensLock.RLock()
+		defer h.tokensLock.RUnlock()
+		return h.tokens[source.Name], nil
+	}
+
+	return nil, errors.Errorf("Unknown source: %s", sourceName)
+}
+
+// GetImageToken refreshes the tokens of a source by its name, and returns the one serving an image or a
+// registry URI along with the registry URI it matched by. The first token is returned when none matches
+// (e.g.: of images matched by a registry URI glob of the source), along with an empty registry URI
+func (h *Handler) GetImageToken(ctx context.Context,
+	sourceName string,
+	image string) (*registry.Token, string, error) {
 
-	secret, err := common.CompileRegistryAuthSecret(token)
+	tokens, err := h.GetTokens(ctx, sourceName)
 	if err != nil {
-		return errors.Wrap(err, "Failed to generate secret object")
+		return nil, "", errors.Wrap(err, "Failed to get tokens")
+	}
+
+	token, registryUri := findImageToken(tokens, image)
+	return token, registryUri, nil
+}
+
+// GetLastImageToken returns the last good token of a source serving an image as GetImageToken does, without
+// refreshing it (e.g.: the token DiscoverSource just fetched). Nil is returned when the source has no token
+func (h *Handler) GetLastImageToken(sourceName string, image string) (*registry.Token, string) {
+	h.tokensLock.RLock()
+	defer h.tokensLock.RUnlock()
+
+	if len(h.tokens[sourceName]) == 0 {
+		return nil, ""
+	}
+	return findImageToken(h.tokens[sourceName], image)
+}
+
+// GetSources returns the handler sources
+func (h *Handler) GetSources() []*Source {
+	return h.sources
+}
+
+// FindSource returns the first source serving an image or a registry URI along with the registry URI it
+// matched by, nil if there is none. Sources are matched by their configured registry URIs, along with the
+// ones of their last good token
+func (h *Handler) FindSource(image string) (*Source, string) {
+	for _, source := range h.sources {
+		for _, registryUri := range h.getSourceRegistryUris(source) {
+			if common.MatchRegistryUri(registryUri, image) {
+				return source, registryUri
+			}
+		}
+	}
+	return nil, ""
+}
+
+// DiscoverSource returns the source serving an image as FindSource does. When none does, the tokens of the
+// sources without configured registry URIs (e.g.: ecr registries whose URI is discovered from their tokens),
+// which can only be matched by their tokens, are fetched first and the image matched against them
+func (h *Handler) DiscoverSource(ctx context.Context, image string) (*Source, string, error) {
+	if source, registryUri := h.FindSource(image); source != nil {
+		return source, registryUri, nil
+	}
+
+	for _, source := range h.GetDiscoverableSources() {
+		if _, err := h.GetTokens(ctx, source.Name); err != nil {
+			return nil, "", errors.Wrapf(err, "Failed to get tokens of registry: %s", source.Name)
+		}
+	}
+
+	source, registryUri := h.FindSource(image)
+	return source, registryUri, nil
+}
+
+// GetDiscoverableSources returns the sources without configured registry URIs which no token was fetched of
+// yet, so that they can not be matched to images
+func (h *Handler) GetDiscoverableSources() []*Source {
+	h.tokensLock.RLock()
+	defer h.tokensLock.RUnlock()
+
+	var discoverableSources []*Source
+	for _, source := range h.sources {
+		if source.RegistryUri == "" && len(source.RegistryUris) == 0 && len(h.tokens[source.Name]) == 0 {
+			discoverableSources = append(discoverableSources, source)
+		}
+	}
+	return discoverableSources
+}
+
+// EnsureImagePullSecrets returns the names of the secrets in namespace that hold the credentials for images,
+// creating the ones missing so that they exist before a pod referring to them is admitted, unless dryRun is set
+// (e.g.: of a dry run admission, which must have no side effects). Only secrets of formats kubelet can pull
+// with are returned, along with the sorted names of the registries serving images that no target of namespace
+// includes, as secrets are only written to their target namespace
+func (h *Handler) EnsureImagePullSecrets(ctx context.Context,
+	namespace string,
+	images []string,
+	dryRun bool) ([]string, []string, error) {
+	sourceNames := map[string]bool{}
+	for _, image := range images {
+		if source, _ := h.FindSource(image); source != nil {
+			sourceNames[source.Name] = true
+		}
+	}
+	if len(sourceNames) == 0 {
+		return nil, nil, nil
+	}
+
+	var secretNames []string
+	coveredSourceNames := map[string]bool{}
+	for _, target := range h.targets {
+		if target.GetKind() != sink.KubernetesSinkKind ||
+			target.Namespace != namespace ||
+			!isImagePullSecretFormat(target.Format) ||
+			!targetIncludesAnyRegistry(target, sourceNames) {
+			continue
+		}
+		for sourceName := range sourceNames {
+			if target.IncludesRegistry(sourceName) {
+				coveredSourceNames[sourceName] = true
+			}
+		}
+
+		credentials := h.getTargetCredentials(target)
+		if len(credentials.Tokens) == 0 {
+			continue
+		}
+
+		kubernetesSink, ok := h.sinks[target].(*sinkkubernetes.Sink)
+		if !ok {
+			continue
+		}
+		secretName, err := kubernetesSink.GetSecretName(credentials)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "Failed to get secret name of %s", target)
+		}
+
+		if _, err := common.GetSecret(ctx, h.kubeClientSet, namespace, secretName); err != nil {
+			if !apierrors.IsNotFound(err) {
+				return nil, nil, errors.Wrapf(err, "Failed to get secret: %s", secretName)
+			}
+			if dryRun {
+				h.logger.DebugWithCtx(ctx, "Dry run, not writing missing secret",
+					"SecretName", secretName,
+					"Namespace", namespace)
+			} else if err := h.writeTarget(ctx, target); err != nil {
+				return nil, nil, errors.Wrapf(err, "Failed to write %s", target)
+			}
+		}
+
+		secretNames = appendUnique(secretNames, secretName)
+	}
+
+	var uncoveredSourceNames []string
+	for sourceName := range sourceNames {
+		if !coveredSourceNames[sourceName] {
+			uncoveredSourceNames = append(uncoveredSourceNames, sourceName)
+		}
+	}
+	sort.Strings(uncoveredSourceNames)
+
+	return secretNames, uncoveredSourceNames, nil
+}
+
+func (h *Handler) getSourceRegistryUris(source *Source) []string {
+	registryUris := append([]string{source.RegistryUri}, source.RegistryUris...)
+
+	h.tokensLock.RLock()
+	for _, token := range h.tokens[source.Name] {
+		registryUris = append(registryUris, token.GetRegistryUris()...)
+	}
+	h.tokensLock.RUnlock()
+
+	var nonEmptyRegistryUris []string
+	for _, registryUri := range registryUris {
+		if registryUri != "" {
+			nonEmptyRegistryUris = append(nonEmptyRegistryUris, registryUri)
+		}
+	}
+	return nonEmptyRegistryUris
+}
+
+// refreshToken get tokens from the source registry, verifies them and keep them as the source last good tokens
+func (h *Handler) refreshToken(ctx context.Context, source *Source) error {
+	_, err := h.refreshTokens(ctx, source)
+	return err
+}
+
+// refreshTokens refreshes the source tokens as refreshToken does, returning whether any of them was refreshed.
+// Tokens of the scopes that failed (e.g.: of a region) are kept while the others are refreshed, failing still
+func (h *Handler) refreshTokens(ctx context.Context, source *Source) (bool, error) {
+	tokens, refreshErr := source.Registry.GetAuthTokens(ctx)
+	if refreshErr != nil {
+		refreshErr = errors.Wrap(refreshErr, "Failed to get authorization token")
 	}
+	if len(tokens) == 0 {
+		if refreshErr != nil {
+			return false, refreshErr
+		}
+		return false, errors.New("Registry issued no authorization token")
+	}
+
+	var verifiedTokens []*registry.Token
+	for _, token := range tokens {
+
+		// registry kinds implementing GetAuthTokens by hand may issue nil tokens
+		if token == nil {
+			if refreshErr == nil {
+				refreshErr = errors.New("Registry issued an empty authorization token")
+			}
+			continue
+		}
+
+		verifiedToken := *token
+		if verifiedToken.IssuedAt.IsZero() {
+			verifiedToken.IssuedAt = time.Now()
+		}
 
-	h.logger.DebugWithCtx(ctx, "Creating or updating secret",
-		"SecretName", token.SecretName,
-		"Namespace", token.Namespace)
+		// a token failing verification (e.g.: of a wrong region or role) must not replace the last good one
+		if source.Verifier != nil {
+			if err := source.Verifier.Verify(ctx, &verifiedToken); err != nil {
+				if refreshErr == nil {
+					refreshErr = errors.Wrap(err, "Failed to verify token")
+				}
+				if token.Scope == "" {
+					return false, refreshErr
+				}
+				continue
+			}
+		}
 
-	if err := common.CreateOrUpdateSecret(ctx, h.kubeClientSet, secret); err != nil {
-		return errors.Wrap(err, "Failed to create or update secret")
+		verifiedTokens = append(verifiedTokens, &verifiedToken)
+	}
+	if len(verifiedTokens) == 0 {
+		return false, refreshErr
 	}
 
-	h.logger.InfoWithCtx(ctx, "Secret created or updated successfully",
-		"SecretName", token.SecretName,
-		"Namespace", token.Namespace)
+	h.tokensLock.Lock()
+	h.tokens[source.Name] = mergeScopeTokens(h.tokens[source.Name], verifiedTokens, source.RegistryUris)
+	h.tokensLock.Unlock()
+
+	return true, refreshErr
+}
+
+// mergeScopeTokens replaces the last good tokens with the refreshed ones of the same scope, keeping the ones of
+// scopes that were not refreshed. The source registry URIs are published along with the first token, so that
+// they are published once
+func mergeScopeTokens(lastGoodTokens []*registry.Token,
+	refreshedTokens []*registry.Token,
+	sourceRegistryUris []string) []*registry.Token {
+
+	refreshedScopeTokens := map[string]*registry.Token{}
+	for _, refreshedToken := range refreshedTokens {
+		if refreshedToken.Scope == "" {
+
+			// registries issuing unscoped tokens issue them all at once
+			refreshedScopeTokens = nil
+			break
+		}
+		refreshedScopeTokens[refreshedToken.Scope] = refreshedToken
+	}
+
+	var mergedTokens []*registry.Token
+	if refreshedScopeTokens != nil {
+		for _, lastGoodToken := range lastGoodTokens {
+			if refreshedToken, found := refreshedScopeTokens[lastGoodToken.Scope]; found {
+				mergedTokens = append(mergedTokens, refreshedToken)
+				delete(refreshedScopeTokens, lastGoodToken.Scope)
+				continue
+			}
+			mergedTokens = append(mergedTokens, lastGoodToken)
+		}
+	}
+	for _, refreshedToken := range refreshedTokens {
+		if _, found := refreshedScopeTokens[refreshedToken.Scope]; found || refreshedScopeTokens == nil {
+			mergedTokens = append(mergedTokens, refreshedToken)
+		}
+	}
+
+	// a kept first token carries the source registry URIs already
+	if len(lastGoodTokens) == 0 || mergedTokens[0] != lastGoodTokens[0] {
+		mergedTokens[0].RegistryUris = append(append([]string{}, mergedTokens[0].RegistryUris...),
+			sourceRegistryUris...)
+	}
+
+	return mergedTokens
+}
+
+// notifyRefreshFailure alerts the notifiers of a source failing to refresh, and of its last good token
+// expiring soon if it does. Alerts are sent in the background, once per repeat interval, and failing to
+// notify is only logged
+func (h *Handler) notifyRefreshFailure(ctx context.Context, source *Source, refreshErr error) {
+	if len(h.notifiers) == 0 {
+		return
+	}
+
+	alerts := []*notifier.Alert{
+		{
+			Kind:     notifier.RefreshFailureAlertKind,
+			Registry: source.Name,
+			Message:  fmt.Sprintf("Failed to refresh credentials: %s", errors.RootCause(refreshErr).Error()),
+		},
+	}
+
+	// the source credentials expire with their first expiring token
+	var expiresAt time.Time
+	h.tokensLock.RLock()
+	for _, token := range h.tokens[source.Name] {
+		if !token.ExpiresAt.IsZero() && (expiresAt.IsZero() || token.ExpiresAt.Before(expiresAt)) {
+			expiresAt = token.ExpiresAt
+		}
+	}
+	h.tokensLock.RUnlock()
+
+	if !expiresAt.IsZero() && time.Until(expiresAt) < h.nearExpiryThreshold {
+		message := fmt.Sprintf("Last good credentials expire at %s", expiresAt.UTC().Format(time.RFC3339))
+		if time.Until(expiresAt) <= 0 {
+			message = fmt.Sprintf("Last good credentials expired at %s", expiresAt.UTC().Format(time.RFC3339))
+		}
+		alerts = append(alerts, &notifier.Alert{
+			Kind:      notifier.NearExpiryAlertKind,
+			Registry:  source.Name,
+			Message:   message,
+			ExpiresAt: expiresAt,
+		})
+	}
+
+	alerts = h.throttleAlerts(alerts)
+	if len(alerts) == 0 {
+		h.logger.DebugWithCtx(ctx, "Alerts were sent lately, holding them back", "source", source.Name)
+		return
+	}
+
+	// a slow notifier must not hold back refreshing
+	h.notificationsWaitGroup.Add(1)
+	go func() {
+		defer h.notificationsWaitGroup.Done()
+
+		notificationCtx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+		defer cancel()
+
+		for _, alertNotifier := range h.notifiers {
+			for _, alert := range alerts {
+				if err := alertNotifier.Notify(notificationCtx, alert); err != nil {
+					h.logger.WarnWithCtx(notificationCtx, "Failed to notify",
+						"source", source.Name,
+						"alert", alert.Kind,
+						"err", err.Error())
+				}
+			}
+		}
+	}()
+}
+
+// throttleAlerts returns the alerts that were not sent within the repeat interval, marking them as sent
+func (h *Handler) throttleAlerts(alerts []*notifier.Alert) []*notifier.Alert {
+	h.notificationsLock.Lock()
+	defer h.notificationsLock.Unlock()
+
+	// alerts not sent lately are forgotten, so that ever changing messages do not pile up
+	for alertKey, notifiedAt := range h.notifiedAt {
+		if time.Since(notifiedAt) >= notificationRepeatInterval {
+			delete(h.notifiedAt, alertKey)
+		}
+	}
+
+	var dueAlerts []*notifier.Alert
+	for _, alert := range alerts {
+		alertKey := fmt.Sprintf("%s/%s/%s", alert.Registry, alert.Kind, alert.Message)
+		if notifiedAt, found := h.notifiedAt[alertKey]; found && time.Since(notifiedAt) < notificationRepeatInterval {
+			continue
+		}
+		h.notifiedAt[alertKey] = time.Now()
+		dueAlerts = append(dueAlerts, alert)
+	}
+	return dueAlerts
+}
+
+// writeTarget publishes the last good tokens of the target sources to its sink, remediating pods in the
+// background once it was written
+func (h *Handler) writeTarget(ctx context.Context, target *config.Target) error {
+	operation, credentials, err := h.publishTarget(ctx, target)
+	if h.remediator != nil &&
+		(operation == common.SecretOperationCreate || operation == common.SecretOperationUpdate) {
+
+		// writes on behalf of an admission request outlive it
+		h.remediationsWaitGroup.Add(1)
+		go func() {
+			defer h.remediationsWaitGroup.Done()
+
+			remediationCtx, cancel := context.WithTimeout(context.Background(), remediationTimeout)
+			defer cancel()
+
+			h.remediateTarget(remediationCtx, target, credentials)
+		}()
+	}
+	if err != nil {
+		return errors.Wrap(err, "Failed to publish target")
+	}
 	return nil
 }
+
+// publishTarget writes the last good credentials of a target to its sink, returning what was done along with
+// the credentials written, also when the sink failed after writing them
+func (h *Handler) publishTarget(ctx context.Context,
+	target *config.Target) (common.SecretOperation, *sink.Credentials, error) {
+
+	credentials := h.getTargetCredentials(target)
+	if len(credentials.Tokens) == 0 {
+		h.logger.WarnWithCtx(ctx, "No token is available yet, skipping target", "Target", target.String())
+		return common.SecretOperationUnchanged, credentials, nil
+	}
+
+	operation, err := h.sinks[target].Write(ctx, credentials)
+	if err != nil {
+		if operation != "" {
+			h.logger.WarnWithCtx(ctx, "Target written, but its sink failed afterwards",
+				"Target", target.String(),
+				"Operation", operation,
+				"err", err.Error())
+		}
+		return operation, credentials, errors.Wrapf(err, "Failed to write to sink: %s", h.sinks[target])
+	}
+
+	h.logger.InfoWithCtx(ctx, "Target written successfully",
+		"Target", target.String(),
+		"Operation", operation)
+	return operation, credentials, nil
+}
+
+// remediateTarget restarts the pods that failed pulling images with the target secret before it was written.
+// Failing to remediate is only logged, pods recover once kubelet retries pulling
+func (h *Handler) remediateTarget(ctx context.Context, target *config.Target, credentials *sink.Credentials) {
+	if h.remediator == nil {
+		return
+	}
+
+	kubernetesSink, ok := h.sinks[target].(*sinkkubernetes.Sink)
+	if !ok {
+		return
+	}
+	secretNames, err := kubernetesSink.GetSecretNames(ctx, credentials)
+	if err != nil {
+		h.logger.WarnWithCtx(ctx, "Failed to get secret names", "Target", target.String(), "err", err.Error())
+		return
+	}
+
+	var registryUris []string
+	for _, token := range credentials.Tokens {
+		registryUris = append(registryUris, token.GetRegistryUris()...)
+	}
+
+	podNames, err := h.remediator.Remediate(ctx, target.Namespace, secretNames, registryUris)
+	if err != nil {
+		h.logger.WarnWithCtx(ctx, "Failed to remediate pods", "Target", target.String(), "err", err.Error())
+	}
+	if len(podNames) > 0 {
+		h.logger.InfoWithCtx(ctx, "Restarted pods that failed pulling images",
+			"Target", target.String(),
+			"Pods", podNames)
+	}
+}
+
+// getTargetCredentials returns the last good tokens of the target sources, along with the sources they came from
+func (h *Handler) getTargetCredentials(target *config.Target) *sink.Credentials {
+	h.tokensLock.RLock()
+	defer h.tokensLock.RUnlock()
+
+	credentials := &sink.Credentials{}
+	for _, source := range h.sources {
+		if !target.IncludesRegistry(source.Name) {
+			continue
+		}
+		if tokens, found := h.tokens[source.Name]; found {
+			credentials.Tokens = append(credentials.Tokens, tokens...)
+			credentials.Registries = append(credentials.Registries, source.Name)
+			credentials.Kinds = appendUnique(credentials.Kinds, source.Kind)
+		}
+	}
+	return credentials
+}
+
+// getTargetCleanupCredentials returns what a target sink deletes its credentials by. Cleanup may run in a process
+// that fetched no tokens (e.g.: the cleanup command), so every registry of the target is included, sources without
+// a token by a placeholder of their configured registry URIs
+func (h *Handler) getTargetCleanupCredentials(target *config.Target) *sink.Credentials {
+	h.tokensLock.RLock()
+	defer h.tokensLock.RUnlock()
+
+	credentials := &sink.Credentials{}
+	for _, source := range h.sources {
+		if !target.IncludesRegistry(source.Name) {
+			continue
+		}
+		credentials.Registries = append(credentials.Registries, source.Name)
+		credentials.Kinds = appendUnique(credentials.Kinds, source.Kind)
+
+		if tokens := h.tokens[source.Name]; len(tokens) > 0 {
+			credentials.Tokens = append(credentials.Tokens, tokens...)
+			continue
+		}
+		if source.RegistryUri != "" || len(source.RegistryUris) > 0 {
+			credentials.Tokens = append(credentials.Tokens, &registry.Token{
+				RegistryUri:  source.RegistryUri,
+				RegistryUris: source.RegistryUris,
+			})
+		}
+	}
+	return credentials
+}
+
+func appendUnique(values []string, value string) []string {
+	for _, existingValue := range values {
+		if existingValue == value {
+			return values
+		}
+	}
+	return append(values, value)
+}
+
+// isImagePullSecretFormat returns whether kubelet can pull images with a secret of the given format
+func isImagePullSecretFormat(format common.SecretFormat) bool {
+	return format == "" || format == common.SecretFormatDockerConfigJSON || format == common.SecretFormatDockerCfg
+}
+
+func targetIncludesAnyRegistry(target *config.Target, registryNames map[string]bool) bool {
+	for registryName := range registryNames {
+		if target.IncludesRegistry(registryName) {
+			return true
+		}
+	}
+	return false
+}
+
+func findImageToken(tokens []*registry.Token, image string) (*registry.Token, string) {
+	for _, token := range tokens {
+		for _, registryUri := range token.GetRegistryUris() {
+			if common.MatchRegistryUri(registryUri, image) {
+				return token, registryUri
+			}
+		}
+	}
+	return tokens[0], ""
+}
@@ -2,43 +2,77 @@ package registrycredshandler
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/notifier"
 	"github.com/v3io/registry-creds-handler/pkg/registry"
 	"github.com/v3io/registry-creds-handler/pkg/registry/mock"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+	"github.com/v3io/registry-creds-handler/pkg/sink/factory"
+	sinkkubernetes "github.com/v3io/registry-creds-handler/pkg/sink/kubernetes"
+	"github.com/v3io/registry-creds-handler/pkg/verifier"
 
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
 	"github.com/stretchr/testify/suite"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/kubernetes/fake"
 )
 
+// multiTokenRegistry is a mocked registry issuing a token per region, failing with err along with them if set
+type multiTokenRegistry struct {
+	*mock.Registry
+	tokens []*registry.Token
+	err    error
+}
+
+func (r *multiTokenRegistry) GetAuthTokens(ctx context.Context) ([]*registry.Token, error) {
+	return r.tokens, r.err
+}
+
 type HandlerSuite struct {
 	suite.Suite
 }
 
 func (suite *HandlerSuite) TestCreateOrUpdateSecretSanity() {
 	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
-	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "secret name", "some namespace", "", "")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "secret-name", "some-namespace", "", "")
 	mockedKubeClientSet := fake.NewSimpleClientset()
-	handler, err := NewHandler(loggerInstance, mockedKubeClientSet, mockedRegistry, 0, "mock")
+	source := &Source{Name: "mock", Registry: mockedRegistry}
+	target := &config.Target{SecretName: "secret-name", Namespace: "some-namespace"}
+	handler, err := NewHandler(loggerInstance, mockedKubeClientSet, []*Source{source}, []*config.Target{target})
 	suite.Require().NoError(err)
 
 	mockedRegistry.On("GetAuthToken").Return(&registry.Token{}, nil).Once()
-	err = handler.createOrUpdateSecret(context.Background())
+	err = handler.refreshToken(context.Background(), source)
+	suite.Require().NoError(err)
+	err = handler.writeTarget(context.Background(), target)
 	suite.Require().NoError(err)
 }
 
 func (suite *HandlerSuite) TestRefreshingSecretSanity() {
 	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
-	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "secret name", "some namespace", "", "")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "secret-name", "some-namespace", "", "")
 	mockedKubeClientSet := fake.NewSimpleClientset()
-	handler, err := NewHandler(loggerInstance, mockedKubeClientSet, mockedRegistry, 10, "mock")
+	source := &Source{Name: "mock", Registry: mockedRegistry, RefreshRate: 10 * time.Minute}
+	target := &config.Target{SecretName: "secret-name", Namespace: "some-namespace"}
+	handler, err := NewHandler(loggerInstance, mockedKubeClientSet, []*Source{source}, []*config.Target{target})
 	suite.Require().NoError(err)
 
 	// setup mock for called assertion
-	handler.refreshRate = time.Duration(300) * time.Millisecond
+	source.RefreshRate = time.Duration(300) * time.Millisecond
 	mockedToken := &registry.Token{
 		SecretName:  mockedRegistry.SecretName,
 		Namespace:   mockedRegistry.Namespace,
@@ -50,7 +84,7 @@ func (suite *HandlerSuite) TestRefreshingSecretSanity() {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	go func() {
-		err = handler.keepRefreshingSecret(ctx)
+		err = handler.keepRefreshingSecret(ctx, source)
 	}()
 
 	// let the refresher start
@@ -65,6 +99,611 @@ func (suite *HandlerSuite) TestRefreshingSecretSanity() {
 	suite.Require().Error(err)
 }
 
+func (suite *HandlerSuite) TestAggregateSecretKeepsLastGoodTokens() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	firstRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "first.mock.com")
+	secondRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "second.mock.com")
+	mockedKubeClientSet := fake.NewSimpleClientset()
+	firstSource := &Source{Name: "first", Registry: firstRegistry}
+	secondSource := &Source{Name: "second", Registry: secondRegistry}
+	target := &config.Target{SecretName: "secret", Namespace: "namespace"}
+	handler, err := NewHandler(loggerInstance,
+		mockedKubeClientSet,
+		[]*Source{firstSource, secondSource},
+		[]*config.Target{target})
+	suite.Require().NoError(err)
+
+	ctx := context.Background()
+	firstRegistry.On("GetAuthToken").Return(&registry.Token{Auth: "first", RegistryUri: "first.mock.com"}, nil).Once()
+	secondRegistry.On("GetAuthToken").Return(&registry.Token{Auth: "second", RegistryUri: "second.mock.com"}, nil).Once()
+	suite.Require().NoError(handler.refreshToken(ctx, firstSource))
+	suite.Require().NoError(handler.refreshToken(ctx, secondSource))
+	suite.Require().NoError(handler.writeTarget(ctx, target))
+
+	// second registry fails, its last good entry is kept
+	firstRegistry.On("GetAuthToken").Return(&registry.Token{Auth: "first refreshed", RegistryUri: "first.mock.com"}, nil).Once()
+	secondRegistry.On("GetAuthToken").Return((*registry.Token)(nil), errors.New("some error")).Once()
+	suite.Require().NoError(handler.refreshToken(ctx, firstSource))
+	suite.Require().Error(handler.refreshToken(ctx, secondSource))
+	suite.Require().NoError(handler.writeTarget(ctx, target))
+
+	secret, err := common.GetSecret(ctx, mockedKubeClientSet, target.Namespace, target.SecretName)
+	suite.Require().NoError(err)
+
+	dockerConfigJSON := common.DockerConfigJSON{}
+	err = json.Unmarshal(secret.Data[v1.DockerConfigJsonKey], &dockerConfigJSON)
+	suite.Require().NoError(err)
+	suite.Require().Equal(map[string]common.RegistryAuth{
+		"first.mock.com":  {Auth: "first refreshed"},
+		"second.mock.com": {Auth: "second"},
+	}, dockerConfigJSON.Auths)
+}
+
+func (suite *HandlerSuite) TestMultiTokenSource() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "")
+	mockedKubeClientSet := fake.NewSimpleClientset()
+	source := &Source{
+		Name: "ecr",
+		Registry: &multiTokenRegistry{
+			Registry: mockedRegistry,
+			tokens: []*registry.Token{
+				{Auth: "east", RegistryUri: "123456789012.dkr.ecr.us-east-1.amazonaws.com"},
+				{Auth: "west", RegistryUri: "123456789012.dkr.ecr.eu-west-1.amazonaws.com"},
+			},
+		},
+		RegistryUris: []string{"ecr-proxy.mock.com"},
+	}
+	target := &config.Target{SecretName: "secret", Namespace: "namespace"}
+	handler, err := NewHandler(loggerInstance, mockedKubeClientSet, []*Source{source}, []*config.Target{target})
+	suite.Require().NoError(err)
+
+	// all the tokens are published together, the source registry URIs along with the first
+	ctx := context.Background()
+	suite.Require().NoError(handler.refreshToken(ctx, source))
+	suite.Require().NoError(handler.writeTarget(ctx, target))
+
+	secret, err := common.GetSecret(ctx, mockedKubeClientSet, target.Namespace, target.SecretName)
+	suite.Require().NoError(err)
+	dockerConfigJSON := common.DockerConfigJSON{}
+	err = json.Unmarshal(secret.Data[v1.DockerConfigJsonKey], &dockerConfigJSON)
+	suite.Require().NoError(err)
+	suite.Require().Equal(map[string]common.RegistryAuth{
+		"123456789012.dkr.ecr.us-east-1.amazonaws.com": {Auth: "east"},
+		"123456789012.dkr.ecr.eu-west-1.amazonaws.com": {Auth: "west"},
+		"ecr-proxy.mock.com":                           {Auth: "east"},
+	}, dockerConfigJSON.Auths)
+
+	// images are served the token of their region
+	token, registryUri, err := handler.GetImageToken(ctx, "ecr", "123456789012.dkr.ecr.eu-west-1.amazonaws.com/app:1.0")
+	suite.Require().NoError(err)
+	suite.Require().Equal("west", token.Auth)
+	suite.Require().Equal("123456789012.dkr.ecr.eu-west-1.amazonaws.com", registryUri)
+}
+
+func (suite *HandlerSuite) TestRefreshSkipsNilTokens() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "")
+	mockedRegistry.On("GetAuthToken").Return((*registry.Token)(nil), nil)
+	source := &Source{Name: "mock", Registry: mockedRegistry}
+	multiTokenSource := &Source{
+		Name: "ecr",
+		Registry: &multiTokenRegistry{
+			Registry: mockedRegistry,
+			tokens:   []*registry.Token{nil, {Auth: "west", RegistryUri: "west.mock.com", Scope: "eu-west-1"}},
+		},
+	}
+	handler, err := NewHandler(loggerInstance, nil, []*Source{source, multiTokenSource}, nil)
+	suite.Require().NoError(err)
+
+	// no token is a failure rather than a panic
+	ctx := context.Background()
+	suite.Require().Error(handler.refreshToken(ctx, source))
+	suite.Require().Empty(handler.tokens[source.Name])
+
+	// the others are refreshed
+	refreshed, err := handler.refreshTokens(ctx, multiTokenSource)
+	suite.Require().Error(err)
+	suite.Require().True(refreshed)
+	suite.Require().Len(handler.tokens[multiTokenSource.Name], 1)
+	suite.Require().Equal("west", handler.tokens[multiTokenSource.Name][0].Auth)
+}
+
+func (suite *HandlerSuite) TestMultiTokenSourcePartialFailure() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "")
+	multiTokenRegistryInstance := &multiTokenRegistry{
+		Registry: mockedRegistry,
+		tokens: []*registry.Token{
+			{Auth: "east", RegistryUri: "east.mock.com", Scope: "us-east-1"},
+			{Auth: "west", RegistryUri: "west.mock.com", Scope: "eu-west-1"},
+		},
+	}
+	source := &Source{
+		Name:         "ecr",
+		Registry:     multiTokenRegistryInstance,
+		RegistryUris: []string{"ecr-proxy.mock.com"},
+	}
+	handler, err := NewHandler(loggerInstance, nil, []*Source{source}, nil)
+	suite.Require().NoError(err)
+
+	ctx := context.Background()
+	suite.Require().NoError(handler.refreshToken(ctx, source))
+
+	// a failing region keeps its last good token while the others are refreshed
+	for _, failure := range []struct {
+		issuedToken    *registry.Token
+		expectedTokens map[string][]string
+	}{
+		{
+			issuedToken: &registry.Token{Auth: "east 2", RegistryUri: "east.mock.com", Scope: "us-east-1"},
+			expectedTokens: map[string][]string{
+				"east 2": {"east.mock.com", "ecr-proxy.mock.com"},
+				"west":   {"west.mock.com"},
+			},
+		},
+		{
+			issuedToken: &registry.Token{Auth: "west 2", RegistryUri: "west.mock.com", Scope: "eu-west-1"},
+			expectedTokens: map[string][]string{
+				"east 2": {"east.mock.com", "ecr-proxy.mock.com"},
+				"west 2": {"west.mock.com"},
+			},
+		},
+	} {
+		multiTokenRegistryInstance.tokens = []*registry.Token{failure.issuedToken}
+		multiTokenRegistryInstance.err = errors.New("region failed")
+
+		refreshed, err := handler.refreshTokens(ctx, source)
+		suite.Require().Error(err)
+		suite.Require().True(refreshed)
+
+		tokens, err := handler.GetTokens(ctx, "ecr")
+		suite.Require().NoError(err)
+		tokenRegistryUris := map[string][]string{}
+		for _, token := range tokens {
+			tokenRegistryUris[token.Auth] = token.GetRegistryUris()
+		}
+		suite.Require().Equal(failure.expectedTokens, tokenRegistryUris)
+	}
+
+	// failing altogether keeps all of them
+	multiTokenRegistryInstance.tokens = nil
+	refreshed, err := handler.refreshTokens(ctx, source)
+	suite.Require().Error(err)
+	suite.Require().False(refreshed)
+	suite.Require().Len(handler.tokens["ecr"], 2)
+}
+
+func (suite *HandlerSuite) TestCompileSecretMetadata() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "ecr.mock.com")
+	source := &Source{Name: "prod", Kind: "ecr", Registry: mockedRegistry}
+	target := &config.Target{
+		SecretName:  "{{ .Registry }}-pull",
+		Namespace:   "namespace",
+		Labels:      map[string]string{"team": "platform"},
+		Annotations: map[string]string{"owner": "{{ .Namespace }}-admins"},
+	}
+	handler, err := NewHandler(loggerInstance, fake.NewSimpleClientset(), []*Source{source}, []*config.Target{target})
+	suite.Require().NoError(err)
+
+	expiresAt := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	mockedRegistry.On("GetAuthToken").Return(&registry.Token{
+		Auth:        "auth",
+		RegistryUri: "ecr.mock.com",
+		ExpiresAt:   expiresAt,
+	}, nil).Once()
+	suite.Require().NoError(handler.refreshToken(context.Background(), source))
+
+	secret, err := handler.sinks[target].(*sinkkubernetes.Sink).CompileSecret(handler.getTargetCredentials(target))
+	suite.Require().NoError(err)
+	suite.Require().Equal("prod-pull", secret.Name)
+	suite.Require().Equal(map[string]string{
+		"team":                "platform",
+		common.ManagedByLabel: common.ManagedByLabelValue,
+		common.InstanceLabel:  config.DefaultInstance,
+	}, secret.Labels)
+	suite.Require().Equal("namespace-admins", secret.Annotations["owner"])
+	suite.Require().Equal("ecr", secret.Annotations[common.RegistryKindsAnnotation])
+	suite.Require().Equal("prod", secret.Annotations[common.SourcesAnnotation])
+	suite.Require().Equal("2030-01-01T00:00:00Z", secret.Annotations[common.ExpiresAtAnnotation])
+	suite.Require().NotEmpty(secret.Annotations[common.IssuedAtAnnotation])
+}
+
+func (suite *HandlerSuite) TestCompileSecretMetadataFromConfiguredRegistries() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	handlerConfig := &config.Config{
+		Registries: []config.Registry{{Name: "prod", Kind: "ecr"}, {Name: "dev", Kind: "ecr"}},
+		Targets:    []config.Target{{SecretName: "{{ .Registry }}-pull", Namespace: "namespace"}},
+	}
+	suite.Require().NoError(handlerConfig.EnrichAndValidate())
+	target := &handlerConfig.Targets[0]
+
+	prodRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "prod.mock.com")
+	devRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "dev.mock.com")
+	prodSource := &Source{Name: "prod", Kind: "ecr", Registry: prodRegistry}
+	devSource := &Source{Name: "dev", Kind: "ecr", Registry: devRegistry}
+	handler, err := NewHandler(loggerInstance,
+		fake.NewSimpleClientset(),
+		[]*Source{prodSource, devSource},
+		[]*config.Target{target})
+	suite.Require().NoError(err)
+
+	// the name stays the same while a registry has no token
+	prodRegistry.On("GetAuthToken").Return(&registry.Token{Auth: "auth", RegistryUri: "prod.mock.com"}, nil).Once()
+	suite.Require().NoError(handler.refreshToken(context.Background(), prodSource))
+
+	secret, err := handler.sinks[target].(*sinkkubernetes.Sink).CompileSecret(handler.getTargetCredentials(target))
+	suite.Require().NoError(err)
+	suite.Require().Equal("prod-dev-pull", secret.Name)
+
+	// names kubernetes would reject fail the config
+	handlerConfig.Targets[0].SecretName = "{{ .Registry }}_pull"
+	suite.Require().Error(handlerConfig.EnrichAndValidate())
+}
+
+func (suite *HandlerSuite) TestSync() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	goodRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "good.mock.com")
+	badRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "bad.mock.com")
+	goodSource := &Source{Name: "good", Registry: goodRegistry}
+	badSource := &Source{Name: "bad", Registry: badRegistry}
+	goodTarget := &config.Target{SecretName: "good", Namespace: "namespace", Registries: []string{"good"}}
+	badTarget := &config.Target{SecretName: "bad", Namespace: "namespace", Registries: []string{"bad"}}
+	mockedKubeClientSet := fake.NewSimpleClientset()
+	handler, err := NewHandler(loggerInstance,
+		mockedKubeClientSet,
+		[]*Source{goodSource, badSource},
+		[]*config.Target{goodTarget, badTarget})
+	suite.Require().NoError(err)
+
+	goodRegistry.On("GetAuthToken").Return(&registry.Token{Auth: "auth", RegistryUri: "good.mock.com"}, nil).Once()
+	badRegistry.On("GetAuthToken").Return((*registry.Token)(nil), errors.New("access denied")).Once()
+
+	ctx := context.Background()
+	err = handler.Sync(ctx)
+	suite.Require().Error(err)
+	suite.Require().Contains(err.Error(), "registry bad: access denied")
+	suite.Require().Contains(err.Error(), "secret namespace/bad: no token is available")
+
+	// the good secret is synced regardless
+	_, err = common.GetSecret(ctx, mockedKubeClientSet, "namespace", "good")
+	suite.Require().NoError(err)
+}
+
+func (suite *HandlerSuite) TestSyncFansOutToRegisteredSinks() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "ecr.mock.com")
+	source := &Source{Name: "mock", Kind: "ecr", Registry: mockedRegistry}
+
+	memorySink := &memorySink{}
+	err := factory.RegisterSinkKind("memory", func(parentLogger logger.Logger,
+		kubeClientSet kubernetes.Interface,
+		target *config.Target) (sink.Sink, error) {
+		return memorySink, nil
+	})
+	suite.Require().NoError(err)
+	defer factory.UnregisterSinkKind("memory")
+
+	secretTarget := &config.Target{SecretName: "secret", Namespace: "namespace"}
+	memoryTarget := &config.Target{Kind: "memory"}
+	mockedKubeClientSet := fake.NewSimpleClientset()
+	handler, err := NewHandler(loggerInstance,
+		mockedKubeClientSet,
+		[]*Source{source},
+		[]*config.Target{secretTarget, memoryTarget})
+	suite.Require().NoError(err)
+
+	mockedRegistry.On("GetAuthToken").Return(&registry.Token{Auth: "auth", RegistryUri: "ecr.mock.com"}, nil).Once()
+	ctx := context.Background()
+	suite.Require().NoError(handler.Sync(ctx))
+
+	_, err = common.GetSecret(ctx, mockedKubeClientSet, "namespace", "secret")
+	suite.Require().NoError(err)
+	suite.Require().Equal([]string{"mock"}, memorySink.credentials.Registries)
+	suite.Require().Equal("auth", memorySink.credentials.Tokens[0].Auth)
+}
+
+func (suite *HandlerSuite) TestSyncNotifiesRefreshFailures() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "ecr.mock.com")
+	source := &Source{Name: "prod", Registry: mockedRegistry}
+	target := &config.Target{SecretName: "secret", Namespace: "namespace"}
+	handler, err := NewHandler(loggerInstance, fake.NewSimpleClientset(), []*Source{source}, []*config.Target{target})
+	suite.Require().NoError(err)
+
+	recordingNotifier := &recordingNotifier{}
+	handler.SetNotifiers([]notifier.Notifier{recordingNotifier}, 30*time.Minute)
+
+	ctx := context.Background()
+	mockedRegistry.On("GetAuthToken").Return(&registry.Token{
+		Auth:        "auth",
+		RegistryUri: "ecr.mock.com",
+		ExpiresAt:   time.Now().Add(10 * time.Minute),
+	}, nil).Once()
+	suite.Require().NoError(handler.Sync(ctx))
+	suite.Require().Empty(recordingNotifier.alerts)
+
+	// the last good token expires within the threshold
+	mockedRegistry.On("GetAuthToken").Return((*registry.Token)(nil), errors.New("access denied")).Once()
+	suite.Require().Error(handler.Sync(ctx))
+	suite.Require().Len(recordingNotifier.alerts, 2)
+	suite.Require().Equal(notifier.RefreshFailureAlertKind, recordingNotifier.alerts[0].Kind)
+	suite.Require().Contains(recordingNotifier.alerts[0].Message, "access denied")
+	suite.Require().Equal(notifier.NearExpiryAlertKind, recordingNotifier.alerts[1].Kind)
+	suite.Require().Equal("prod", recordingNotifier.alerts[1].Registry)
+
+	// failing the same way again is not alerted of again, failing otherwise is
+	mockedRegistry.On("GetAuthToken").Return((*registry.Token)(nil), errors.New("access denied")).Once()
+	suite.Require().Error(handler.Sync(ctx))
+	suite.Require().Len(recordingNotifier.alerts, 2)
+
+	mockedRegistry.On("GetAuthToken").Return((*registry.Token)(nil), errors.New("throttled")).Once()
+	suite.Require().Error(handler.Sync(ctx))
+	suite.Require().Len(recordingNotifier.alerts, 3)
+	suite.Require().Contains(recordingNotifier.alerts[2].Message, "throttled")
+}
+
+func (suite *HandlerSuite) TestNotifyRefreshFailureInBackground() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "ecr.mock.com")
+	source := &Source{Name: "prod", Registry: mockedRegistry}
+	handler, err := NewHandler(loggerInstance, nil, []*Source{source}, nil)
+	suite.Require().NoError(err)
+
+	blockingNotifier := &blockingNotifier{release: make(chan struct{})}
+	handler.SetNotifiers([]notifier.Notifier{blockingNotifier}, 30*time.Minute)
+
+	// a notifier that does not reply does not hold back the refresher
+	handler.notifyRefreshFailure(context.Background(), source, errors.New("access denied"))
+	close(blockingNotifier.release)
+	handler.notificationsWaitGroup.Wait()
+}
+
+func (suite *HandlerSuite) TestSyncKeepsSecretWhenVerificationFails() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+
+	// a registry accepting a single password
+	registryServer := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter,
+		request *http.Request) {
+		if username, password, _ := request.BasicAuth(); username != "AWS" || password != "good" {
+			responseWriter.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		responseWriter.WriteHeader(http.StatusOK)
+	}))
+	defer registryServer.Close()
+	registryHost := strings.TrimPrefix(registryServer.URL, "http://")
+
+	tokenVerifier, err := verifier.NewVerifier(loggerInstance, verifier.Options{PlainHTTP: true})
+	suite.Require().NoError(err)
+
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", registryHost)
+	source := &Source{Name: "prod", Registry: mockedRegistry, Verifier: tokenVerifier}
+	target := &config.Target{SecretName: "pull", Namespace: "namespace"}
+	mockedKubeClientSet := fake.NewSimpleClientset()
+	handler, err := NewHandler(loggerInstance, mockedKubeClientSet, []*Source{source}, []*config.Target{target})
+	suite.Require().NoError(err)
+
+	ctx := context.Background()
+	mockedRegistry.On("GetAuthToken").
+		Return(&registry.Token{Username: "AWS", Password: "good", RegistryUri: registryHost}, nil).
+		Once()
+	suite.Require().NoError(handler.Sync(ctx))
+
+	// a token the registry rejects is not published
+	mockedRegistry.On("GetAuthToken").
+		Return(&registry.Token{Username: "AWS", Password: "bad", RegistryUri: registryHost}, nil).
+		Once()
+	err = handler.Sync(ctx)
+	suite.Require().Error(err)
+	suite.Require().Contains(err.Error(), "registry prod: Registry rejected the credentials")
+
+	secret, err := common.GetSecret(ctx, mockedKubeClientSet, "namespace", "pull")
+	suite.Require().NoError(err)
+	dockerConfigJSON := common.DockerConfigJSON{}
+	suite.Require().NoError(json.Unmarshal(secret.Data[v1.DockerConfigJsonKey], &dockerConfigJSON))
+	suite.Require().Equal("good", dockerConfigJSON.Auths[registryHost].Password)
+}
+
+func (suite *HandlerSuite) TestCleanup() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "ecr.mock.com")
+	source := &Source{Name: "mock", Registry: mockedRegistry}
+	ownedTarget := &config.Target{SecretName: "owned", Namespace: "namespace"}
+	mergedTarget := &config.Target{SecretName: "merged", Namespace: "namespace", Merge: true}
+
+	mergedSecret, err := common.CompileRegistryAuthSecret("merged", "namespace", []*registry.Token{
+		{Auth: "docker hub auth", RegistryUri: "docker.io"},
+	})
+	suite.Require().NoError(err)
+	mergedSecret.Annotations = nil
+
+	mockedKubeClientSet := fake.NewSimpleClientset(mergedSecret, &v1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "default",
+			Namespace: "namespace",
+		},
+		ImagePullSecrets: []v1.LocalObjectReference{{Name: "owned"}, {Name: "merged"}},
+	})
+	handler, err := NewHandler(loggerInstance,
+		mockedKubeClientSet,
+		[]*Source{source},
+		[]*config.Target{ownedTarget, mergedTarget})
+	suite.Require().NoError(err)
+
+	ctx := context.Background()
+	mockedRegistry.On("GetAuthToken").Return(&registry.Token{Auth: "auth", RegistryUri: "ecr.mock.com"}, nil).Once()
+	suite.Require().NoError(handler.refreshToken(ctx, source))
+	suite.Require().NoError(handler.writeTarget(ctx, ownedTarget))
+	suite.Require().NoError(handler.writeTarget(ctx, mergedTarget))
+
+	suite.Require().NoError(handler.Cleanup(ctx))
+
+	// owned secret is gone, along with its service account reference
+	_, err = common.GetSecret(ctx, mockedKubeClientSet, "namespace", "owned")
+	suite.Require().True(apierrors.IsNotFound(errors.RootCause(err)))
+
+	serviceAccount, err := mockedKubeClientSet.CoreV1().ServiceAccounts("namespace").Get(ctx,
+		"default",
+		metav1.GetOptions{})
+	suite.Require().NoError(err)
+	suite.Require().Equal([]v1.LocalObjectReference{{Name: "merged"}}, serviceAccount.ImagePullSecrets)
+
+	// merged secret only lost our entry
+	cleanedSecret, err := common.GetSecret(ctx, mockedKubeClientSet, "namespace", "merged")
+	suite.Require().NoError(err)
+	registryUris, err := common.GetDockerConfigJSONRegistryUris(cleanedSecret.Data[v1.DockerConfigJsonKey])
+	suite.Require().NoError(err)
+	suite.Require().Equal([]string{"docker.io"}, registryUris)
+	suite.Require().NotContains(cleanedSecret.Labels, common.MergedLabel)
+}
+
+func (suite *HandlerSuite) TestCleanupWithoutTokens() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	mockedRegistry, _ := mock.NewRegistry(loggerInstance, "", "", "", "ecr.mock.com")
+	source := &Source{Name: "mock", Registry: mockedRegistry, RegistryUri: "ecr.mock.com"}
+	secretTarget := &config.Target{SecretName: "{{ .Registry }}-pull", Namespace: "namespace"}
+	fileTarget := &config.Target{
+		Path:   filepath.Join(suite.T().TempDir(), "config.json"),
+		Format: common.SecretFormatDockerConfigJSON,
+		Merge:  true,
+	}
+	suite.Require().NoError(os.WriteFile(fileTarget.Path,
+		[]byte(`{"auths":{"docker.io":{"auth":"docker hub auth"},"ecr.mock.com":{"auth":"auth"}}}`),
+		0600))
+
+	// as recorded when we wrote the ecr.mock.com entry
+	suite.Require().NoError(os.WriteFile(fileTarget.Path+".owned-registries", []byte("ecr.mock.com"), 0600))
+
+	mockedKubeClientSet := fake.NewSimpleClientset(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "mock-pull", Namespace: "namespace"},
+	})
+	handler, err := NewHandler(loggerInstance,
+		mockedKubeClientSet,
+		[]*Source{source},
+		[]*config.Target{secretTarget, fileTarget})
+	suite.Require().NoError(err)
+
+	// the cleanup command fetches no token, templated names and merged entries are resolved regardless
+	ctx := context.Background()
+	suite.Require().NoError(handler.Cleanup(ctx))
+	mockedRegistry.AssertNotCalled(suite.T(), "GetAuthToken")
+
+	_, err = common.GetSecret(ctx, mockedKubeClientSet, "namespace", "mock-pull")
+	suite.Require().True(apierrors.IsNotFound(errors.RootCause(err)))
+
+	configJSON, err := os.ReadFile(fileTarget.Path)
+	suite.Require().NoError(err)
+	registryUris, err := common.GetDockerConfigJSONRegistryUris(configJSON)
+	suite.Require().NoError(err)
+	suite.Require().Equal([]string{"docker.io"}, registryUris)
+}
+
+func (suite *HandlerSuite) TestCleanupOnlyFindsOwnInstance() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	managedSecret := func(name string, instance string, writer string) *v1.Secret {
+		return &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      name,
+				Namespace: "namespace",
+				Labels: map[string]string{
+					common.ManagedByLabel: common.ManagedByLabelValue,
+					common.InstanceLabel:  instance,
+				},
+				Annotations: map[string]string{common.WriterAnnotation: writer},
+			},
+		}
+	}
+
+	for _, testCase := range []struct {
+		name                string
+		onShutdown          bool
+		expectedSecretNames []string
+	}{
+		{
+			name:                "cleanup",
+			expectedSecretNames: []string{"other-instance"},
+		},
+		{
+			name:                "onShutdown",
+			onShutdown:          true,
+			expectedSecretNames: []string{"other-instance", "replacement-write"},
+		},
+	} {
+		suite.Run(testCase.name, func() {
+			mockedKubeClientSet := fake.NewSimpleClientset(
+				managedSecret("orphan", "prod", common.GetWriter()),
+				managedSecret("replacement-write", "prod", "replacement-pod"),
+				managedSecret("other-instance", "staging", common.GetWriter()))
+			handler, err := NewHandler(loggerInstance, mockedKubeClientSet, nil, nil)
+			suite.Require().NoError(err)
+			handler.SetInstance("prod")
+
+			ctx := context.Background()
+			if testCase.onShutdown {
+				suite.Require().NoError(handler.CleanupOnShutdown(ctx))
+			} else {
+				suite.Require().NoError(handler.Cleanup(ctx))
+			}
+
+			secrets, err := common.ListSecrets(ctx, mockedKubeClientSet, "namespace", common.ManagedByLabel)
+			suite.Require().NoError(err)
+			var secretNames []string
+			for _, secret := range secrets {
+				secretNames = append(secretNames, secret.Name)
+			}
+			suite.Require().ElementsMatch(testCase.expectedSecretNames, secretNames)
+		})
+	}
+}
+
+// recordingNotifier keeps the alerts it was notified of
+type recordingNotifier struct {
+	alerts []*notifier.Alert
+}
+
+func (rn *recordingNotifier) Notify(ctx context.Context, alert *notifier.Alert) error {
+	rn.alerts = append(rn.alerts, alert)
+	return nil
+}
+
+// memorySink keeps the last credentials written to it
+type blockingNotifier struct {
+	release chan struct{}
+}
+
+func (bn *blockingNotifier) Notify(ctx context.Context, alert *notifier.Alert) error {
+	<-bn.release
+	return nil
+}
+
+type memorySink struct {
+	credentials *sink.Credentials
+}
+
+func (ms *memorySink) Write(ctx context.Context, credentials *sink.Credentials) (common.SecretOperation, error) {
+	ms.credentials = credentials
+	return common.SecretOperationUpdate, nil
+}
+
+func (ms *memorySink) Plan(ctx context.Context, credentials *sink.Credentials) (*common.SecretPlan, error) {
+	return &common.SecretPlan{Operation: common.SecretOperationUpdate, Name: "memory"}, nil
+}
+
+func (ms *memorySink) Delete(ctx context.Context, credentials *sink.Credentials) error {
+	ms.credentials = nil
+	return nil
+}
+
+func (ms *memorySink) Health(ctx context.Context) error {
+	return nil
+}
+
+func (ms *memorySink) String() string {
+	return "memory"
+}
+
 func TestHandler(t *testing.T) {
 	suite.Run(t, new(HandlerSuite))
 }
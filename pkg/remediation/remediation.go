@@ -0,0 +1,213 @@
+package remediation
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/flowcontrol"
+)
+
+const (
+
+	// OptInLabel opts the pods of a namespace in to being restarted once the credentials they failed to pull
+	// images with are refreshed
+	OptInLabel = "registry-creds-handler.v3io.io/remediate-image-pulls"
+
+	imagePullBackOffReason = "ImagePullBackOff"
+	errImagePullReason     = "ErrImagePull"
+
+	// failedEventReason is the reason of the events kubelet records failed pulls with
+	failedEventReason = "Failed"
+)
+
+// authErrorPattern matches the messages of pulls failing on missing or expired credentials, as reported by the
+// container runtimes. Status codes are only matched along with their reason, and phrases on word boundaries, so
+// that image references (e.g.: a tag or digest containing 401) are not mistaken for them
+var authErrorPattern = regexp.MustCompile(`(?i)\b(401 unauthorized|403 forbidden|unauthorized|` +
+	`authentication required|authorization failed|no basic auth credentials|pull access denied)\b|\bdenied:`)
+
+// Remediator restarts pods stuck pulling images with expired credentials once their pull secret is refreshed,
+// so that they recover without waiting for the kubelet pull backoff. Only pods owned by a controller, in
+// namespaces labeled with OptInLabel, are deleted so that their controller recreates them
+type Remediator struct {
+	logger        logger.Logger
+	kubeClientSet kubernetes.Interface
+	rateLimiter   flowcontrol.RateLimiter
+}
+
+func NewRemediator(parentLogger logger.Logger,
+	kubeClientSet kubernetes.Interface,
+	maxPodsPerMinute int64) (*Remediator, error) {
+
+	if kubeClientSet == nil {
+		return nil, errors.New("Kubernetes client is required")
+	}
+	if maxPodsPerMinute <= 0 {
+		return nil, errors.New("Max pods per minute must be positive")
+	}
+
+	return &Remediator{
+		logger:        parentLogger.GetChild("remediator"),
+		kubeClientSet: kubeClientSet,
+		rateLimiter:   flowcontrol.NewTokenBucketRateLimiter(float32(maxPodsPerMinute)/60, int(maxPodsPerMinute)),
+	}, nil
+}
+
+// Remediate deletes the pods of namespace referring to one of secretNames (e.g.: the versions of a rotated
+// secret) that failed pulling an image of one of registryUris on an authentication error, returning their
+// names. Pods over the rate limit are left to kubelet
+func (r *Remediator) Remediate(ctx context.Context,
+	namespace string,
+	secretNames []string,
+	registryUris []string) ([]string, error) {
+
+	namespaceObject, err := r.kubeClientSet.CoreV1().Namespaces().Get(ctx, namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to get namespace: %s", namespace)
+	}
+	if namespaceObject.Labels[OptInLabel] != "true" {
+		return nil, nil
+	}
+
+	podList, err := r.kubeClientSet.CoreV1().Pods(namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list pods")
+	}
+
+	var candidatePods []*v1.Pod
+	for index := range podList.Items {
+		pod := &podList.Items[index]
+		if metav1.GetControllerOf(pod) == nil ||
+			pod.DeletionTimestamp != nil ||
+			!refersToSecret(pod, secretNames) ||
+			len(getFailedPullImages(pod, registryUris)) == 0 {
+			continue
+		}
+		candidatePods = append(candidatePods, pod)
+	}
+	if len(candidatePods) == 0 {
+		return nil, nil
+	}
+
+	failureMessages, err := r.getPullFailureMessages(ctx, namespace)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get pull failure messages")
+	}
+
+	var remediatedPodNames []string
+	for _, pod := range candidatePods {
+		if !isAuthError(pod, failureMessages[pod.UID]) {
+			continue
+		}
+
+		if !r.rateLimiter.TryAccept() {
+			r.logger.WarnWithCtx(ctx, "Remediation rate limit reached, leaving pod to kubelet",
+				"namespace", namespace,
+				"pod", pod.Name)
+			continue
+		}
+
+		if err := r.kubeClientSet.CoreV1().Pods(namespace).Delete(ctx, pod.Name, metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &pod.UID},
+		}); err != nil {
+			return remediatedPodNames, errors.Wrapf(err, "Failed to delete pod: %s", pod.Name)
+		}
+
+		r.logger.InfoWithCtx(ctx, "Deleted pod stuck pulling images",
+			"namespace", namespace,
+			"pod", pod.Name,
+			"images", getFailedPullImages(pod, registryUris))
+		remediatedPodNames = append(remediatedPodNames, pod.Name)
+	}
+
+	return remediatedPodNames, nil
+}
+
+// getPullFailureMessages returns the messages of the failed pull events of the namespace pods, by pod UID
+func (r *Remediator) getPullFailureMessages(ctx context.Context, namespace string) (map[types.UID][]string, error) {
+	eventList, err := r.kubeClientSet.CoreV1().Events(namespace).List(ctx, metav1.ListOptions{
+		FieldSelector: fmt.Sprintf("involvedObject.kind=Pod,reason=%s", failedEventReason),
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list events")
+	}
+
+	failureMessages := map[types.UID][]string{}
+	for _, event := range eventList.Items {
+		if event.InvolvedObject.Kind != "Pod" || event.Reason != failedEventReason {
+			continue
+		}
+		failureMessages[event.InvolvedObject.UID] = append(failureMessages[event.InvolvedObject.UID],
+			event.Message)
+	}
+	return failureMessages, nil
+}
+
+// getFailedPullImages returns the images of registryUris the pod containers are waiting to pull
+func getFailedPullImages(pod *v1.Pod, registryUris []string) []string {
+	var images []string
+	for _, containerStatuses := range [][]v1.ContainerStatus{
+		pod.Status.InitContainerStatuses,
+		pod.Status.ContainerStatuses,
+	} {
+		for _, containerStatus := range containerStatuses {
+			if containerStatus.State.Waiting == nil {
+				continue
+			}
+			if reason := containerStatus.State.Waiting.Reason; reason != imagePullBackOffReason &&
+				reason != errImagePullReason {
+				continue
+			}
+			for _, registryUri := range registryUris {
+				if common.MatchRegistryUri(registryUri, containerStatus.Image) {
+					images = append(images, containerStatus.Image)
+					break
+				}
+			}
+		}
+	}
+	return images
+}
+
+// isAuthError returns whether the pod failed pulling on an authentication error, by its containers waiting
+// messages (set on ErrImagePull) or its failed pull events (ImagePullBackOff only says it is backing off)
+func isAuthError(pod *v1.Pod, failureMessages []string) bool {
+	messages := append([]string{}, failureMessages...)
+	for _, containerStatuses := range [][]v1.ContainerStatus{
+		pod.Status.InitContainerStatuses,
+		pod.Status.ContainerStatuses,
+	} {
+		for _, containerStatus := range containerStatuses {
+			if containerStatus.State.Waiting != nil {
+				messages = append(messages, containerStatus.State.Waiting.Message)
+			}
+		}
+	}
+
+	for _, message := range messages {
+		if authErrorPattern.MatchString(message) {
+			return true
+		}
+	}
+	return false
+}
+
+func refersToSecret(pod *v1.Pod, secretNames []string) bool {
+	for _, imagePullSecret := range pod.Spec.ImagePullSecrets {
+		for _, secretName := range secretNames {
+			if imagePullSecret.Name == secretName {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package remediation
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+
+	"github.com/nuclio/logger"
+	"github.com/stretchr/testify/suite"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type RemediationSuite struct {
+	suite.Suite
+	logger logger.Logger
+}
+
+func (suite *RemediationSuite) SetupTest() {
+	suite.logger, _ = common.CreateLogger("test", true, os.Stdout, "humanreadable")
+}
+
+func (suite *RemediationSuite) TestRemediate() {
+	kubeClientSet := fake.NewSimpleClientset(
+		suite.compileNamespace("team", true),
+		suite.compilePod("stuck", true, "registry.mock.com/team/app:1.0", imagePullBackOffReason, ""),
+		suite.compileEvent("stuck", "Failed to pull image: 401 Unauthorized"),
+		suite.compilePod("pulling", true, "registry.mock.com/team/app:1.0", errImagePullReason,
+			"failed to resolve reference: pull access denied"),
+		suite.compilePod("unowned", false, "registry.mock.com/team/app:1.0", imagePullBackOffReason, ""),
+		suite.compileEvent("unowned", "Failed to pull image: 401 Unauthorized"),
+		suite.compilePod("other-registry", true, "quay.io/team/app:1.0", imagePullBackOffReason, ""),
+		suite.compileEvent("other-registry", "Failed to pull image: 401 Unauthorized"),
+		suite.compilePod("missing-image", true, "registry.mock.com/team/app:1.0", imagePullBackOffReason, ""),
+		suite.compileEvent("missing-image", "Failed to pull image: manifest unknown"),
+	)
+
+	remediator, err := NewRemediator(suite.logger, kubeClientSet, 10)
+	suite.Require().NoError(err)
+
+	podNames, err := remediator.Remediate(context.Background(),
+		"team",
+		[]string{"pull-secret"},
+		[]string{"registry.mock.com"})
+	suite.Require().NoError(err)
+	suite.Require().ElementsMatch([]string{"stuck", "pulling"}, podNames)
+
+	podList, err := kubeClientSet.CoreV1().Pods("team").List(context.Background(), metav1.ListOptions{})
+	suite.Require().NoError(err)
+	var remainingPodNames []string
+	for _, pod := range podList.Items {
+		remainingPodNames = append(remainingPodNames, pod.Name)
+	}
+	suite.Require().ElementsMatch([]string{"unowned", "other-registry", "missing-image"}, remainingPodNames)
+}
+
+func (suite *RemediationSuite) TestRemediateRequiresOptIn() {
+	kubeClientSet := fake.NewSimpleClientset(
+		suite.compileNamespace("team", false),
+		suite.compilePod("stuck", true, "registry.mock.com/team/app:1.0", imagePullBackOffReason, ""),
+		suite.compileEvent("stuck", "Failed to pull image: 401 Unauthorized"),
+	)
+
+	remediator, err := NewRemediator(suite.logger, kubeClientSet, 10)
+	suite.Require().NoError(err)
+
+	podNames, err := remediator.Remediate(context.Background(),
+		"team",
+		[]string{"pull-secret"},
+		[]string{"registry.mock.com"})
+	suite.Require().NoError(err)
+	suite.Require().Empty(podNames)
+
+	_, err = kubeClientSet.CoreV1().Pods("team").Get(context.Background(), "stuck", metav1.GetOptions{})
+	suite.Require().NoError(err)
+}
+
+func (suite *RemediationSuite) TestRemediateIsRateLimited() {
+	kubeClientSet := fake.NewSimpleClientset(
+		suite.compileNamespace("team", true),
+		suite.compilePod("first", true, "registry.mock.com/team/app:1.0", errImagePullReason, "401 Unauthorized"),
+		suite.compilePod("second", true, "registry.mock.com/team/app:1.0", errImagePullReason, "401 Unauthorized"),
+	)
+
+	remediator, err := NewRemediator(suite.logger, kubeClientSet, 1)
+	suite.Require().NoError(err)
+
+	podNames, err := remediator.Remediate(context.Background(),
+		"team",
+		[]string{"pull-secret"},
+		[]string{"registry.mock.com"})
+	suite.Require().NoError(err)
+	suite.Require().Len(podNames, 1)
+}
+
+func (suite *RemediationSuite) TestIsAuthError() {
+	for _, testCase := range []struct {
+		message           string
+		expectedAuthError bool
+	}{
+		{message: "Failed to pull image: 401 Unauthorized", expectedAuthError: true},
+		{message: "unexpected status code 403 Forbidden", expectedAuthError: true},
+		{message: "no basic auth credentials", expectedAuthError: true},
+		{message: "denied: Your authorization token has expired", expectedAuthError: true},
+		{message: `Failed to pull image "registry.mock.com/team/app:build-4013": not found`},
+		{message: `Failed to pull image "registry.mock.com/team/app@sha256:4010403f": manifest unknown`},
+		{message: "Back-off pulling image"},
+	} {
+		suite.Run(testCase.message, func() {
+			suite.Require().Equal(testCase.expectedAuthError, isAuthError(&v1.Pod{}, []string{testCase.message}))
+		})
+	}
+}
+
+func (suite *RemediationSuite) compileNamespace(name string, optedIn bool) runtime.Object {
+	namespace := &v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+	if optedIn {
+		namespace.Labels = map[string]string{OptInLabel: "true"}
+	}
+	return namespace
+}
+
+func (suite *RemediationSuite) compilePod(name string,
+	owned bool,
+	image string,
+	waitingReason string,
+	waitingMessage string) runtime.Object {
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "team",
+			UID:       types.UID(name + "-uid"),
+		},
+		Spec: v1.PodSpec{
+			Containers:       []v1.Container{{Name: "app", Image: image}},
+			ImagePullSecrets: []v1.LocalObjectReference{{Name: "pull-secret"}},
+		},
+		Status: v1.PodStatus{
+			ContainerStatuses: []v1.ContainerStatus{
+				{
+					Name:  "app",
+					Image: image,
+					State: v1.ContainerState{
+						Waiting: &v1.ContainerStateWaiting{Reason: waitingReason, Message: waitingMessage},
+					},
+				},
+			},
+		},
+	}
+	if owned {
+		controller := true
+		pod.OwnerReferences = []metav1.OwnerReference{
+			{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app", UID: "replicaset-uid", Controller: &controller},
+		}
+	}
+	return pod
+}
+
+func (suite *RemediationSuite) compileEvent(podName string, message string) runtime.Object {
+	return &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{Name: podName + ".event", Namespace: "team"},
+		InvolvedObject: v1.ObjectReference{
+			Kind:      "Pod",
+			Name:      podName,
+			Namespace: "team",
+			UID:       types.UID(podName + "-uid"),
+		},
+		Reason:  failedEventReason,
+		Message: message,
+	}
+}
+
+func TestRemediationSuite(t *testing.T) {
+	suite.Run(t, new(RemediationSuite))
+}
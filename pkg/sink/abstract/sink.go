@@ -0,0 +1,27 @@
+package abstract
+
+import (
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+
+	"github.com/nuclio/logger"
+)
+
+type Sink struct {
+	Logger logger.Logger
+	sink   sink.Sink
+	Target *config.Target
+}
+
+func NewSink(loggerInstance logger.Logger, sink sink.Sink, target *config.Target) (*Sink, error) {
+	return &Sink{
+		Logger: loggerInstance.GetChild("sink"),
+		sink:   sink,
+		Target: target,
+	}, nil
+}
+
+// String describes the sink by its target
+func (as *Sink) String() string {
+	return as.Target.String()
+}
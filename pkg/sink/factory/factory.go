@@ -0,0 +1,102 @@
+package factory
+
+import (
+	"sync"
+
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+	"github.com/v3io/registry-creds-handler/pkg/sink/file"
+	sinkkubernetes "github.com/v3io/registry-creds-handler/pkg/sink/kubernetes"
+	"github.com/v3io/registry-creds-handler/pkg/sink/vault"
+	sinkwebhook "github.com/v3io/registry-creds-handler/pkg/sink/webhook"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Creator creates a sink of a registered kind
+type Creator func(parentLogger logger.Logger,
+	kubeClientSet kubernetes.Interface,
+	target *config.Target) (sink.Sink, error)
+
+var (
+	creators     = map[string]Creator{}
+	creatorsLock sync.RWMutex
+)
+
+// RegisterSinkKind registers a sink kind, so that embedders can add their own destinations to targets of that
+// kind without forking the handler. Built in kinds can not be overridden
+func RegisterSinkKind(sinkKind string, creator Creator) error {
+	for _, builtInSinkKind := range []string{
+		sink.KubernetesSinkKind,
+		sink.FileSinkKind,
+		sink.VaultSinkKind,
+		sink.WebhookSinkKind,
+	} {
+		if sinkKind == builtInSinkKind {
+			return errors.Errorf("Sink kind is built in: %s", sinkKind)
+		}
+	}
+
+	creatorsLock.Lock()
+	defer creatorsLock.Unlock()
+
+	if _, found := creators[sinkKind]; found {
+		return errors.Errorf("Sink kind is already registered: %s", sinkKind)
+	}
+	creators[sinkKind] = creator
+	return nil
+}
+
+// UnregisterSinkKind unregisters a sink kind, e.g.: of tests registering their own
+func UnregisterSinkKind(sinkKind string) {
+	creatorsLock.Lock()
+	defer creatorsLock.Unlock()
+
+	delete(creators, sinkKind)
+}
+
+// CreateSink creates a sink based on the target kind
+func CreateSink(parentLogger logger.Logger,
+	kubeClientSet kubernetes.Interface,
+	target *config.Target) (sink.Sink, error) {
+
+	var newSink sink.Sink
+	var err error
+
+	switch target.GetKind() {
+	case sink.KubernetesSinkKind:
+		newSink, err = sinkkubernetes.NewSink(parentLogger, kubeClientSet, target)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create kubernetes kind")
+		}
+	case sink.FileSinkKind:
+		newSink, err = file.NewSink(parentLogger, target)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create file kind")
+		}
+	case sink.VaultSinkKind:
+		newSink, err = vault.NewSink(parentLogger, target)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create vault kind")
+		}
+	case sink.WebhookSinkKind:
+		newSink, err = sinkwebhook.NewSink(parentLogger, target)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to create webhook kind")
+		}
+	default:
+		creatorsLock.RLock()
+		creator, found := creators[target.GetKind()]
+		creatorsLock.RUnlock()
+		if !found {
+			return nil, errors.Errorf("Unsupported sink kind: %s", target.GetKind())
+		}
+		if newSink, err = creator(parentLogger, kubeClientSet, target); err != nil {
+			return nil, errors.Wrapf(err, "Failed to create %s kind", target.GetKind())
+		}
+	}
+
+	return newSink, nil
+}
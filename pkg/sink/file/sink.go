@@ -0,0 +1,140 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+	"github.com/v3io/registry-creds-handler/pkg/sink/abstract"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+)
+
+// Sink publishes credentials as a docker config json file, e.g.: kubelet's config.json or a build tool's
+type Sink struct {
+	*abstract.Sink
+
+	// hookFailed is set while the hook failed to run since the file was last written, so that it is run
+	// again on the next write even if the file is unchanged
+	hookFailed     bool
+	hookFailedLock sync.Mutex
+}
+
+func NewSink(parentLogger logger.Logger, target *config.Target) (*Sink, error) {
+	if target.Path == "" {
+		return nil, errors.New("Path must not be empty")
+	}
+
+	newSink := &Sink{}
+
+	// create base
+	abstractSink, err := abstract.NewSink(parentLogger.GetChild("file"), newSink, target)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create abstract sink")
+	}
+
+	newSink.Sink = abstractSink
+	return newSink, nil
+}
+
+// Write writes the file, merging into it if configured to, and runs the hook when it changed or when its
+// last run failed
+func (s *Sink) Write(ctx context.Context, credentials *sink.Credentials) (common.SecretOperation, error) {
+	fileConfig, err := s.compileFile(credentials)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to compile file")
+	}
+
+	operation, err := common.WriteDockerConfigJSONFile(s.Target.Path,
+		fileConfig,
+		s.Target.Merge,
+		s.Target.GetFileMode())
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to write file")
+	}
+
+	if s.Target.Hook == nil {
+		return operation, nil
+	}
+
+	s.hookFailedLock.Lock()
+	defer s.hookFailedLock.Unlock()
+
+	if operation != common.SecretOperationUnchanged || s.hookFailed {
+		if err := s.Target.Hook.Run(ctx, s.Target.Path); err != nil {
+			s.hookFailed = true
+
+			// the file was written regardless
+			return operation, errors.Wrap(err, "Failed to run file hook")
+		}
+		s.hookFailed = false
+		s.Logger.DebugWithCtx(ctx, "File hook ran successfully", "Path", s.Target.Path)
+	}
+
+	return operation, nil
+}
+
+// Plan returns what Write would change in the file
+func (s *Sink) Plan(ctx context.Context, credentials *sink.Credentials) (*common.SecretPlan, error) {
+	fileConfig, err := s.compileFile(credentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to compile file")
+	}
+
+	plan, err := common.PlanWriteDockerConfigJSONFile(s.Target.Path, fileConfig, s.Target.Merge)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to plan file %s", s.Target.Path)
+	}
+	return plan, nil
+}
+
+// Delete removes the file, or only the entries we recorded writing to a merged file
+func (s *Sink) Delete(ctx context.Context, credentials *sink.Credentials) error {
+	if !s.Target.Merge {
+		if err := common.RemoveFile(s.Target.Path); err != nil {
+			return errors.Wrap(err, "Failed to remove file")
+		}
+		return nil
+	}
+
+	// entries of the same registries written by others are kept
+	if _, err := common.RemoveDockerConfigJSONFileAuths(s.Target.Path, s.Target.GetFileMode()); err != nil {
+		return errors.Wrap(err, "Failed to remove entries from file")
+	}
+	return nil
+}
+
+// Health checks the file dir can be written to
+func (s *Sink) Health(ctx context.Context) error {
+	dir := filepath.Dir(s.Target.Path)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "Failed to create dir: %s", dir)
+	}
+
+	healthFile, err := os.CreateTemp(dir, ".health-*")
+	if err != nil {
+		return errors.Wrapf(err, "Dir is not writable: %s", dir)
+	}
+	healthFile.Close()
+	if err := os.Remove(healthFile.Name()); err != nil {
+		return errors.Wrap(err, "Failed to remove health file")
+	}
+	return nil
+}
+
+// compileFile compiles the file contents in the target format
+func (s *Sink) compileFile(credentials *sink.Credentials) ([]byte, error) {
+	secret, err := common.CompileSecret("", "", s.Target.Format, "", "", credentials.Tokens)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to compile credentials")
+	}
+	for _, fileConfig := range secret.Data {
+		return fileConfig, nil
+	}
+	return nil, errors.Errorf("Format %s has no data", s.Target.Format)
+}
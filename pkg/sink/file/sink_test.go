@@ -0,0 +1,63 @@
+package file
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SinkSuite struct {
+	suite.Suite
+}
+
+func (suite *SinkSuite) TestWriteRetriesFailedHook() {
+	tempDir := suite.T().TempDir()
+	failPath := filepath.Join(tempDir, "fail")
+	hookOutputPath := filepath.Join(tempDir, "hook")
+	suite.Require().NoError(os.WriteFile(failPath, nil, 0600))
+
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	fileSink, err := NewSink(loggerInstance, &config.Target{
+		Path:   filepath.Join(tempDir, "config.json"),
+		Format: common.SecretFormatDockerConfigJSON,
+		Hook: &common.FileHook{
+			Command: []string{"sh", "-c", "test ! -e " + failPath + " && echo -n ran >> " + hookOutputPath},
+		},
+	})
+	suite.Require().NoError(err)
+
+	credentials := &sink.Credentials{
+		Tokens: []*registry.Token{{Auth: "ecr auth", RegistryUri: "ecr.mock.com"}},
+	}
+
+	// the file is written but the hook fails
+	operation, err := fileSink.Write(context.Background(), credentials)
+	suite.Require().Error(err)
+	suite.Require().Equal(common.SecretOperationCreate, operation)
+
+	// the file is unchanged, the hook is run again
+	suite.Require().NoError(os.Remove(failPath))
+	operation, err = fileSink.Write(context.Background(), credentials)
+	suite.Require().NoError(err)
+	suite.Require().Equal(common.SecretOperationUnchanged, operation)
+
+	// and only once it succeeded
+	_, err = fileSink.Write(context.Background(), credentials)
+	suite.Require().NoError(err)
+
+	hookOutput, err := os.ReadFile(hookOutputPath)
+	suite.Require().NoError(err)
+	suite.Require().Equal("ran", string(hookOutput))
+}
+
+func TestSink(t *testing.T) {
+	suite.Run(t, new(SinkSuite))
+}
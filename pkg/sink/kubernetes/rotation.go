@@ -0,0 +1,260 @@
+package kubernetes
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+
+	"github.com/nuclio/errors"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+)
+
+// versionHashLength is how many hex digits of the data hash versioned secret names end with
+const versionHashLength = 10
+
+// writeVersion creates the immutable secret version unless it exists, moves the service accounts referring to
+// previous versions to it and deletes the versions superseded for longer than the grace period
+func (s *Sink) writeVersion(ctx context.Context, secret *v1.Secret) (common.SecretOperation, error) {
+	operation := common.SecretOperationUnchanged
+
+	if _, err := common.GetSecret(ctx, s.kubeClientSet, secret.Namespace, secret.Name); err != nil {
+		if !apierrors.IsNotFound(err) {
+			return "", errors.Wrap(err, "Failed to get secret version")
+		}
+
+		s.Logger.DebugWithCtx(ctx, "Creating secret version",
+			"SecretName", secret.Name,
+			"Namespace", secret.Namespace)
+
+		secret = secret.DeepCopy()
+		secret.Annotations[common.CreatedAtAnnotation] = s.now().UTC().Format(time.RFC3339)
+		if err := common.CreateSecret(ctx, s.kubeClientSet, secret); err != nil {
+			if !apierrors.IsAlreadyExists(err) {
+				return "", errors.Wrap(err, "Failed to create secret version")
+			}
+
+			// another replica created it meanwhile, and reports it
+			s.Logger.DebugWithCtx(ctx, "Secret version was created meanwhile",
+				"SecretName", secret.Name,
+				"Namespace", secret.Namespace)
+		} else {
+			operation = common.SecretOperationCreate
+		}
+	}
+
+	versions, err := s.listVersions(ctx, secret.Labels[common.VersionOfLabel])
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to list secret versions")
+	}
+
+	var previousVersionNames []string
+	for _, version := range versions {
+		if version.Name != secret.Name {
+			previousVersionNames = append(previousVersionNames, version.Name)
+		}
+	}
+
+	serviceAccountNames, err := common.ReplaceServiceAccountsImagePullSecrets(ctx,
+		s.kubeClientSet,
+		secret.Namespace,
+		previousVersionNames,
+		secret.Name,
+		s.Target.Rotation.ServiceAccounts)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to move service accounts to secret version")
+	}
+	if len(serviceAccountNames) > 0 {
+		s.Logger.InfoWithCtx(ctx, "Service accounts moved to secret version",
+			"SecretName", secret.Name,
+			"Namespace", secret.Namespace,
+			"ServiceAccounts", serviceAccountNames)
+	}
+
+	// previous versions are deleted once superseded for longer than the grace period, and no pod refers to them
+	if err := s.deleteSupersededVersions(ctx, versions, secret.Name); err != nil {
+		return "", errors.Wrap(err, "Failed to delete superseded secret versions")
+	}
+
+	return operation, nil
+}
+
+// deleteSupersededVersions deletes the versions superseded by a newer one for longer than the grace period,
+// unless a pod still refers to them. Pod imagePullSecrets are immutable, so a pod admitted with a version keeps
+// pulling with it for as long as it runs. The latest version is never deleted
+func (s *Sink) deleteSupersededVersions(ctx context.Context, versions []v1.Secret, latestVersionName string) error {
+	gracePeriod := time.Duration(s.Target.Rotation.GracePeriod) * time.Minute
+
+	// pods are only listed once a version is due for deletion
+	var referredSecretNames map[string]bool
+
+	for index, version := range versions {
+		if version.Name == latestVersionName {
+			continue
+		}
+
+		// a version is superseded once the next one was created
+		supersededAt := getVersionCreatedAt(&version)
+		if index+1 < len(versions) {
+			supersededAt = getVersionCreatedAt(&versions[index+1])
+		}
+		if s.now().Sub(supersededAt) < gracePeriod {
+			continue
+		}
+
+		if referredSecretNames == nil {
+			var err error
+			if referredSecretNames, err = s.getPodsImagePullSecretNames(ctx); err != nil {
+				return errors.Wrap(err, "Failed to get the secrets pods refer to")
+			}
+		}
+		if referredSecretNames[version.Name] {
+			s.Logger.DebugWithCtx(ctx, "Keeping superseded secret version pods refer to",
+				"SecretName", version.Name,
+				"Namespace", version.Namespace)
+			continue
+		}
+
+		if err := common.DeleteSecret(ctx, s.kubeClientSet, version.Namespace, version.Name); err != nil &&
+			!apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "Failed to delete secret version")
+		}
+		s.Logger.InfoWithCtx(ctx, "Superseded secret version deleted",
+			"SecretName", version.Name,
+			"Namespace", version.Namespace,
+			"SupersededAt", supersededAt)
+	}
+
+	return nil
+}
+
+// getPodsImagePullSecretNames returns the names of the secrets the pods of the target namespace pull images with.
+// Pods that are done running pull no more images
+func (s *Sink) getPodsImagePullSecretNames(ctx context.Context) (map[string]bool, error) {
+	podList, err := s.kubeClientSet.CoreV1().Pods(s.Target.Namespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to list pods in namespace: %s", s.Target.Namespace)
+	}
+
+	secretNames := map[string]bool{}
+	for _, pod := range podList.Items {
+		if pod.Status.Phase == v1.PodSucceeded || pod.Status.Phase == v1.PodFailed {
+			continue
+		}
+		for _, imagePullSecret := range pod.Spec.ImagePullSecrets {
+			secretNames[imagePullSecret.Name] = true
+		}
+	}
+	return secretNames, nil
+}
+
+// getVersionNames returns the names of all versions of a secret
+func (s *Sink) getVersionNames(ctx context.Context, secretName string) ([]string, error) {
+	versions, err := s.listVersions(ctx, secretName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list secret versions")
+	}
+
+	var versionNames []string
+	for _, version := range versions {
+		versionNames = append(versionNames, version.Name)
+	}
+	return versionNames, nil
+}
+
+// deleteVersions deletes all versions of a secret and removes them from service accounts imagePullSecrets
+func (s *Sink) deleteVersions(ctx context.Context, secretName string) error {
+	versions, err := s.listVersions(ctx, secretName)
+	if err != nil {
+		return errors.Wrap(err, "Failed to list secret versions")
+	}
+
+	var versionNames []string
+	for _, version := range versions {
+		if err := common.DeleteSecret(ctx, s.kubeClientSet, version.Namespace, version.Name); err != nil &&
+			!apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "Failed to delete secret version")
+		}
+		versionNames = append(versionNames, version.Name)
+	}
+	if len(versionNames) == 0 {
+		return nil
+	}
+
+	if _, err := common.RemoveServiceAccountsImagePullSecrets(ctx,
+		s.kubeClientSet,
+		s.Target.Namespace,
+		versionNames); err != nil {
+		return errors.Wrap(err, "Failed to remove secret versions from service accounts")
+	}
+	return nil
+}
+
+// listVersions lists the versions of a secret, from the oldest to the latest
+func (s *Sink) listVersions(ctx context.Context, secretName string) ([]v1.Secret, error) {
+	versions, err := common.ListSecrets(ctx,
+		s.kubeClientSet,
+		s.Target.Namespace,
+		fmt.Sprintf("%s=%s", common.VersionOfLabel, secretName))
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to list secrets")
+	}
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return getVersionCreatedAt(&versions[i]).Before(getVersionCreatedAt(&versions[j]))
+	})
+	return versions, nil
+}
+
+// compileSecretVersion returns the immutable version of a secret, named after the secret and a hash of its data
+// so that identical credentials map to the same version
+func compileSecretVersion(secret *v1.Secret) (*v1.Secret, error) {
+	if errs := validation.IsValidLabelValue(secret.Name); len(errs) > 0 {
+		return nil, errors.Errorf("Rotated secret name %s is not a valid label value: %s", secret.Name, errs[0])
+	}
+
+	dataHash := sha256.New()
+	for _, key := range getSortedDataKeys(secret.Data) {
+		dataHash.Write([]byte(key))
+		dataHash.Write([]byte{0})
+		dataHash.Write(secret.Data[key])
+		dataHash.Write([]byte{0})
+	}
+
+	immutable := true
+	version := secret.DeepCopy()
+	version.Name = fmt.Sprintf("%s-%s", secret.Name, hex.EncodeToString(dataHash.Sum(nil))[:versionHashLength])
+	version.Immutable = &immutable
+	if version.Labels == nil {
+		version.Labels = map[string]string{}
+	}
+	version.Labels[common.VersionOfLabel] = secret.Name
+	if version.Annotations == nil {
+		version.Annotations = map[string]string{}
+	}
+	return version, nil
+}
+
+func getVersionCreatedAt(version *v1.Secret) time.Time {
+	createdAt, err := time.Parse(time.RFC3339, version.Annotations[common.CreatedAtAnnotation])
+	if err != nil {
+		return version.CreationTimestamp.Time
+	}
+	return createdAt
+}
+
+func getSortedDataKeys(data map[string][]byte) []string {
+	var keys []string
+	for key := range data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
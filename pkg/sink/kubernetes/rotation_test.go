@@ -0,0 +1,192 @@
+package kubernetes
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+
+	"github.com/stretchr/testify/suite"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+type RotationSuite struct {
+	suite.Suite
+	kubeClientSet kubernetes.Interface
+	sink          *Sink
+	now           time.Time
+}
+
+func (suite *RotationSuite) SetupTest() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	suite.kubeClientSet = fake.NewSimpleClientset(
+		&v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "default", Namespace: "team"}},
+		&v1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: "builder", Namespace: "team"},
+			ImagePullSecrets: []v1.LocalObjectReference{{Name: "someone-elses"}},
+		},
+	)
+
+	var err error
+	suite.sink, err = NewSink(loggerInstance, suite.kubeClientSet, &config.Target{
+		SecretName: "pull-secret",
+		Namespace:  "team",
+		Format:     common.SecretFormatDockerConfigJSON,
+		Rotation: &config.Rotation{
+			GracePeriod:     60,
+			ServiceAccounts: []string{"default"},
+		},
+	})
+	suite.Require().NoError(err)
+
+	suite.now = time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	suite.sink.now = func() time.Time {
+		return suite.now
+	}
+}
+
+func (suite *RotationSuite) TestRotate() {
+	ctx := context.Background()
+
+	// the first version is created and attached to the configured service accounts
+	firstVersionName := suite.write("first", common.SecretOperationCreate)
+	suite.Require().Regexp(`^pull-secret-[0-9a-f]{10}$`, firstVersionName)
+	firstVersion, err := common.GetSecret(ctx, suite.kubeClientSet, "team", firstVersionName)
+	suite.Require().NoError(err)
+	suite.Require().True(*firstVersion.Immutable)
+	suite.Require().Equal("pull-secret", firstVersion.Labels[common.VersionOfLabel])
+	suite.requireImagePullSecrets("default", firstVersionName)
+	suite.requireImagePullSecrets("builder", "someone-elses")
+
+	// same credentials, same version
+	suite.now = suite.now.Add(5 * time.Minute)
+	suite.Require().Equal(firstVersionName, suite.write("first", common.SecretOperationUnchanged))
+
+	// a new version takes over the service accounts, the previous one is kept for the grace period
+	suite.now = suite.now.Add(5 * time.Minute)
+	secondVersionName := suite.write("second", common.SecretOperationCreate)
+	suite.Require().NotEqual(firstVersionName, secondVersionName)
+	suite.requireImagePullSecrets("default", secondVersionName)
+	_, err = common.GetSecret(ctx, suite.kubeClientSet, "team", firstVersionName)
+	suite.Require().NoError(err)
+
+	// once the grace period is over, the previous version is deleted
+	suite.now = suite.now.Add(61 * time.Minute)
+	suite.write("second", common.SecretOperationUnchanged)
+	_, err = common.GetSecret(ctx, suite.kubeClientSet, "team", firstVersionName)
+	suite.Require().Error(err)
+	_, err = common.GetSecret(ctx, suite.kubeClientSet, "team", secondVersionName)
+	suite.Require().NoError(err)
+
+	// deleting removes all versions, and their references
+	suite.Require().NoError(suite.sink.Delete(ctx, suite.compileCredentials("second")))
+	versions, err := suite.sink.listVersions(ctx, "pull-secret")
+	suite.Require().NoError(err)
+	suite.Require().Empty(versions)
+	suite.requireImagePullSecrets("default")
+}
+
+func (suite *RotationSuite) TestKeepVersionsPodsReferTo() {
+	ctx := context.Background()
+
+	firstVersionName := suite.write("first", common.SecretOperationCreate)
+	_, err := suite.kubeClientSet.CoreV1().Pods("team").Create(ctx, &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team"},
+		Spec: v1.PodSpec{
+			ImagePullSecrets: []v1.LocalObjectReference{{Name: firstVersionName}},
+		},
+	}, metav1.CreateOptions{})
+	suite.Require().NoError(err)
+
+	suite.now = suite.now.Add(5 * time.Minute)
+	secondVersionName := suite.write("second", common.SecretOperationCreate)
+
+	// the pod keeps pulling with the first version, which outlives the grace period
+	suite.now = suite.now.Add(61 * time.Minute)
+	suite.write("second", common.SecretOperationUnchanged)
+	_, err = common.GetSecret(ctx, suite.kubeClientSet, "team", firstVersionName)
+	suite.Require().NoError(err)
+
+	secretNames, err := suite.sink.GetSecretNames(ctx, suite.compileCredentials("second"))
+	suite.Require().NoError(err)
+	suite.Require().Equal([]string{firstVersionName, secondVersionName}, secretNames)
+
+	// once the pod is gone, so is the version
+	suite.Require().NoError(suite.kubeClientSet.CoreV1().Pods("team").Delete(ctx, "app", metav1.DeleteOptions{}))
+	suite.write("second", common.SecretOperationUnchanged)
+	_, err = common.GetSecret(ctx, suite.kubeClientSet, "team", firstVersionName)
+	suite.Require().Error(err)
+}
+
+func (suite *RotationSuite) TestVersionCreatedMeanwhile() {
+	credentials := suite.compileCredentials("first")
+	versionName, err := suite.sink.GetSecretName(credentials)
+	suite.Require().NoError(err)
+
+	// another replica creates the version once we found it missing
+	kubeClientSet := suite.kubeClientSet.(*fake.Clientset)
+	kubeClientSet.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		secret := action.(k8stesting.CreateAction).GetObject().(*v1.Secret).DeepCopy()
+		suite.Require().NoError(kubeClientSet.Tracker().Add(secret))
+		return true, nil, apierrors.NewAlreadyExists(schema.GroupResource{Resource: "secrets"}, versionName)
+	})
+
+	// it is not reported as created by us too
+	suite.Require().Equal(versionName, suite.write("first", common.SecretOperationUnchanged))
+	suite.requireImagePullSecrets("default", versionName)
+}
+
+func (suite *RotationSuite) write(password string, expectedOperation common.SecretOperation) string {
+	credentials := suite.compileCredentials(password)
+
+	operation, err := suite.sink.Write(context.Background(), credentials)
+	suite.Require().NoError(err)
+	suite.Require().Equal(expectedOperation, operation)
+
+	versionName, err := suite.sink.GetSecretName(credentials)
+	suite.Require().NoError(err)
+	return versionName
+}
+
+func (suite *RotationSuite) compileCredentials(password string) *sink.Credentials {
+	return &sink.Credentials{
+		Tokens: []*registry.Token{
+			{
+				Auth:        fmt.Sprintf("username:%s", password),
+				RegistryUri: "registry.mock.com",
+			},
+		},
+		Registries: []string{"mock"},
+		Kinds:      []string{"mock"},
+	}
+}
+
+func (suite *RotationSuite) requireImagePullSecrets(serviceAccountName string, secretNames ...string) {
+	serviceAccount, err := suite.kubeClientSet.CoreV1().ServiceAccounts("team").Get(context.Background(),
+		serviceAccountName,
+		metav1.GetOptions{})
+	suite.Require().NoError(err)
+
+	var imagePullSecretNames []string
+	for _, imagePullSecret := range serviceAccount.ImagePullSecrets {
+		imagePullSecretNames = append(imagePullSecretNames, imagePullSecret.Name)
+	}
+	suite.Require().Equal(secretNames, imagePullSecretNames)
+}
+
+func TestRotationSuite(t *testing.T) {
+	suite.Run(t, new(RotationSuite))
+}
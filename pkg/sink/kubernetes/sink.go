@@ -0,0 +1,257 @@
+package kubernetes
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+	"github.com/v3io/registry-creds-handler/pkg/sink/abstract"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Sink publishes credentials as a Kubernetes secret
+type Sink struct {
+	*abstract.Sink
+	kubeClientSet kubernetes.Interface
+	writer        string
+	now           func() time.Time
+}
+
+func NewSink(parentLogger logger.Logger, kubeClientSet kubernetes.Interface, target *config.Target) (*Sink, error) {
+	if kubeClientSet == nil {
+		return nil, errors.New("Kubernetes client is required")
+	}
+
+	newSink := &Sink{
+		kubeClientSet: kubeClientSet,
+		writer:        common.GetWriter(),
+		now:           time.Now,
+	}
+
+	// create base
+	abstractSink, err := abstract.NewSink(parentLogger.GetChild("kubernetes"), newSink, target)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create abstract sink")
+	}
+
+	newSink.Sink = abstractSink
+	return newSink, nil
+}
+
+// Write creates or updates the secret, merging into it if configured to
+func (s *Sink) Write(ctx context.Context, credentials *sink.Credentials) (common.SecretOperation, error) {
+	secret, err := s.CompileSecret(credentials)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to generate secret object")
+	}
+
+	if s.Target.Rotation != nil {
+		return s.writeVersion(ctx, secret)
+	}
+
+	s.Logger.DebugWithCtx(ctx, "Creating or updating secret",
+		"SecretName", secret.Name,
+		"Namespace", secret.Namespace,
+		"Merge", s.Target.Merge,
+		"Format", s.Target.Format)
+
+	operation, err := common.CreateOrUpdateSecret(ctx, s.kubeClientSet, secret, s.Target.Merge)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to create or update secret")
+	}
+	return operation, nil
+}
+
+// Plan returns what Write would change in the secret
+func (s *Sink) Plan(ctx context.Context, credentials *sink.Credentials) (*common.SecretPlan, error) {
+	secret, err := s.CompileSecret(credentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to generate secret object")
+	}
+
+	plan, err := common.PlanCreateOrUpdateSecret(ctx, s.kubeClientSet, secret, s.Target.Merge)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to plan secret %s/%s", secret.Namespace, secret.Name)
+	}
+	return plan, nil
+}
+
+// Delete deletes the secret and removes it from service accounts imagePullSecrets. Only our own entries are
+// stripped from merged secrets, which are deleted only when no entries are left in them
+func (s *Sink) Delete(ctx context.Context, credentials *sink.Credentials) error {
+	secretName, err := s.renderSecretName(credentials)
+	if err != nil {
+		return errors.Wrap(err, "Failed to render secret name")
+	}
+
+	if s.Target.Rotation != nil {
+		return s.deleteVersions(ctx, secretName)
+	}
+
+	if s.Target.Merge {
+		operation, err := common.RemoveOwnedRegistryAuths(ctx, s.kubeClientSet, s.Target.Namespace, secretName)
+		if err != nil && !apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "Failed to remove owned entries from secret")
+		}
+		if operation != common.SecretOperationDelete {
+			return nil
+		}
+	} else {
+		if err := common.DeleteSecret(ctx, s.kubeClientSet, s.Target.Namespace, secretName); err != nil &&
+			!apierrors.IsNotFound(err) {
+			return errors.Wrap(err, "Failed to delete secret")
+		}
+	}
+
+	if _, err := common.RemoveServiceAccountsImagePullSecrets(ctx,
+		s.kubeClientSet,
+		s.Target.Namespace,
+		[]string{secretName}); err != nil {
+		return errors.Wrap(err, "Failed to remove secret from service accounts")
+	}
+	return nil
+}
+
+// Health checks the target secret can be read, a missing one is healthy as it is created on write. Only get is
+// needed, as for writing
+func (s *Sink) Health(ctx context.Context) error {
+	secretName, err := s.renderSecretName(&sink.Credentials{})
+	if err != nil {
+		return errors.Wrap(err, "Failed to render secret name")
+	}
+
+	if _, err := common.GetSecret(ctx, s.kubeClientSet, s.Target.Namespace, secretName); err != nil &&
+		!apierrors.IsNotFound(err) {
+		return errors.Wrapf(err, "Failed to get secret: %s/%s", s.Target.Namespace, secretName)
+	}
+	return nil
+}
+
+// CompileSecret compiles the target secret, along with its metadata, from credentials. When rotating, the
+// secret is the immutable version holding credentials
+func (s *Sink) CompileSecret(credentials *sink.Credentials) (*v1.Secret, error) {
+	secretName, err := s.renderSecretName(credentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to render secret name")
+	}
+
+	secret, err := common.CompileSecret(secretName,
+		s.Target.Namespace,
+		s.Target.Format,
+		s.Target.Template,
+		s.Target.TemplateKey,
+		credentials.Tokens)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to compile secret")
+	}
+
+	metadataTemplateData := compileMetadataTemplateData(s.Target, credentials)
+
+	labels, err := common.RenderSecretMetadataTemplates(s.Target.Labels, metadataTemplateData)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to render secret labels")
+	}
+
+	// a merged secret is managed by whoever created it
+	if s.Target.Merge {
+		labels[common.MergedLabel] = "true"
+	} else {
+		labels[common.ManagedByLabel] = common.ManagedByLabelValue
+	}
+	labels[common.InstanceLabel] = config.DefaultInstance
+	if s.Target.Instance != "" {
+		labels[common.InstanceLabel] = s.Target.Instance
+	}
+
+	annotations, err := common.RenderSecretMetadataTemplates(s.Target.Annotations, metadataTemplateData)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to render secret annotations")
+	}
+	for key, value := range secret.Annotations {
+		annotations[key] = value
+	}
+	annotations[common.RegistryKindsAnnotation] = strings.Join(credentials.Kinds, ",")
+	annotations[common.SourcesAnnotation] = strings.Join(credentials.Registries, ",")
+	if s.writer != "" {
+		annotations[common.WriterAnnotation] = s.writer
+	}
+
+	issuedAt, expiresAt := common.GetTokensValidity(credentials.Tokens)
+	if !issuedAt.IsZero() {
+		annotations[common.IssuedAtAnnotation] = issuedAt.UTC().Format(time.RFC3339)
+	}
+	if !expiresAt.IsZero() {
+		annotations[common.ExpiresAtAnnotation] = expiresAt.UTC().Format(time.RFC3339)
+	}
+
+	if len(labels) > 0 {
+		secret.Labels = labels
+	}
+	secret.Annotations = annotations
+
+	if s.Target.Rotation != nil {
+		return compileSecretVersion(secret)
+	}
+	return secret, nil
+}
+
+// GetSecretName returns the name of the target secret for credentials, the name of their version when rotating
+func (s *Sink) GetSecretName(credentials *sink.Credentials) (string, error) {
+	if s.Target.Rotation == nil {
+		return s.renderSecretName(credentials)
+	}
+
+	secret, err := s.CompileSecret(credentials)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to compile secret")
+	}
+	return secret.Name, nil
+}
+
+// GetSecretNames returns the names of the target secret pods may pull images with: the secret, or every version
+// of it when rotating, as pods keep pulling with the version they were admitted with
+func (s *Sink) GetSecretNames(ctx context.Context, credentials *sink.Credentials) ([]string, error) {
+	secretName, err := s.renderSecretName(credentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to render secret name")
+	}
+
+	if s.Target.Rotation == nil {
+		return []string{secretName}, nil
+	}
+
+	versionNames, err := s.getVersionNames(ctx, secretName)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to get secret version names")
+	}
+	return versionNames, nil
+}
+
+func (s *Sink) renderSecretName(credentials *sink.Credentials) (string, error) {
+	return common.RenderSecretName(s.Target.SecretName, compileMetadataTemplateData(s.Target, credentials))
+}
+
+// compileMetadataTemplateData returns what the target templates are executed with, from the registries configured
+// for the target. Targets not enriched by the config (e.g.: of embedders) fall back to the registries of credentials
+func compileMetadataTemplateData(target *config.Target,
+	credentials *sink.Credentials) *common.SecretMetadataTemplateData {
+
+	if len(target.RegistryNames) > 0 {
+		return target.GetMetadataTemplateData()
+	}
+
+	return &common.SecretMetadataTemplateData{
+		Namespace:  target.Namespace,
+		Registry:   strings.Join(credentials.Registries, "-"),
+		Registries: credentials.Registries,
+		Kinds:      credentials.Kinds,
+	}
+}
@@ -0,0 +1,47 @@
+package kubernetes
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+
+	"github.com/stretchr/testify/suite"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+type SinkSuite struct {
+	suite.Suite
+}
+
+func (suite *SinkSuite) TestHealth() {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	kubeClientSet := fake.NewSimpleClientset()
+	kubernetesSink, err := NewSink(loggerInstance, kubeClientSet, &config.Target{
+		SecretName: "pull-secret",
+		Namespace:  "team",
+	})
+	suite.Require().NoError(err)
+
+	// listing secrets is not needed, and a missing secret is created on write
+	kubeClientSet.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "", nil)
+	})
+	suite.Require().NoError(kubernetesSink.Health(context.Background()))
+
+	// the secret must be readable
+	kubeClientSet.PrependReactor("get", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Resource: "secrets"}, "pull-secret", nil)
+	})
+	suite.Require().Error(kubernetesSink.Health(context.Background()))
+}
+
+func TestSink(t *testing.T) {
+	suite.Run(t, new(SinkSuite))
+}
@@ -0,0 +1,26 @@
+package sink
+
+import (
+	"context"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+)
+
+type Sink interface {
+
+	// Write publishes the credentials, returns what it did. Failing after publishing them (e.g.: a file hook
+	// failing), it returns what it did along with the error
+	Write(ctx context.Context, credentials *Credentials) (common.SecretOperation, error)
+
+	// Plan returns what Write would do, writing nothing
+	Plan(ctx context.Context, credentials *Credentials) (*common.SecretPlan, error)
+
+	// Delete removes what Write published, credentials may have no tokens
+	Delete(ctx context.Context, credentials *Credentials) error
+
+	// Health checks the sink can be written to
+	Health(ctx context.Context) error
+
+	// String describes the sink in messages
+	String() string
+}
@@ -0,0 +1,61 @@
+package sink
+
+import (
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/webhook"
+)
+
+const (
+	KubernetesSinkKind string = "kubernetes"
+	FileSinkKind       string = "file"
+	VaultSinkKind      string = "vault"
+	WebhookSinkKind    string = "webhook"
+)
+
+// Credentials are what a target is published from
+type Credentials struct {
+
+	// Tokens are the last good tokens of the target registries
+	Tokens []*registry.Token
+
+	// Registries and Kinds are the names and kinds of the registries the tokens came from
+	Registries []string
+	Kinds      []string
+}
+
+// VaultOptions are the options of vault sinks
+type VaultOptions struct {
+
+	// Address is the vault server address (default: $VAULT_ADDR)
+	Address string `json:"address,omitempty"`
+
+	// Namespace is the vault enterprise namespace (default: $VAULT_NAMESPACE)
+	Namespace string `json:"namespace,omitempty"`
+
+	// Mount is the KV v2 secrets engine mount (default: secret)
+	Mount string `json:"mount,omitempty"`
+
+	// Path is the secret path within Mount
+	Path string `json:"path,omitempty"`
+
+	// AuthMount is the kubernetes auth method mount (default: kubernetes)
+	AuthMount string `json:"authMount,omitempty"`
+
+	// Role is the kubernetes auth method role to log in with
+	Role string `json:"role,omitempty"`
+
+	// ServiceAccountTokenPath is the service account token to log in with
+	// (default: /var/run/secrets/kubernetes.io/serviceaccount/token)
+	ServiceAccountTokenPath string `json:"serviceAccountTokenPath,omitempty"`
+
+	// CACertPath is a PEM bundle to verify the vault server with (default: $VAULT_CACERT)
+	CACertPath string `json:"caCertPath,omitempty"`
+}
+
+// WebhookOptions are the options of webhook sinks
+type WebhookOptions struct {
+	webhook.Options
+
+	// IncludeCredentials adds the credentials to the requests, which otherwise only hold refresh metadata
+	IncludeCredentials bool `json:"includeCredentials,omitempty"`
+}
@@ -0,0 +1,419 @@
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+	"github.com/v3io/registry-creds-handler/pkg/sink/abstract"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	"k8s.io/api/core/v1"
+)
+
+const (
+	defaultMount                   = "secret"
+	defaultAuthMount               = "kubernetes"
+	defaultServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+	requestTimeout = 30 * time.Second
+
+	// clientTokenRenewMargin is how long before its lease ends a client token is replaced by logging in again
+	clientTokenRenewMargin = time.Minute
+)
+
+var (
+	errNotFound  = errors.New("Not found")
+	errForbidden = errors.New("Permission denied")
+)
+
+// Sink publishes credentials to a vault KV v2 secret, authenticating with the kubernetes auth method
+type Sink struct {
+	*abstract.Sink
+	options    sink.VaultOptions
+	httpClient *http.Client
+
+	// clientToken is the vault token of the last login, replaced before its lease ends
+	clientToken          string
+	clientTokenExpiresAt time.Time
+	clientTokenLock      sync.Mutex
+}
+
+func NewSink(parentLogger logger.Logger, target *config.Target) (*Sink, error) {
+	newSink := &Sink{}
+
+	// create base
+	abstractSink, err := abstract.NewSink(parentLogger.GetChild("vault"), newSink, target)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create abstract sink")
+	}
+	newSink.Sink = abstractSink
+
+	if err := newSink.enrichAndValidate(); err != nil {
+		return nil, errors.Wrap(err, "Failed to enrich and validate vault sink")
+	}
+
+	return newSink, nil
+}
+
+// Write writes the credentials as a new version of the secret, unless they are already its latest version
+func (s *Sink) Write(ctx context.Context, credentials *sink.Credentials) (common.SecretOperation, error) {
+	desiredData, err := compileData(credentials)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to compile secret data")
+	}
+
+	existingData, err := s.readData(ctx)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to read secret")
+	}
+	if existingData != nil && reflect.DeepEqual(existingData, desiredData) {
+		return common.SecretOperationUnchanged, nil
+	}
+
+	if err := s.request(ctx, http.MethodPost, s.getDataPath(), map[string]interface{}{
+		"data": desiredData,
+	}, nil); err != nil {
+		return "", errors.Wrap(err, "Failed to write secret")
+	}
+
+	if existingData == nil {
+		return common.SecretOperationCreate, nil
+	}
+	return common.SecretOperationUpdate, nil
+}
+
+// Plan returns what Write would change in the secret, by data key
+func (s *Sink) Plan(ctx context.Context, credentials *sink.Credentials) (*common.SecretPlan, error) {
+	plan := &common.SecretPlan{
+		Operation: common.SecretOperationUnchanged,
+		Kind:      sink.VaultSinkKind,
+		Name:      fmt.Sprintf("%s/%s", s.options.Mount, s.options.Path),
+	}
+
+	desiredData, err := compileData(credentials)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to compile secret data")
+	}
+
+	existingData, err := s.readData(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to read secret")
+	}
+
+	var keys []string
+	for key := range desiredData {
+		keys = append(keys, key)
+	}
+	for key := range existingData {
+		if _, found := desiredData[key]; !found {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		existingValue, existingFound := existingData[key]
+		desiredValue, desiredFound := desiredData[key]
+		switch {
+		case !existingFound:
+			plan.Changes = append(plan.Changes, fmt.Sprintf("+ data[%s]: <redacted>", key))
+		case !desiredFound:
+			plan.Changes = append(plan.Changes, fmt.Sprintf("- data[%s]: <redacted>", key))
+		case existingValue != desiredValue:
+			plan.Changes = append(plan.Changes, fmt.Sprintf("~ data[%s]: <redacted>", key))
+		}
+	}
+
+	switch {
+	case existingData == nil:
+		plan.Operation = common.SecretOperationCreate
+	case len(plan.Changes) > 0:
+		plan.Operation = common.SecretOperationUpdate
+	}
+	return plan, nil
+}
+
+// Delete deletes the secret along with all of its versions
+func (s *Sink) Delete(ctx context.Context, credentials *sink.Credentials) error {
+	if err := s.request(ctx, http.MethodDelete, s.getMetadataPath(), nil, nil); err != nil &&
+		errors.RootCause(err) != errNotFound {
+		return errors.Wrap(err, "Failed to delete secret")
+	}
+	return nil
+}
+
+// Health logs in to vault, checking the address, the role and the service account token
+func (s *Sink) Health(ctx context.Context) error {
+	if _, err := s.getClientToken(ctx); err != nil {
+		return errors.Wrap(err, "Failed to log in to vault")
+	}
+	return nil
+}
+
+// String describes the sink by its secret
+func (s *Sink) String() string {
+	return fmt.Sprintf("vault %s/%s/%s", s.options.Address, s.options.Mount, s.options.Path)
+}
+
+func (s *Sink) enrichAndValidate() error {
+	if len(s.Target.Options) > 0 {
+		if err := json.Unmarshal(s.Target.Options, &s.options); err != nil {
+			return errors.Wrap(err, "Failed to parse vault options")
+		}
+	}
+
+	s.options.Address = strings.TrimSuffix(common.GetFirstNonEmptyString(
+		[]string{s.options.Address, strings.TrimSpace(os.Getenv("VAULT_ADDR"))}), "/")
+	s.options.Namespace = common.GetFirstNonEmptyString(
+		[]string{s.options.Namespace, strings.TrimSpace(os.Getenv("VAULT_NAMESPACE"))})
+	s.options.CACertPath = common.GetFirstNonEmptyString(
+		[]string{s.options.CACertPath, strings.TrimSpace(os.Getenv("VAULT_CACERT"))})
+	s.options.Mount = strings.Trim(common.GetFirstNonEmptyString([]string{s.options.Mount, defaultMount}), "/")
+	s.options.AuthMount = strings.Trim(common.GetFirstNonEmptyString(
+		[]string{s.options.AuthMount, defaultAuthMount}), "/")
+	s.options.ServiceAccountTokenPath = common.GetFirstNonEmptyString(
+		[]string{s.options.ServiceAccountTokenPath, defaultServiceAccountTokenPath})
+	s.options.Path = strings.Trim(s.options.Path, "/")
+
+	if s.options.Address == "" {
+		return errors.New("Vault address must not be empty")
+	}
+	if s.options.Path == "" {
+		return errors.New("Vault path must not be empty")
+	}
+	if s.options.Role == "" {
+		return errors.New("Vault role must not be empty")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if s.options.CACertPath != "" {
+		caCert, err := os.ReadFile(s.options.CACertPath)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to read CA cert: %s", s.options.CACertPath)
+		}
+		rootCAs := x509.NewCertPool()
+		if !rootCAs.AppendCertsFromPEM(caCert) {
+			return errors.Errorf("No certificates found in CA cert: %s", s.options.CACertPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: rootCAs}
+	}
+	s.httpClient = &http.Client{
+		Transport: transport,
+		Timeout:   requestTimeout,
+	}
+
+	return nil
+}
+
+// readData returns the data of the secret latest version, nil if there is none
+func (s *Sink) readData(ctx context.Context) (map[string]string, error) {
+	response := struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}{}
+
+	if err := s.request(ctx, http.MethodGet, s.getDataPath(), nil, &response); err != nil {
+		if errors.RootCause(err) == errNotFound {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "Failed to read secret")
+	}
+	return response.Data.Data, nil
+}
+
+// getClientToken returns the token of the last login, logging in when there is none or its lease is ending
+func (s *Sink) getClientToken(ctx context.Context) (string, error) {
+	s.clientTokenLock.Lock()
+	defer s.clientTokenLock.Unlock()
+
+	if s.clientToken != "" && time.Now().Add(clientTokenRenewMargin).Before(s.clientTokenExpiresAt) {
+		return s.clientToken, nil
+	}
+
+	serviceAccountToken, err := os.ReadFile(s.options.ServiceAccountTokenPath)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to read service account token: %s", s.options.ServiceAccountTokenPath)
+	}
+
+	response := struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int64  `json:"lease_duration"`
+		} `json:"auth"`
+	}{}
+	if err := s.do(ctx, http.MethodPost, fmt.Sprintf("auth/%s/login", s.options.AuthMount), "", map[string]string{
+		"role": s.options.Role,
+		"jwt":  strings.TrimSpace(string(serviceAccountToken)),
+	}, &response); err != nil {
+		return "", errors.Wrap(err, "Failed to log in")
+	}
+	if response.Auth.ClientToken == "" {
+		return "", errors.New("Login response has no client token")
+	}
+
+	s.clientToken = response.Auth.ClientToken
+	s.clientTokenExpiresAt = time.Now().Add(time.Duration(response.Auth.LeaseDuration) * time.Second)
+	s.Logger.DebugWithCtx(ctx, "Logged in to vault",
+		"Address", s.options.Address,
+		"Role", s.options.Role,
+		"ExpiresAt", s.clientTokenExpiresAt)
+	return s.clientToken, nil
+}
+
+// request sends an authenticated request, logging in again once if the client token was revoked
+func (s *Sink) request(ctx context.Context,
+	method string,
+	path string,
+	body interface{},
+	response interface{}) error {
+
+	clientToken, err := s.getClientToken(ctx)
+	if err != nil {
+		return errors.Wrap(err, "Failed to get client token")
+	}
+
+	err = s.do(ctx, method, path, clientToken, body, response)
+	if errors.RootCause(err) != errForbidden {
+		return err
+	}
+
+	s.clientTokenLock.Lock()
+	s.clientToken = ""
+	s.clientTokenLock.Unlock()
+
+	if clientToken, err = s.getClientToken(ctx); err != nil {
+		return errors.Wrap(err, "Failed to get client token")
+	}
+	return s.do(ctx, method, path, clientToken, body, response)
+}
+
+func (s *Sink) do(ctx context.Context,
+	method string,
+	path string,
+	clientToken string,
+	body interface{},
+	response interface{}) error {
+
+	var encodedBody io.Reader
+	if body != nil {
+		encodedRequest, err := json.Marshal(body)
+		if err != nil {
+			return errors.Wrap(err, "Failed to encode request")
+		}
+		encodedBody = bytes.NewReader(encodedRequest)
+	}
+
+	request, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("%s/v1/%s", s.options.Address, path), encodedBody)
+	if err != nil {
+		return errors.Wrap(err, "Failed to create request")
+	}
+	if clientToken != "" {
+		request.Header.Set("X-Vault-Token", clientToken)
+	}
+	if s.options.Namespace != "" {
+		request.Header.Set("X-Vault-Namespace", s.options.Namespace)
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	httpResponse, err := s.httpClient.Do(request)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to send %s request", method)
+	}
+	defer httpResponse.Body.Close()
+
+	encodedResponse, err := io.ReadAll(httpResponse.Body)
+	if err != nil {
+		return errors.Wrap(err, "Failed to read response")
+	}
+
+	switch {
+	case httpResponse.StatusCode == http.StatusNotFound:
+		return errNotFound
+	case httpResponse.StatusCode == http.StatusForbidden:
+		return errForbidden
+	case httpResponse.StatusCode >= http.StatusMultipleChoices:
+		return errors.Errorf("Vault replied with status %d: %s",
+			httpResponse.StatusCode,
+			strings.TrimSpace(string(encodedResponse)))
+	}
+
+	if response != nil && len(encodedResponse) > 0 {
+		if err := json.Unmarshal(encodedResponse, response); err != nil {
+			return errors.Wrap(err, "Failed to decode response")
+		}
+	}
+	return nil
+}
+
+func (s *Sink) getDataPath() string {
+	return fmt.Sprintf("%s/data/%s", s.options.Mount, s.options.Path)
+}
+
+func (s *Sink) getMetadataPath() string {
+	return fmt.Sprintf("%s/metadata/%s", s.options.Mount, s.options.Path)
+}
+
+// compileData compiles the secret data. A docker config json holds the credentials of all registries,
+// while the token fields are given as is when the target has a single registry, for tools reading them directly
+func compileData(credentials *sink.Credentials) (map[string]string, error) {
+	secret, err := common.CompileRegistryAuthSecret("", "", credentials.Tokens)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to compile docker config json")
+	}
+
+	data := map[string]string{
+		"dockerconfigjson": string(secret.Data[v1.DockerConfigJsonKey]),
+		"sources":          strings.Join(credentials.Registries, ","),
+	}
+
+	issuedAt, expiresAt := common.GetTokensValidity(credentials.Tokens)
+	if !issuedAt.IsZero() {
+		data["issuedAt"] = issuedAt.UTC().Format(time.RFC3339)
+	}
+	if !expiresAt.IsZero() {
+		data["expiresAt"] = expiresAt.UTC().Format(time.RFC3339)
+	}
+
+	if len(credentials.Tokens) == 1 {
+		token := credentials.Tokens[0]
+
+		// registries issuing identity tokens may issue no username and password
+		username, password, err := token.GetUsernamePassword()
+		if err != nil && token.IdentityToken == "" {
+			return nil, errors.Wrap(err, "Failed to get username and password")
+		}
+		if err == nil {
+			data["username"] = username
+			data["password"] = password
+		}
+		data["registryUri"] = token.RegistryUri
+		data["registryUris"] = strings.Join(token.GetRegistryUris(), ",")
+		if token.IdentityToken != "" {
+			data["identityToken"] = token.IdentityToken
+		}
+		if token.RegistryToken != "" {
+			data["registryToken"] = token.RegistryToken
+		}
+	}
+
+	return data, nil
+}
@@ -0,0 +1,188 @@
+package vault
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeVault serves the kubernetes auth login and the KV v2 data and metadata endpoints of a single mount
+type fakeVault struct {
+	lock    sync.Mutex
+	jwt     string
+	logins  int
+	tokens  map[string]bool
+	secrets map[string][]map[string]string
+}
+
+func newFakeVault(jwt string) *fakeVault {
+	return &fakeVault{
+		jwt:     jwt,
+		tokens:  map[string]bool{},
+		secrets: map[string][]map[string]string{},
+	}
+}
+
+func (fv *fakeVault) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	fv.lock.Lock()
+	defer fv.lock.Unlock()
+
+	if request.URL.Path == "/v1/auth/kubernetes/login" {
+		login := map[string]string{}
+		if err := json.NewDecoder(request.Body).Decode(&login); err != nil ||
+			login["jwt"] != fv.jwt ||
+			login["role"] != "registry-creds" {
+			http.Error(responseWriter, `{"errors":["permission denied"]}`, http.StatusForbidden)
+			return
+		}
+		fv.logins++
+		clientToken := fmt.Sprintf("client-token-%d", fv.logins)
+		fv.tokens[clientToken] = true
+		json.NewEncoder(responseWriter).Encode(map[string]interface{}{
+			"auth": map[string]interface{}{"client_token": clientToken, "lease_duration": 3600},
+		})
+		return
+	}
+
+	if !fv.tokens[request.Header.Get("X-Vault-Token")] {
+		http.Error(responseWriter, `{"errors":["permission denied"]}`, http.StatusForbidden)
+		return
+	}
+
+	switch {
+	case strings.HasPrefix(request.URL.Path, "/v1/secret/data/"):
+		path := strings.TrimPrefix(request.URL.Path, "/v1/secret/data/")
+		switch request.Method {
+		case http.MethodGet:
+			versions := fv.secrets[path]
+			if len(versions) == 0 {
+				http.Error(responseWriter, `{"errors":[]}`, http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(responseWriter).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"data": versions[len(versions)-1]},
+			})
+		case http.MethodPost:
+			body := struct {
+				Data map[string]string `json:"data"`
+			}{}
+			if err := json.NewDecoder(request.Body).Decode(&body); err != nil {
+				http.Error(responseWriter, err.Error(), http.StatusBadRequest)
+				return
+			}
+			fv.secrets[path] = append(fv.secrets[path], body.Data)
+			responseWriter.Write([]byte(`{"data":{"version":1}}`))
+		}
+	case strings.HasPrefix(request.URL.Path, "/v1/secret/metadata/") && request.Method == http.MethodDelete:
+		delete(fv.secrets, strings.TrimPrefix(request.URL.Path, "/v1/secret/metadata/"))
+		responseWriter.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(responseWriter, request)
+	}
+}
+
+type SinkSuite struct {
+	suite.Suite
+	fakeVault *fakeVault
+	server    *httptest.Server
+	sink      *Sink
+}
+
+func (suite *SinkSuite) SetupTest() {
+	serviceAccountTokenPath := filepath.Join(suite.T().TempDir(), "token")
+	err := os.WriteFile(serviceAccountTokenPath, []byte("service-account-jwt\n"), 0600)
+	suite.Require().NoError(err)
+
+	suite.fakeVault = newFakeVault("service-account-jwt")
+	suite.server = httptest.NewServer(suite.fakeVault)
+
+	options, err := json.Marshal(sink.VaultOptions{
+		Address:                 suite.server.URL,
+		Path:                    "ci/registry",
+		Role:                    "registry-creds",
+		ServiceAccountTokenPath: serviceAccountTokenPath,
+	})
+	suite.Require().NoError(err)
+
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	suite.sink, err = NewSink(loggerInstance, &config.Target{Kind: sink.VaultSinkKind, Options: options})
+	suite.Require().NoError(err)
+}
+
+func (suite *SinkSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *SinkSuite) TestWrite() {
+	ctx := context.Background()
+	credentials := &sink.Credentials{
+		Tokens: []*registry.Token{
+			{
+
+				// AWS:password
+				Auth:        "QVdTOnBhc3N3b3Jk",
+				RegistryUri: "ecr.mock.com",
+				ExpiresAt:   time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+			},
+		},
+		Registries: []string{"prod"},
+		Kinds:      []string{"ecr"},
+	}
+
+	suite.Require().NoError(suite.sink.Health(ctx))
+
+	operation, err := suite.sink.Write(ctx, credentials)
+	suite.Require().NoError(err)
+	suite.Require().Equal(common.SecretOperationCreate, operation)
+
+	versions := suite.fakeVault.secrets["ci/registry"]
+	suite.Require().Len(versions, 1)
+	suite.Require().Equal("AWS", versions[0]["username"])
+	suite.Require().Equal("password", versions[0]["password"])
+	suite.Require().Equal("ecr.mock.com", versions[0]["registryUri"])
+	suite.Require().Equal("prod", versions[0]["sources"])
+	suite.Require().Equal("2030-01-01T00:00:00Z", versions[0]["expiresAt"])
+	suite.Require().JSONEq(`{"auths":{"ecr.mock.com":{"auth":"QVdTOnBhc3N3b3Jk"}}}`, versions[0]["dockerconfigjson"])
+
+	// the same credentials do not make a new version
+	operation, err = suite.sink.Write(ctx, credentials)
+	suite.Require().NoError(err)
+	suite.Require().Equal(common.SecretOperationUnchanged, operation)
+	suite.Require().Len(suite.fakeVault.secrets["ci/registry"], 1)
+
+	// a revoked client token is replaced by logging in again
+	suite.fakeVault.tokens = map[string]bool{}
+	credentials.Tokens[0] = &registry.Token{Auth: "QVdTOnJlZnJlc2hlZA==", RegistryUri: "ecr.mock.com"}
+	operation, err = suite.sink.Write(ctx, credentials)
+	suite.Require().NoError(err)
+	suite.Require().Equal(common.SecretOperationUpdate, operation)
+	suite.Require().Len(suite.fakeVault.secrets["ci/registry"], 2)
+	suite.Require().Equal(2, suite.fakeVault.logins)
+
+	suite.Require().NoError(suite.sink.Delete(ctx, credentials))
+	suite.Require().Empty(suite.fakeVault.secrets)
+}
+
+func (suite *SinkSuite) TestHealthBadRole() {
+	suite.sink.options.Role = "other"
+	suite.Require().Error(suite.sink.Health(context.Background()))
+}
+
+func TestSink(t *testing.T) {
+	suite.Run(t, new(SinkSuite))
+}
@@ -0,0 +1,187 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+	"github.com/v3io/registry-creds-handler/pkg/sink/abstract"
+	"github.com/v3io/registry-creds-handler/pkg/webhook"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+)
+
+const (
+	RefreshEvent = "refresh"
+	DeleteEvent  = "delete"
+)
+
+// Event is the body POSTed to the webhook
+type Event struct {
+	Event        string     `json:"event"`
+	Registries   []string   `json:"registries"`
+	Kinds        []string   `json:"kinds"`
+	RegistryUris []string   `json:"registryUris"`
+	IssuedAt     *time.Time `json:"issuedAt,omitempty"`
+	ExpiresAt    *time.Time `json:"expiresAt,omitempty"`
+
+	// Credentials are given only when the sink is configured to include them
+	Credentials []EventCredentials `json:"credentials,omitempty"`
+}
+
+type EventCredentials struct {
+	RegistryUris  []string `json:"registryUris"`
+	Username      string   `json:"username,omitempty"`
+	Password      string   `json:"password,omitempty"`
+	IdentityToken string   `json:"identityToken,omitempty"`
+	RegistryToken string   `json:"registryToken,omitempty"`
+}
+
+// Sink POSTs refreshed credentials, or only their refresh metadata, to a webhook
+type Sink struct {
+	*abstract.Sink
+	options sink.WebhookOptions
+	client  *webhook.Client
+
+	// lastEvent is the last event posted, so that the same credentials are not posted again
+	lastEvent     []byte
+	lastEventLock sync.Mutex
+}
+
+func NewSink(parentLogger logger.Logger, target *config.Target) (*Sink, error) {
+	newSink := &Sink{}
+
+	// create base
+	abstractSink, err := abstract.NewSink(parentLogger.GetChild("webhook"), newSink, target)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create abstract sink")
+	}
+	newSink.Sink = abstractSink
+
+	if len(target.Options) > 0 {
+		if err := json.Unmarshal(target.Options, &newSink.options); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse webhook options")
+		}
+	}
+
+	if newSink.client, err = webhook.NewClient(newSink.Logger, newSink.options.Options); err != nil {
+		return nil, errors.Wrap(err, "Failed to create webhook client")
+	}
+
+	return newSink, nil
+}
+
+// Write posts a refresh event, unless the same one was already posted
+func (s *Sink) Write(ctx context.Context, credentials *sink.Credentials) (common.SecretOperation, error) {
+	event, err := s.compileEvent(RefreshEvent, credentials)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to compile event")
+	}
+
+	encodedEvent, err := json.Marshal(event)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to encode event")
+	}
+
+	s.lastEventLock.Lock()
+	defer s.lastEventLock.Unlock()
+
+	if bytes.Equal(s.lastEvent, encodedEvent) {
+		return common.SecretOperationUnchanged, nil
+	}
+
+	if err := s.client.Post(ctx, event); err != nil {
+		return "", errors.Wrap(err, "Failed to post refresh event")
+	}
+
+	s.lastEvent = encodedEvent
+	return common.SecretOperationUpdate, nil
+}
+
+// Plan returns that a refresh event would be posted, as the webhook state is unknown
+func (s *Sink) Plan(ctx context.Context, credentials *sink.Credentials) (*common.SecretPlan, error) {
+	change := "~ POST refresh event"
+	if s.options.IncludeCredentials {
+		change += " with credentials: <redacted>"
+	}
+
+	return &common.SecretPlan{
+		Operation: common.SecretOperationUpdate,
+		Kind:      sink.WebhookSinkKind,
+		Name:      s.client.String(),
+		Changes:   []string{change},
+	}, nil
+}
+
+// Delete posts a delete event, for the receiver to remove what it stored
+func (s *Sink) Delete(ctx context.Context, credentials *sink.Credentials) error {
+	if err := s.client.Post(ctx, &Event{
+		Event:      DeleteEvent,
+		Registries: credentials.Registries,
+		Kinds:      credentials.Kinds,
+	}); err != nil {
+		return errors.Wrap(err, "Failed to post delete event")
+	}
+	return nil
+}
+
+// Health is not checked, as webhooks have no standard way to be probed without posting an event
+func (s *Sink) Health(ctx context.Context) error {
+	return nil
+}
+
+// String describes the sink by its URL
+func (s *Sink) String() string {
+	return "webhook " + s.client.String()
+}
+
+func (s *Sink) compileEvent(eventName string, credentials *sink.Credentials) (*Event, error) {
+	event := &Event{
+		Event:        eventName,
+		Registries:   credentials.Registries,
+		Kinds:        credentials.Kinds,
+		RegistryUris: []string{},
+	}
+
+	issuedAt, expiresAt := common.GetTokensValidity(credentials.Tokens)
+	if !issuedAt.IsZero() {
+		issuedAt = issuedAt.UTC()
+		event.IssuedAt = &issuedAt
+	}
+	if !expiresAt.IsZero() {
+		expiresAt = expiresAt.UTC()
+		event.ExpiresAt = &expiresAt
+	}
+
+	for _, token := range credentials.Tokens {
+		event.RegistryUris = append(event.RegistryUris, token.GetRegistryUris()...)
+		if !s.options.IncludeCredentials {
+			continue
+		}
+
+		eventCredentials := EventCredentials{
+			RegistryUris:  token.GetRegistryUris(),
+			IdentityToken: token.IdentityToken,
+			RegistryToken: token.RegistryToken,
+		}
+
+		// registries issuing identity tokens may issue no username and password
+		username, password, err := token.GetUsernamePassword()
+		if err != nil && token.IdentityToken == "" {
+			return nil, errors.Wrap(err, "Failed to get username and password")
+		}
+		if err == nil {
+			eventCredentials.Username = username
+			eventCredentials.Password = password
+		}
+		event.Credentials = append(event.Credentials, eventCredentials)
+	}
+
+	return event, nil
+}
@@ -0,0 +1,103 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/config"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+	"github.com/v3io/registry-creds-handler/pkg/sink"
+	"github.com/v3io/registry-creds-handler/pkg/webhook"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type SinkSuite struct {
+	suite.Suite
+	events []*Event
+	server *httptest.Server
+}
+
+func (suite *SinkSuite) SetupTest() {
+	suite.events = nil
+	suite.server = httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		event := &Event{}
+		suite.Require().NoError(json.NewDecoder(request.Body).Decode(event))
+		suite.events = append(suite.events, event)
+	}))
+}
+
+func (suite *SinkSuite) TearDownTest() {
+	suite.server.Close()
+}
+
+func (suite *SinkSuite) TestWrite() {
+	credentials := &sink.Credentials{
+		Tokens: []*registry.Token{
+
+			// AWS:password
+			{Auth: "QVdTOnBhc3N3b3Jk", RegistryUri: "ecr.mock.com"},
+		},
+		Registries: []string{"prod"},
+		Kinds:      []string{"ecr"},
+	}
+
+	for _, test := range []struct {
+		name                string
+		includeCredentials  bool
+		expectedCredentials []EventCredentials
+	}{
+		{
+			name: "metadataOnly",
+		},
+		{
+			name:               "includeCredentials",
+			includeCredentials: true,
+			expectedCredentials: []EventCredentials{
+				{RegistryUris: []string{"ecr.mock.com"}, Username: "AWS", Password: "password"},
+			},
+		},
+	} {
+		suite.Run(test.name, func() {
+			suite.events = nil
+			webhookSink := suite.createSink(sink.WebhookOptions{
+				Options:            webhook.Options{URL: suite.server.URL},
+				IncludeCredentials: test.includeCredentials,
+			})
+
+			operation, err := webhookSink.Write(context.Background(), credentials)
+			suite.Require().NoError(err)
+			suite.Require().Equal(common.SecretOperationUpdate, operation)
+
+			// the same credentials are not posted again
+			operation, err = webhookSink.Write(context.Background(), credentials)
+			suite.Require().NoError(err)
+			suite.Require().Equal(common.SecretOperationUnchanged, operation)
+
+			suite.Require().Len(suite.events, 1)
+			suite.Require().Equal(RefreshEvent, suite.events[0].Event)
+			suite.Require().Equal([]string{"prod"}, suite.events[0].Registries)
+			suite.Require().Equal([]string{"ecr.mock.com"}, suite.events[0].RegistryUris)
+			suite.Require().Equal(test.expectedCredentials, suite.events[0].Credentials)
+		})
+	}
+}
+
+func (suite *SinkSuite) createSink(options sink.WebhookOptions) *Sink {
+	encodedOptions, err := json.Marshal(options)
+	suite.Require().NoError(err)
+
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	webhookSink, err := NewSink(loggerInstance, &config.Target{Kind: sink.WebhookSinkKind, Options: encodedOptions})
+	suite.Require().NoError(err)
+	return webhookSink
+}
+
+func TestSink(t *testing.T) {
+	suite.Run(t, new(SinkSuite))
+}
@@ -0,0 +1,396 @@
+package verifier
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+)
+
+const (
+	DefaultTimeout int64 = 30
+
+	defaultReference = "latest"
+
+	maxDrainedBodySize = 1024 * 1024
+
+	// oauthClientID identifies us to token services when exchanging identity tokens
+	oauthClientID = "registry-creds-handler"
+)
+
+// manifestMediaTypes are accepted when fetching the test manifest, so that registries serve it as is
+var manifestMediaTypes = []string{
+	"application/vnd.oci.image.index.v1+json",
+	"application/vnd.oci.image.manifest.v1+json",
+	"application/vnd.docker.distribution.manifest.list.v2+json",
+	"application/vnd.docker.distribution.manifest.v2+json",
+}
+
+// Options describe how credentials are verified against their registry
+type Options struct {
+
+	// Manifest is an image (e.g.: team/app:1.0 or team/app@sha256:...) whose manifest is fetched with the
+	// credentials, to verify they can pull and not only log in
+	Manifest string `json:"manifest,omitempty"`
+
+	// Timeout is the verification timeout in seconds (default: 30)
+	Timeout int64 `json:"timeout,omitempty"`
+
+	// CACertPath verifies the registry certificate with a custom CA
+	CACertPath string `json:"caCertPath,omitempty"`
+
+	// PlainHTTP talks to the registry over http, e.g.: for a local registry
+	PlainHTTP bool `json:"plainHTTP,omitempty"`
+}
+
+// Verifier authenticates to a registry's /v2/ endpoint with credentials, following bearer token challenges
+// as docker does, and optionally fetches a test manifest with them
+type Verifier struct {
+	logger     logger.Logger
+	options    Options
+	httpClient *http.Client
+}
+
+// challenge is a bearer token challenge of a registry
+type challenge struct {
+	realm   string
+	service string
+}
+
+func NewVerifier(parentLogger logger.Logger, options Options) (*Verifier, error) {
+	if options.Timeout <= 0 {
+		options.Timeout = DefaultTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if options.CACertPath != "" {
+		caCert, err := os.ReadFile(options.CACertPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read CA certificate: %s", options.CACertPath)
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, errors.Errorf("No certificate found in: %s", options.CACertPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: caCertPool}
+	}
+
+	if options.Manifest != "" {
+		if _, _, err := parseManifest(options.Manifest); err != nil {
+			return nil, errors.Wrap(err, "Failed to parse manifest")
+		}
+	}
+
+	return &Verifier{
+		logger:  parentLogger.GetChild("verifier"),
+		options: options,
+		httpClient: &http.Client{
+			Transport: transport,
+			Timeout:   time.Duration(options.Timeout) * time.Second,
+		},
+	}, nil
+}
+
+// Verify logs in to every registry a token is published under (e.g.: its aliases and replication destinations)
+// with it, and fetches the test manifest from its first registry if one is configured
+func (v *Verifier) Verify(ctx context.Context, token *registry.Token) error {
+	var registryHosts []string
+	seenRegistryHosts := map[string]bool{}
+	for _, registryUri := range token.GetRegistryUris() {
+		registryHost := strings.SplitN(common.NormalizeRegistryUri(registryUri), "/", 2)[0]
+		if registryHost == "docker.io" {
+			registryHost = "registry-1.docker.io"
+		}
+		if registryHost != "" && !seenRegistryHosts[registryHost] {
+			seenRegistryHosts[registryHost] = true
+			registryHosts = append(registryHosts, registryHost)
+		}
+	}
+	if len(registryHosts) == 0 {
+		return errors.New("Token has no registry URI to verify against")
+	}
+
+	for index, registryHost := range registryHosts {
+		if err := v.verifyRegistry(ctx, token, registryHost, index == 0); err != nil {
+			return errors.Wrapf(err, "Failed to verify token against registry: %s", registryHost)
+		}
+	}
+	return nil
+}
+
+// verifyRegistry logs in to a registry with a token, and fetches the test manifest from it if fetchManifest is
+// set and one is configured
+func (v *Verifier) verifyRegistry(ctx context.Context,
+	token *registry.Token,
+	registryHost string,
+	fetchManifest bool) error {
+
+	baseURL := fmt.Sprintf("https://%s", registryHost)
+	if v.options.PlainHTTP {
+		baseURL = fmt.Sprintf("http://%s", registryHost)
+	}
+
+	v.logger.DebugWithCtx(ctx, "Verifying token", "registryHost", registryHost)
+
+	if err := v.get(ctx, token, baseURL+"/v2/", "", nil); err != nil {
+		return errors.Wrapf(err, "Failed to log in to registry: %s", registryHost)
+	}
+
+	if !fetchManifest || v.options.Manifest == "" {
+		return nil
+	}
+
+	repository, reference, err := parseManifest(v.options.Manifest)
+	if err != nil {
+		return errors.Wrap(err, "Failed to parse manifest")
+	}
+	if err := v.get(ctx,
+		token,
+		fmt.Sprintf("%s/v2/%s/manifests/%s", baseURL, repository, reference),
+		fmt.Sprintf("repository:%s:pull", repository),
+		manifestMediaTypes); err != nil {
+		return errors.Wrapf(err, "Failed to fetch manifest: %s", v.options.Manifest)
+	}
+
+	return nil
+}
+
+// get requests a registry URL with the token credentials, exchanging them for a bearer token of scope when
+// the registry challenges for one
+func (v *Verifier) get(ctx context.Context,
+	token *registry.Token,
+	requestURL string,
+	scope string,
+	acceptedMediaTypes []string) error {
+
+	username, password, err := token.GetUsernamePassword()
+	if err != nil {
+		return errors.Wrap(err, "Failed to get username and password")
+	}
+
+	authorization := ""
+	switch {
+	case token.RegistryToken != "":
+		authorization = "Bearer " + token.RegistryToken
+	case username != "" || password != "":
+		authorization = "Basic " + token.GetAuth()
+	case token.IdentityToken == "":
+
+		// registries serve anonymous pulls, which must not pass for the credentials working
+		return errors.New("Token has no credentials to verify")
+	}
+
+	response, err := v.do(ctx, http.MethodGet, requestURL, authorization, acceptedMediaTypes)
+	if err != nil {
+		return errors.Wrap(err, "Failed to send request")
+	}
+
+	if response.StatusCode == http.StatusUnauthorized {
+		bearerChallenge, found := parseBearerChallenge(response.Header.Get("WWW-Authenticate"))
+		if !found {
+			return errors.New("Registry rejected the credentials (401 Unauthorized)")
+		}
+
+		bearerToken, err := v.getBearerToken(ctx, bearerChallenge, scope, username, password, token.IdentityToken)
+		if err != nil {
+			return errors.Wrap(err, "Failed to get bearer token")
+		}
+
+		if response, err = v.do(ctx,
+			http.MethodGet,
+			requestURL,
+			"Bearer "+bearerToken,
+			acceptedMediaTypes); err != nil {
+			return errors.Wrap(err, "Failed to send request")
+		}
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return errors.Errorf("Registry replied %s", response.Status)
+	}
+	return nil
+}
+
+// getBearerToken exchanges credentials for a bearer token at the challenge realm, as in the docker registry
+// token authentication specification. Identity tokens are exchanged through the OAuth2 refresh token grant
+func (v *Verifier) getBearerToken(ctx context.Context,
+	bearerChallenge *challenge,
+	scope string,
+	username string,
+	password string,
+	identityToken string) (string, error) {
+
+	realmURL, err := url.Parse(bearerChallenge.realm)
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to parse realm: %s", bearerChallenge.realm)
+	}
+
+	var request *http.Request
+	if identityToken != "" {
+		form := url.Values{}
+		form.Set("grant_type", "refresh_token")
+		form.Set("refresh_token", identityToken)
+		form.Set("client_id", oauthClientID)
+		if bearerChallenge.service != "" {
+			form.Set("service", bearerChallenge.service)
+		}
+		if scope != "" {
+			form.Set("scope", scope)
+		}
+
+		if request, err = http.NewRequestWithContext(ctx,
+			http.MethodPost,
+			realmURL.String(),
+			strings.NewReader(form.Encode())); err != nil {
+			return "", errors.Wrap(err, "Failed to create request")
+		}
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := realmURL.Query()
+		if bearerChallenge.service != "" {
+			query.Set("service", bearerChallenge.service)
+		}
+		if scope != "" {
+			query.Set("scope", scope)
+		}
+		realmURL.RawQuery = query.Encode()
+
+		if request, err = http.NewRequestWithContext(ctx, http.MethodGet, realmURL.String(), nil); err != nil {
+			return "", errors.Wrap(err, "Failed to create request")
+		}
+		if username != "" || password != "" {
+			request.SetBasicAuth(username, password)
+		}
+	}
+
+	response, err := v.httpClient.Do(request)
+	if err != nil {
+		return "", errors.Wrap(err, "Failed to send request")
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", errors.Errorf("Token service rejected the credentials (%s)", response.Status)
+	}
+
+	tokenResponse := struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.NewDecoder(response.Body).Decode(&tokenResponse); err != nil {
+		return "", errors.Wrap(err, "Failed to decode token response")
+	}
+
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	if tokenResponse.AccessToken != "" {
+		return tokenResponse.AccessToken, nil
+	}
+	return "", errors.New("Token service replied without a token")
+}
+
+// do sends a request, returning its response with the body already read and closed
+func (v *Verifier) do(ctx context.Context,
+	method string,
+	requestURL string,
+	authorization string,
+	acceptedMediaTypes []string) (*http.Response, error) {
+
+	request, err := http.NewRequestWithContext(ctx, method, requestURL, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to create request")
+	}
+	if authorization != "" {
+		request.Header.Set("Authorization", authorization)
+	}
+	for _, mediaType := range acceptedMediaTypes {
+		request.Header.Add("Accept", mediaType)
+	}
+
+	response, err := v.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	// only the status and headers are of interest, the body is drained so that the connection is reused
+	if _, err := io.Copy(io.Discard, io.LimitReader(response.Body, maxDrainedBodySize)); err != nil {
+		return nil, errors.Wrap(err, "Failed to read response")
+	}
+	return response, nil
+}
+
+// parseManifest splits an image into its repository and its tag or digest, defaulting to latest
+func parseManifest(manifest string) (string, string, error) {
+	repository, reference := manifest, defaultReference
+	if index := strings.Index(manifest, "@"); index != -1 {
+		repository, reference = manifest[:index], manifest[index+1:]
+	} else if index := strings.LastIndex(manifest, ":"); index > strings.LastIndex(manifest, "/") {
+		repository, reference = manifest[:index], manifest[index+1:]
+	}
+
+	if repository == "" || reference == "" {
+		return "", "", errors.Errorf("Manifest must be <repository>[:<tag>|@<digest>]: %s", manifest)
+	}
+	return repository, reference, nil
+}
+
+// parseBearerChallenge parses a WWW-Authenticate header of the Bearer scheme,
+// e.g.: Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseBearerChallenge(header string) (*challenge, bool) {
+	scheme, parameters := header, ""
+	if index := strings.Index(header, " "); index != -1 {
+		scheme, parameters = header[:index], header[index+1:]
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return nil, false
+	}
+
+	bearerChallenge := &challenge{}
+	for _, parameter := range splitChallengeParameters(parameters) {
+		keyValue := strings.SplitN(parameter, "=", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		value := strings.Trim(strings.TrimSpace(keyValue[1]), `"`)
+		switch strings.ToLower(strings.TrimSpace(keyValue[0])) {
+		case "realm":
+			bearerChallenge.realm = value
+		case "service":
+			bearerChallenge.service = value
+		}
+	}
+
+	return bearerChallenge, bearerChallenge.realm != ""
+}
+
+// splitChallengeParameters splits challenge parameters by commas outside of quoted values
+func splitChallengeParameters(parameters string) []string {
+	var splitParameters []string
+	quoted := false
+	start := 0
+	for index, character := range parameters {
+		switch {
+		case character == '"':
+			quoted = !quoted
+		case character == ',' && !quoted:
+			splitParameters = append(splitParameters, parameters[start:index])
+			start = index + 1
+		}
+	}
+	return append(splitParameters, parameters[start:])
+}
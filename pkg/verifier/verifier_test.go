@@ -0,0 +1,270 @@
+package verifier
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+	"github.com/v3io/registry-creds-handler/pkg/registry"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+	"github.com/stretchr/testify/suite"
+)
+
+// fakeRegistry is a registry stand-in accepting a single username and password, either directly (as ECR does)
+// or through a bearer token service (as docker hub does)
+type fakeRegistry struct {
+	server        *httptest.Server
+	username      string
+	password      string
+	identityToken string
+	bearer        bool
+	manifests     map[string]bool
+	grantedScopes []string
+}
+
+func newFakeRegistry(bearer bool) *fakeRegistry {
+	registry := &fakeRegistry{
+		username:      "AWS",
+		password:      "good",
+		identityToken: "identity",
+		bearer:        bearer,
+		manifests:     map[string]bool{"team/app/manifests/1.0": true},
+	}
+	registry.server = httptest.NewServer(registry)
+	return registry
+}
+
+func (r *fakeRegistry) ServeHTTP(responseWriter http.ResponseWriter, request *http.Request) {
+	if request.URL.Path == "/token" {
+		scope := request.URL.Query().Get("scope")
+		username, password, found := request.BasicAuth()
+		switch {
+
+		// identity tokens are exchanged through the oauth2 refresh token grant
+		case request.Method == http.MethodPost:
+			if request.PostFormValue("grant_type") != "refresh_token" ||
+				request.PostFormValue("refresh_token") != r.identityToken {
+				responseWriter.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			scope = request.PostFormValue("scope")
+			json.NewEncoder(responseWriter).Encode(map[string]string{"access_token": "bearer-token"})
+
+		// anonymous requests get a token of public repositories, as docker hub does
+		case !found:
+			json.NewEncoder(responseWriter).Encode(map[string]string{"token": "anonymous-token"})
+			return
+
+		case username != r.username || password != r.password:
+			responseWriter.WriteHeader(http.StatusUnauthorized)
+			return
+
+		default:
+			json.NewEncoder(responseWriter).Encode(map[string]string{"token": "bearer-token"})
+		}
+		r.grantedScopes = append(r.grantedScopes, scope)
+		return
+	}
+
+	if !r.isAuthorized(request) {
+		if r.bearer {
+			responseWriter.Header().Set("WWW-Authenticate",
+				fmt.Sprintf(`Bearer realm="%s/token",service="fake,registry"`, r.server.URL))
+		} else {
+			responseWriter.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+		}
+		responseWriter.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if request.URL.Path == "/v2/" || r.manifests[strings.TrimPrefix(request.URL.Path, "/v2/")] {
+		responseWriter.WriteHeader(http.StatusOK)
+		return
+	}
+	responseWriter.WriteHeader(http.StatusNotFound)
+}
+
+func (r *fakeRegistry) isAuthorized(request *http.Request) bool {
+	if r.bearer {
+		return request.Header.Get("Authorization") == "Bearer bearer-token"
+	}
+	username, password, _ := request.BasicAuth()
+	return username == r.username && password == r.password
+}
+
+func (r *fakeRegistry) compileToken(password string) *registry.Token {
+	registryURL, _ := url.Parse(r.server.URL)
+	return &registry.Token{
+		Username:    r.username,
+		Password:    password,
+		RegistryUri: registryURL.Host,
+	}
+}
+
+type VerifierSuite struct {
+	suite.Suite
+	logger logger.Logger
+}
+
+func (suite *VerifierSuite) SetupTest() {
+	suite.logger, _ = common.CreateLogger("test", true, os.Stdout, "humanreadable")
+}
+
+func (suite *VerifierSuite) TestVerify() {
+	for _, testCase := range []struct {
+		name          string
+		bearer        bool
+		password      string
+		manifest      string
+		expectedError string
+	}{
+		{name: "basicLogin", password: "good"},
+		{name: "bearerLogin", bearer: true, password: "good"},
+		{name: "basicManifest", password: "good", manifest: "team/app:1.0"},
+		{name: "bearerManifest", bearer: true, password: "good", manifest: "team/app:1.0"},
+		{
+			name:          "basicUnauthorized",
+			password:      "bad",
+			expectedError: "Registry rejected the credentials (401 Unauthorized)",
+		},
+		{
+			name:          "bearerUnauthorized",
+			bearer:        true,
+			password:      "bad",
+			expectedError: "Token service rejected the credentials (401 Unauthorized)",
+		},
+		{
+			name:          "missingManifest",
+			password:      "good",
+			manifest:      "team/app:2.0",
+			expectedError: "Registry replied 404 Not Found",
+		},
+	} {
+		suite.Run(testCase.name, func() {
+			fakeRegistry := newFakeRegistry(testCase.bearer)
+			defer fakeRegistry.server.Close()
+
+			verifier, err := NewVerifier(suite.logger, Options{Manifest: testCase.manifest, PlainHTTP: true})
+			suite.Require().NoError(err)
+
+			err = verifier.Verify(context.Background(), fakeRegistry.compileToken(testCase.password))
+			if testCase.expectedError != "" {
+				suite.Require().Error(err)
+				suite.Require().Equal(testCase.expectedError, errors.RootCause(err).Error())
+				return
+			}
+			suite.Require().NoError(err)
+
+			if testCase.bearer && testCase.manifest != "" {
+				suite.Require().Contains(fakeRegistry.grantedScopes, "repository:team/app:pull")
+			}
+		})
+	}
+}
+
+func (suite *VerifierSuite) TestVerifyIdentityToken() {
+	for _, testCase := range []struct {
+		name          string
+		token         *registry.Token
+		expectedError string
+	}{
+		{name: "identityToken", token: &registry.Token{IdentityToken: "identity"}},
+		{
+			name:          "badIdentityToken",
+			token:         &registry.Token{IdentityToken: "expired"},
+			expectedError: "Token service rejected the credentials (401 Unauthorized)",
+		},
+		{
+			name:          "noCredentials",
+			token:         &registry.Token{},
+			expectedError: "Token has no credentials to verify",
+		},
+	} {
+		suite.Run(testCase.name, func() {
+			fakeRegistry := newFakeRegistry(true)
+			defer fakeRegistry.server.Close()
+
+			verifier, err := NewVerifier(suite.logger, Options{Manifest: "team/app:1.0", PlainHTTP: true})
+			suite.Require().NoError(err)
+
+			registryURL, _ := url.Parse(fakeRegistry.server.URL)
+			testCase.token.RegistryUri = registryURL.Host
+			err = verifier.Verify(context.Background(), testCase.token)
+			if testCase.expectedError != "" {
+				suite.Require().Error(err)
+				suite.Require().Equal(testCase.expectedError, errors.RootCause(err).Error())
+				return
+			}
+			suite.Require().NoError(err)
+			suite.Require().Contains(fakeRegistry.grantedScopes, "repository:team/app:pull")
+		})
+	}
+}
+
+func (suite *VerifierSuite) TestVerifyEveryRegistry() {
+	fakeRegistry := newFakeRegistry(false)
+	defer fakeRegistry.server.Close()
+	replicaRegistry := newFakeRegistry(true)
+	defer replicaRegistry.server.Close()
+
+	verifier, err := NewVerifier(suite.logger, Options{Manifest: "team/app:1.0", PlainHTTP: true})
+	suite.Require().NoError(err)
+
+	// the token is published under an alias of its registry and a replica, which are verified too
+	token := fakeRegistry.compileToken("good")
+	replicaURL, _ := url.Parse(replicaRegistry.server.URL)
+	token.RegistryUris = []string{token.RegistryUri + "/prefix", replicaURL.Host}
+	suite.Require().NoError(verifier.Verify(context.Background(), token))
+
+	// the manifest is only fetched from the first registry, the replica is logged in to without a scope
+	suite.Require().Equal([]string{""}, replicaRegistry.grantedScopes)
+
+	// a registry rejecting the token fails it
+	replicaRegistry.password = "other"
+	err = verifier.Verify(context.Background(), token)
+	suite.Require().Error(err)
+	suite.Require().Contains(err.Error(), replicaURL.Host)
+}
+
+func (suite *VerifierSuite) TestParseManifest() {
+	for _, testCase := range []struct {
+		manifest           string
+		expectedRepository string
+		expectedReference  string
+	}{
+		{manifest: "team/app", expectedRepository: "team/app", expectedReference: "latest"},
+		{manifest: "team/app:1.0", expectedRepository: "team/app", expectedReference: "1.0"},
+		{manifest: "team/app@sha256:abc", expectedRepository: "team/app", expectedReference: "sha256:abc"},
+	} {
+		repository, reference, err := parseManifest(testCase.manifest)
+		suite.Require().NoError(err)
+		suite.Require().Equal(testCase.expectedRepository, repository)
+		suite.Require().Equal(testCase.expectedReference, reference)
+	}
+
+	_, _, err := parseManifest("team/app:")
+	suite.Require().Error(err)
+}
+
+func (suite *VerifierSuite) TestParseBearerChallenge() {
+	bearerChallenge, found := parseBearerChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io"`)
+	suite.Require().True(found)
+	suite.Require().Equal("https://auth.docker.io/token", bearerChallenge.realm)
+	suite.Require().Equal("registry.docker.io", bearerChallenge.service)
+
+	_, found = parseBearerChallenge(`Basic realm="fake"`)
+	suite.Require().False(found)
+}
+
+func TestVerifierSuite(t *testing.T) {
+	suite.Run(t, new(VerifierSuite))
+}
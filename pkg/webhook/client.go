@@ -0,0 +1,226 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nuclio/errors"
+	"github.com/nuclio/logger"
+)
+
+const (
+	SignatureHeader          = "X-Registry-Creds-Signature"
+	SignatureTimestampHeader = "X-Registry-Creds-Timestamp"
+
+	defaultMaxRetries = 3
+	defaultTimeout    = 30
+)
+
+// Options describe a webhook and how to reach it
+type Options struct {
+
+	// URL is where requests are POSTed to
+	URL string `json:"url,omitempty"`
+
+	// Headers are added to every request
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// SigningKeyPath and SigningKeyEnv hold the HMAC key requests are signed with, requests are not signed
+	// when neither is set. The signature is hex(HMAC-SHA256(key, timestamp + "." + body)), given as
+	// sha256=<signature> in the X-Registry-Creds-Signature header along with X-Registry-Creds-Timestamp
+	SigningKeyPath string `json:"signingKeyPath,omitempty"`
+	SigningKeyEnv  string `json:"signingKeyEnv,omitempty"`
+
+	// MaxRetries is how many times a request failing with a network error, a 429 or a 5xx is retried
+	// (default: 3, -1 to disable)
+	MaxRetries int `json:"maxRetries,omitempty"`
+
+	// Timeout is the request timeout in seconds (default: 30)
+	Timeout int64 `json:"timeout,omitempty"`
+
+	// CACertPath verifies the server, ClientCertPath and ClientKeyPath authenticate the client (mTLS)
+	CACertPath     string `json:"caCertPath,omitempty"`
+	ClientCertPath string `json:"clientCertPath,omitempty"`
+	ClientKeyPath  string `json:"clientKeyPath,omitempty"`
+}
+
+// Client POSTs signed JSON requests to a webhook, retrying transient failures
+type Client struct {
+	logger     logger.Logger
+	options    Options
+	httpClient *http.Client
+	signingKey []byte
+
+	// retryInterval is the first retry backoff, doubled on every retry
+	retryInterval time.Duration
+}
+
+func NewClient(parentLogger logger.Logger, options Options) (*Client, error) {
+	if options.URL == "" {
+		return nil, errors.New("Webhook URL must not be empty")
+	}
+	if options.MaxRetries == 0 {
+		options.MaxRetries = defaultMaxRetries
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = defaultTimeout
+	}
+
+	newClient := &Client{
+		logger:        parentLogger.GetChild("webhook"),
+		options:       options,
+		retryInterval: time.Second,
+	}
+
+	var err error
+	if newClient.signingKey, err = readSigningKey(options); err != nil {
+		return nil, errors.Wrap(err, "Failed to read signing key")
+	}
+
+	tlsConfig, err := compileTLSConfig(options)
+	if err != nil {
+		return nil, errors.Wrap(err, "Failed to compile TLS config")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	newClient.httpClient = &http.Client{
+		Transport: transport,
+		Timeout:   time.Duration(options.Timeout) * time.Second,
+	}
+
+	return newClient, nil
+}
+
+// Post sends body as JSON, retrying transient failures with an exponential backoff
+func (c *Client) Post(ctx context.Context, body interface{}) error {
+	encodedBody, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "Failed to encode body")
+	}
+
+	retryInterval := c.retryInterval
+	for attempt := 0; ; attempt++ {
+		retryable, err := c.post(ctx, encodedBody)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= c.options.MaxRetries {
+			return errors.Wrapf(err, "Failed to post to webhook after %d attempts", attempt+1)
+		}
+
+		c.logger.DebugWithCtx(ctx, "Failed to post to webhook, retrying",
+			"attempt", attempt+1,
+			"retryInterval", retryInterval,
+			"err", err.Error())
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ctx.Err(), "Context was canceled while retrying")
+		case <-time.After(retryInterval):
+		}
+		retryInterval *= 2
+	}
+}
+
+// String describes the webhook by its URL
+func (c *Client) String() string {
+	return c.options.URL
+}
+
+// post sends a single request, returns whether its failure is transient
+func (c *Client) post(ctx context.Context, encodedBody []byte) (bool, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, c.options.URL, bytes.NewReader(encodedBody))
+	if err != nil {
+		return false, errors.Wrap(err, "Failed to create request")
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for name, value := range c.options.Headers {
+		request.Header.Set(name, value)
+	}
+	if len(c.signingKey) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		request.Header.Set(SignatureTimestampHeader, timestamp)
+		request.Header.Set(SignatureHeader, "sha256="+Sign(c.signingKey, timestamp, encodedBody))
+	}
+
+	response, err := c.httpClient.Do(request)
+	if err != nil {
+		return true, errors.Wrap(err, "Failed to send request")
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= http.StatusMultipleChoices {
+		encodedResponse, _ := io.ReadAll(io.LimitReader(response.Body, 1024))
+		return response.StatusCode == http.StatusTooManyRequests ||
+				response.StatusCode >= http.StatusInternalServerError,
+			errors.Errorf("Webhook replied with status %d: %s",
+				response.StatusCode,
+				strings.TrimSpace(string(encodedResponse)))
+	}
+	return false, nil
+}
+
+// Sign returns the hex encoded HMAC-SHA256 signature of a request, as receivers should compute it
+func Sign(signingKey []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, signingKey)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func readSigningKey(options Options) ([]byte, error) {
+	switch {
+	case options.SigningKeyPath != "":
+		signingKey, err := os.ReadFile(options.SigningKeyPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read signing key file: %s", options.SigningKeyPath)
+		}
+		return bytes.TrimSpace(signingKey), nil
+	case options.SigningKeyEnv != "":
+		signingKey := strings.TrimSpace(os.Getenv(options.SigningKeyEnv))
+		if signingKey == "" {
+			return nil, errors.Errorf("Signing key env is empty: %s", options.SigningKeyEnv)
+		}
+		return []byte(signingKey), nil
+	default:
+		return nil, nil
+	}
+}
+
+func compileTLSConfig(options Options) (*tls.Config, error) {
+	tlsConfig := &tls.Config{}
+
+	if options.CACertPath != "" {
+		caCert, err := os.ReadFile(options.CACertPath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Failed to read CA cert: %s", options.CACertPath)
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(caCert) {
+			return nil, errors.Errorf("No certificates found in CA cert: %s", options.CACertPath)
+		}
+	}
+
+	if options.ClientCertPath != "" || options.ClientKeyPath != "" {
+		clientCert, err := tls.LoadX509KeyPair(options.ClientCertPath, options.ClientKeyPath)
+		if err != nil {
+			return nil, errors.Wrap(err, "Failed to load client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{clientCert}
+	}
+
+	return tlsConfig, nil
+}
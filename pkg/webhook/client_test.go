@@ -0,0 +1,80 @@
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/v3io/registry-creds-handler/pkg/common"
+
+	"github.com/nuclio/errors"
+	"github.com/stretchr/testify/suite"
+)
+
+type ClientSuite struct {
+	suite.Suite
+}
+
+func (suite *ClientSuite) TestPostSignsAndRetries() {
+	signingKeyPath := filepath.Join(suite.T().TempDir(), "signing-key")
+	err := os.WriteFile(signingKeyPath, []byte("signing key\n"), 0600)
+	suite.Require().NoError(err)
+
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		attempts++
+		if attempts < 3 {
+			http.Error(responseWriter, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		body, err := io.ReadAll(request.Body)
+		suite.Require().NoError(err)
+		suite.Require().JSONEq(`{"event":"refresh"}`, string(body))
+		suite.Require().Equal("value", request.Header.Get("X-Custom"))
+		suite.Require().Equal(
+			"sha256="+Sign([]byte("signing key"), request.Header.Get(SignatureTimestampHeader), body),
+			request.Header.Get(SignatureHeader))
+	}))
+	defer server.Close()
+
+	client := suite.createClient(Options{
+		URL:            server.URL,
+		Headers:        map[string]string{"X-Custom": "value"},
+		SigningKeyPath: signingKeyPath,
+	})
+	err = client.Post(context.Background(), map[string]string{"event": "refresh"})
+	suite.Require().NoError(err)
+	suite.Require().Equal(3, attempts)
+}
+
+func (suite *ClientSuite) TestPostDoesNotRetryClientErrors() {
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(responseWriter http.ResponseWriter, request *http.Request) {
+		attempts++
+		http.Error(responseWriter, "bad signature", http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	client := suite.createClient(Options{URL: server.URL})
+	err := client.Post(context.Background(), map[string]string{"event": "refresh"})
+	suite.Require().Error(err)
+	suite.Require().Contains(errors.RootCause(err).Error(), "bad signature")
+	suite.Require().Equal(1, attempts)
+}
+
+func (suite *ClientSuite) createClient(options Options) *Client {
+	loggerInstance, _ := common.CreateLogger("test", true, os.Stdout, "humanreadable")
+	client, err := NewClient(loggerInstance, options)
+	suite.Require().NoError(err)
+	client.retryInterval = 0
+	return client
+}
+
+func TestClient(t *testing.T) {
+	suite.Run(t, new(ClientSuite))
+}